@@ -1,17 +1,43 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"github.com/DavidGQK/go-link-shortener/internal/config"
 	"github.com/DavidGQK/go-link-shortener/internal/logger"
 	"github.com/DavidGQK/go-link-shortener/internal/router"
 	"github.com/DavidGQK/go-link-shortener/internal/server"
 	"github.com/DavidGQK/go-link-shortener/internal/storage/initstorage"
+	"github.com/DavidGQK/go-link-shortener/internal/tlsconfig"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// shutdownTimeout bounds how long requests in flight are waited for on
+// shutdown.
+const shutdownTimeout = 10 * time.Second
+
+// Timeouts of every http listener, so slow clients can't hold connections.
+const (
+	readHeaderTimeout = 10 * time.Second
+	readTimeout       = 30 * time.Second
+	writeTimeout      = 30 * time.Second
+	idleTimeout       = 2 * time.Minute
 )
 
 func runServer(cfg *config.Config) error {
-	st, err := initstorage.NewStorage(cfg.Filename, cfg.DBConnData)
+	if err := logger.Initialize(cfg.LoggingLevel); err != nil {
+		return err
+	}
+
+	st, err := initstorage.NewStorage(cfg.Filename, cfg.DBConnData, cfg.DedupScope)
 	if err != nil {
 		return err
 	}
@@ -22,19 +48,143 @@ func runServer(cfg *config.Config) error {
 		}
 	}
 
-	s := server.New(cfg, st)
-	if err := logger.Initialize(cfg.LoggingLevel); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	s, err := server.New(cfg, st)
+	if err != nil {
 		return err
 	}
+	defer s.Close()
 
 	r := router.NewRouter(s)
 
-	logger.Log.Infow("server start", "address", cfg.ServerURL)
-	return http.ListenAndServe(cfg.ServerURL, r)
+	var tlsConfig *tls.Config
+	if cfg.TLSEnabled() {
+		var reloader *tlsconfig.Reloader
+		tlsConfig, reloader, err = tlsconfig.New(tlsconfig.Options{
+			CertFile:     cfg.TLSCertFile,
+			KeyFile:      cfg.TLSKeyFile,
+			MinVersion:   cfg.TLSMinVersion,
+			CipherSuites: cfg.TLSCipherSuites,
+		})
+		if err != nil {
+			return err
+		}
+
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+		// ctx is done on shutdown and when runServer returns
+		go reloader.Watch(ctx, cfg.TLSReloadInterval, hup)
+	}
+
+	if cfg.GRPCAddress != "" {
+		listener, err := net.Listen("tcp", cfg.GRPCAddress)
+		if err != nil {
+			return err
+		}
+
+		var opts []grpc.ServerOption
+		if tlsConfig != nil {
+			opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig.Clone())))
+		}
+		grpcServer := server.NewGRPCServer(&s, opts...)
+		go func() {
+			logger.Log.Infow("grpc server start", "address", cfg.GRPCAddress)
+			if err := grpcServer.Serve(listener); err != nil {
+				logger.Log.Error("grpc server error", zap.Error(err))
+			}
+		}()
+		defer stopGRPC(grpcServer)
+	}
+
+	srv := newHTTPServer(cfg.ServerURL, r)
+	srv.TLSConfig = tlsConfig
+
+	serveErr := make(chan error, 1)
+	if tlsConfig == nil {
+		logger.Log.Infow("server start", "address", cfg.ServerURL)
+		go func() {
+			serveErr <- srv.ListenAndServe()
+		}()
+		return waitShutdown(ctx, serveErr, srv)
+	}
+
+	servers := []*http.Server{srv}
+	if cfg.TLSRedirectAddress != "" {
+		redirect := newHTTPServer(cfg.TLSRedirectAddress, tlsconfig.RedirectHandler(cfg.ServerURL))
+		servers = append(servers, redirect)
+		go func() {
+			logger.Log.Infow("redirect server start", "address", cfg.TLSRedirectAddress)
+			if err := redirect.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Log.Error("redirect server error", zap.Error(err))
+			}
+		}()
+	}
+
+	logger.Log.Infow("server start", "address", cfg.ServerURL, "tls", true)
+	go func() {
+		serveErr <- srv.ListenAndServeTLS("", "")
+	}()
+	return waitShutdown(ctx, serveErr, servers...)
+}
+
+func newHTTPServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+}
+
+// waitShutdown waits until the main server fails or ctx is done and then
+// shuts all the servers down, waiting for requests in flight.
+func waitShutdown(ctx context.Context, serveErr <-chan error, servers ...*http.Server) error {
+	var err error
+	select {
+	case err = <-serveErr:
+	case <-ctx.Done():
+		logger.Log.Infow("server shutdown")
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, srv := range servers {
+		if shutdownErr := srv.Shutdown(shutdownCtx); shutdownErr != nil {
+			srv.Close()
+			if err == nil {
+				err = shutdownErr
+			}
+		}
+	}
+	return err
+}
+
+// stopGRPC lets the calls in flight finish and cuts them off after
+// shutdownTimeout.
+func stopGRPC(srv *grpc.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(shutdownTimeout):
+		srv.Stop()
+	}
 }
 
 func main() {
-	cfg := config.GetConfig()
+	cfg, err := config.GetConfig()
+	if err != nil {
+		panic(err)
+	}
 	if err := runServer(cfg); err != nil {
 		panic(err)
 	}
@@ -1,8 +1,20 @@
 package config
 
 import (
+	"errors"
 	"flag"
+	"fmt"
+	"github.com/DavidGQK/go-link-shortener/internal/idempotency"
+	"github.com/DavidGQK/go-link-shortener/internal/metadata"
+	"github.com/DavidGQK/go-link-shortener/internal/models"
+	"github.com/DavidGQK/go-link-shortener/internal/tlsconfig"
+	"github.com/DavidGQK/go-link-shortener/internal/validation"
+	"github.com/DavidGQK/go-link-shortener/internal/webhook"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Config struct {
@@ -11,6 +23,53 @@ type Config struct {
 	LoggingLevel string
 	Filename     string
 	DBConnData   string
+
+	NormalizeSortQuery     bool
+	NormalizeStripFragment bool
+
+	AllowedSchemes    string
+	MaxURLLength      int
+	AllowPrivateHosts bool
+
+	DomainBlocklist string
+	DomainAllowlist string
+
+	DedupScope string
+
+	RedirectStatus      int
+	RedirectCacheMaxAge int
+	RedirectBody        bool
+
+	PasswordMaxAttempts int
+	PasswordLockout     time.Duration
+
+	ScheduleFallbackURL string
+	SchedulePageFile    string
+
+	QueryPolicy string
+
+	ShortDomains string
+
+	FetchMetadata    bool
+	MetadataWorkers  int
+	MetadataTimeout  time.Duration
+	MetadataMaxBytes int64
+
+	WebhookWorkers     int
+	WebhookMaxAttempts int
+	WebhookBackoff     time.Duration
+	WebhookTimeout     time.Duration
+
+	GRPCAddress string
+
+	IdempotencyTTL time.Duration
+
+	TLSCertFile        string
+	TLSKeyFile         string
+	TLSMinVersion      string
+	TLSCipherSuites    string
+	TLSReloadInterval  time.Duration
+	TLSRedirectAddress string
 }
 
 func loadFlagConfig(AppConfig *Config) {
@@ -19,6 +78,39 @@ func loadFlagConfig(AppConfig *Config) {
 	flag.StringVar(&AppConfig.LoggingLevel, "l", "info", "logging level")
 	flag.StringVar(&AppConfig.Filename, "f", "/tmp/short-url-db.json", "storage")
 	flag.StringVar(&AppConfig.DBConnData, "d", "", "data for db connection")
+	flag.BoolVar(&AppConfig.NormalizeSortQuery, "normalize-sort-query", false, "sort query parameters of shortened urls")
+	flag.BoolVar(&AppConfig.NormalizeStripFragment, "normalize-strip-fragment", false, "strip fragments of shortened urls")
+	flag.StringVar(&AppConfig.AllowedSchemes, "allowed-schemes", validation.DefaultAllowedSchemes, "comma separated url schemes allowed for shortening")
+	flag.IntVar(&AppConfig.MaxURLLength, "max-url-length", validation.DefaultMaxLength, "maximum length of a shortened url")
+	flag.BoolVar(&AppConfig.AllowPrivateHosts, "allow-private-hosts", false, "allow shortening urls with private and loopback hosts")
+	flag.StringVar(&AppConfig.DomainBlocklist, "domain-blocklist", "", "file with blocked destination domains")
+	flag.StringVar(&AppConfig.DomainAllowlist, "domain-allowlist", "", "file with allowed destination domains")
+	flag.StringVar(&AppConfig.DedupScope, "dedup-scope", "", "deduplication scope of original urls: global, user or none; repeated urls get 409 unless none. Defaults to global with a database and none for memory and file storages")
+	flag.IntVar(&AppConfig.RedirectStatus, "redirect-status", http.StatusTemporaryRedirect, "default redirect status: 301, 302, 307 or 308")
+	flag.IntVar(&AppConfig.RedirectCacheMaxAge, "redirect-cache-max-age", 86400, "max-age in seconds for permanent redirects")
+	flag.BoolVar(&AppConfig.RedirectBody, "redirect-body", true, "write the destination url into the redirect body")
+	flag.IntVar(&AppConfig.PasswordMaxAttempts, "password-max-attempts", 5, "failed link password attempts before lockout")
+	flag.DurationVar(&AppConfig.PasswordLockout, "password-lockout", 15*time.Minute, "lockout period after too many failed link password attempts")
+	flag.StringVar(&AppConfig.ScheduleFallbackURL, "schedule-fallback-url", "", "url to redirect to before a link becomes active")
+	flag.StringVar(&AppConfig.SchedulePageFile, "schedule-page", "", "html template shown before a link becomes active")
+	flag.StringVar(&AppConfig.QueryPolicy, "query-policy", models.QueryPolicyDrop, "what to do with the query string of short url visits: append, merge_incoming, merge_stored or drop")
+	flag.StringVar(&AppConfig.ShortDomains, "short-domains", "", "comma separated base urls of additional short link domains")
+	flag.BoolVar(&AppConfig.FetchMetadata, "fetch-metadata", false, "fetch titles and icons of shortened pages in the background")
+	flag.IntVar(&AppConfig.MetadataWorkers, "metadata-workers", metadata.DefaultWorkers, "number of background metadata fetchers")
+	flag.DurationVar(&AppConfig.MetadataTimeout, "metadata-timeout", metadata.DefaultTimeout, "timeout of a single metadata fetch")
+	flag.Int64Var(&AppConfig.MetadataMaxBytes, "metadata-max-bytes", metadata.DefaultMaxBytes, "maximum size of a page read for metadata")
+	flag.IntVar(&AppConfig.WebhookWorkers, "webhook-workers", webhook.DefaultWorkers, "number of webhook delivery workers")
+	flag.IntVar(&AppConfig.WebhookMaxAttempts, "webhook-attempts", webhook.DefaultMaxAttempts, "delivery attempts before a webhook event is dead-lettered")
+	flag.DurationVar(&AppConfig.WebhookBackoff, "webhook-backoff", webhook.DefaultBackoff, "delay before the first webhook retry, doubled on every attempt")
+	flag.DurationVar(&AppConfig.WebhookTimeout, "webhook-timeout", webhook.DefaultTimeout, "timeout of a single webhook delivery")
+	flag.StringVar(&AppConfig.GRPCAddress, "grpc-address", "", "address of the grpc server, empty disables it")
+	flag.DurationVar(&AppConfig.IdempotencyTTL, "idempotency-ttl", idempotency.DefaultTTL, "how long responses to idempotency keys are replayed, 0 disables them")
+	flag.StringVar(&AppConfig.TLSCertFile, "tls-cert", "", "tls certificate file, serves https together with -tls-key")
+	flag.StringVar(&AppConfig.TLSKeyFile, "tls-key", "", "tls private key file")
+	flag.StringVar(&AppConfig.TLSMinVersion, "tls-min-version", tlsconfig.DefaultMinVersion, "minimum tls version: 1.0, 1.1, 1.2 or 1.3")
+	flag.StringVar(&AppConfig.TLSCipherSuites, "tls-cipher-suites", "", "comma separated tls cipher suites, empty keeps the defaults")
+	flag.DurationVar(&AppConfig.TLSReloadInterval, "tls-reload-interval", tlsconfig.DefaultReloadInterval, "how often the certificate files are checked for changes")
+	flag.StringVar(&AppConfig.TLSRedirectAddress, "tls-redirect-address", "", "address of the listener redirecting http to https, empty disables it")
 
 	flag.Parse()
 }
@@ -43,13 +135,157 @@ func loadEnvConfig(AppConfig *Config) {
 	if envDBConnData := os.Getenv("DATABASE_DSN"); envDBConnData != "" {
 		AppConfig.DBConnData = envDBConnData
 	}
+
+	loadEnvBool("NORMALIZE_SORT_QUERY", &AppConfig.NormalizeSortQuery)
+	loadEnvBool("NORMALIZE_STRIP_FRAGMENT", &AppConfig.NormalizeStripFragment)
+
+	if envAllowedSchemes := os.Getenv("ALLOWED_SCHEMES"); envAllowedSchemes != "" {
+		AppConfig.AllowedSchemes = envAllowedSchemes
+	}
+
+	loadEnvInt("MAX_URL_LENGTH", &AppConfig.MaxURLLength)
+	loadEnvBool("ALLOW_PRIVATE_HOSTS", &AppConfig.AllowPrivateHosts)
+
+	if envDomainBlocklist := os.Getenv("DOMAIN_BLOCKLIST_FILE"); envDomainBlocklist != "" {
+		AppConfig.DomainBlocklist = envDomainBlocklist
+	}
+
+	if envDomainAllowlist := os.Getenv("DOMAIN_ALLOWLIST_FILE"); envDomainAllowlist != "" {
+		AppConfig.DomainAllowlist = envDomainAllowlist
+	}
+
+	if envDedupScope := os.Getenv("DEDUP_SCOPE"); envDedupScope != "" {
+		AppConfig.DedupScope = envDedupScope
+	}
+
+	loadEnvInt("REDIRECT_STATUS", &AppConfig.RedirectStatus)
+	loadEnvInt("REDIRECT_CACHE_MAX_AGE", &AppConfig.RedirectCacheMaxAge)
+	loadEnvBool("REDIRECT_BODY", &AppConfig.RedirectBody)
+
+	loadEnvInt("PASSWORD_MAX_ATTEMPTS", &AppConfig.PasswordMaxAttempts)
+	loadEnvDuration("PASSWORD_LOCKOUT", &AppConfig.PasswordLockout)
+
+	if envScheduleFallbackURL := os.Getenv("SCHEDULE_FALLBACK_URL"); envScheduleFallbackURL != "" {
+		AppConfig.ScheduleFallbackURL = envScheduleFallbackURL
+	}
+
+	if envSchedulePageFile := os.Getenv("SCHEDULE_PAGE_FILE"); envSchedulePageFile != "" {
+		AppConfig.SchedulePageFile = envSchedulePageFile
+	}
+
+	if envQueryPolicy := os.Getenv("QUERY_POLICY"); envQueryPolicy != "" {
+		AppConfig.QueryPolicy = envQueryPolicy
+	}
+
+	if envShortDomains := os.Getenv("SHORT_DOMAINS"); envShortDomains != "" {
+		AppConfig.ShortDomains = envShortDomains
+	}
+
+	loadEnvBool("FETCH_METADATA", &AppConfig.FetchMetadata)
+	loadEnvInt("METADATA_WORKERS", &AppConfig.MetadataWorkers)
+	loadEnvDuration("METADATA_TIMEOUT", &AppConfig.MetadataTimeout)
+
+	if env := os.Getenv("METADATA_MAX_BYTES"); env != "" {
+		if parsed, err := strconv.ParseInt(env, 10, 64); err == nil {
+			AppConfig.MetadataMaxBytes = parsed
+		}
+	}
+
+	loadEnvInt("WEBHOOK_WORKERS", &AppConfig.WebhookWorkers)
+	loadEnvInt("WEBHOOK_ATTEMPTS", &AppConfig.WebhookMaxAttempts)
+	loadEnvDuration("WEBHOOK_BACKOFF", &AppConfig.WebhookBackoff)
+	loadEnvDuration("WEBHOOK_TIMEOUT", &AppConfig.WebhookTimeout)
+
+	if envGRPCAddress, found := os.LookupEnv("GRPC_ADDRESS"); found {
+		AppConfig.GRPCAddress = envGRPCAddress
+	}
+
+	loadEnvDuration("IDEMPOTENCY_TTL", &AppConfig.IdempotencyTTL)
+
+	if envTLSCertFile := os.Getenv("TLS_CERT_FILE"); envTLSCertFile != "" {
+		AppConfig.TLSCertFile = envTLSCertFile
+	}
+	if envTLSKeyFile := os.Getenv("TLS_KEY_FILE"); envTLSKeyFile != "" {
+		AppConfig.TLSKeyFile = envTLSKeyFile
+	}
+	if envTLSMinVersion := os.Getenv("TLS_MIN_VERSION"); envTLSMinVersion != "" {
+		AppConfig.TLSMinVersion = envTLSMinVersion
+	}
+	if envTLSCipherSuites := os.Getenv("TLS_CIPHER_SUITES"); envTLSCipherSuites != "" {
+		AppConfig.TLSCipherSuites = envTLSCipherSuites
+	}
+	loadEnvDuration("TLS_RELOAD_INTERVAL", &AppConfig.TLSReloadInterval)
+	if envTLSRedirectAddress, found := os.LookupEnv("TLS_REDIRECT_ADDRESS"); found {
+		AppConfig.TLSRedirectAddress = envTLSRedirectAddress
+	}
+}
+
+func loadEnvBool(name string, value *bool) {
+	if env := os.Getenv(name); env != "" {
+		if parsed, err := strconv.ParseBool(env); err == nil {
+			*value = parsed
+		}
+	}
+}
+
+func loadEnvInt(name string, value *int) {
+	if env := os.Getenv(name); env != "" {
+		if parsed, err := strconv.Atoi(env); err == nil {
+			*value = parsed
+		}
+	}
+}
+
+func loadEnvDuration(name string, value *time.Duration) {
+	if env := os.Getenv(name); env != "" {
+		if parsed, err := time.ParseDuration(env); err == nil {
+			*value = parsed
+		}
+	}
 }
 
-func GetConfig() *Config {
+func GetConfig() (*Config, error) {
 	var AppConfig Config
 
 	loadFlagConfig(&AppConfig)
 	loadEnvConfig(&AppConfig)
 
-	return &AppConfig
+	// the default base url follows the scheme of the server
+	if AppConfig.TLSEnabled() && !isBaseURLSet() {
+		AppConfig.ShortURLBase = "https://" + strings.TrimPrefix(AppConfig.ShortURLBase, "http://")
+	}
+
+	if err := AppConfig.validate(); err != nil {
+		return nil, err
+	}
+	return &AppConfig, nil
+}
+
+func (c *Config) validate() error {
+	switch c.DedupScope {
+	case "", models.DedupScopeGlobal, models.DedupScopeUser, models.DedupScopeNone:
+	default:
+		return fmt.Errorf("unknown dedup scope %q, want global, user or none", c.DedupScope)
+	}
+
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return errors.New("tls needs both the certificate and the key file")
+	}
+	return nil
+}
+
+// TLSEnabled tells whether the server serves https. validate makes sure
+// the certificate and the key are set together.
+func (c *Config) TLSEnabled() bool {
+	return c.TLSCertFile != "" && c.TLSKeyFile != ""
+}
+
+func isBaseURLSet() bool {
+	set := os.Getenv("BASE_URL") != ""
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "b" {
+			set = true
+		}
+	})
+	return set
 }
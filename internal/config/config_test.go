@@ -0,0 +1,19 @@
+package config
+
+import (
+	"github.com/DavidGQK/go-link-shortener/internal/models"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_validate(t *testing.T) {
+	for _, scope := range []string{"", models.DedupScopeGlobal, models.DedupScopeUser, models.DedupScopeNone} {
+		assert.NoError(t, (&Config{DedupScope: scope}).validate(), scope)
+	}
+	assert.Error(t, (&Config{DedupScope: "users"}).validate())
+	assert.Error(t, (&Config{DedupScope: "Global"}).validate())
+
+	assert.NoError(t, (&Config{TLSCertFile: "cert.pem", TLSKeyFile: "key.pem"}).validate())
+	assert.Error(t, (&Config{TLSCertFile: "cert.pem"}).validate())
+	assert.Error(t, (&Config{TLSKeyFile: "key.pem"}).validate())
+}
@@ -0,0 +1,258 @@
+package domainlist
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultReloadInterval = 10 * time.Second
+
+var ErrBlocked = errors.New(`domain is blocked`)
+var ErrNotAllowed = errors.New(`domain is not allowed`)
+
+type List struct {
+	exact     map[string]struct{}
+	wildcards []string
+	regexps   []*regexp.Regexp
+}
+
+// ParseList reads one rule per line: an exact domain (example.com),
+// a wildcard for its subdomains (*.example.com) or a regular expression
+// wrapped in slashes (/^ads\d+\.example\.com$/). Empty lines and lines
+// starting with # are ignored.
+func ParseList(r io.Reader) (*List, error) {
+	list := &List{
+		exact: make(map[string]struct{}),
+	}
+
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		switch {
+		case len(line) > 1 && strings.HasPrefix(line, "/") && strings.HasSuffix(line, "/"):
+			re, err := regexp.Compile(line[1 : len(line)-1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNum, err)
+			}
+			list.regexps = append(list.regexps, re)
+		case strings.HasPrefix(line, "*."):
+			list.wildcards = append(list.wildcards, strings.ToLower(line[1:]))
+		default:
+			list.exact[strings.ToLower(line)] = struct{}{}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+func LoadList(path string) (*List, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ParseList(file)
+}
+
+func (l *List) Matches(host string) bool {
+	if l == nil {
+		return false
+	}
+
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if _, found := l.exact[host]; found {
+		return true
+	}
+
+	for _, suffix := range l.wildcards {
+		if strings.HasSuffix(host, suffix) {
+			return true
+		}
+	}
+
+	for _, re := range l.regexps {
+		if re.MatchString(host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (l *List) Empty() bool {
+	return l == nil || len(l.exact) == 0 && len(l.wildcards) == 0 && len(l.regexps) == 0
+}
+
+type listFile struct {
+	path    string
+	modTime time.Time
+	size    int64
+}
+
+// changed returns the file info when the file differs from the one whose
+// list was applied last, and nil otherwise.
+func (f *listFile) changed() (os.FileInfo, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return nil, nil
+	}
+	return info, nil
+}
+
+// applied records the file its list was loaded from once the list is in
+// effect, so a list that failed to apply is read again on the next reload.
+func (f *listFile) applied(info os.FileInfo) {
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+}
+
+type Engine struct {
+	mu        sync.RWMutex
+	block     *List
+	allow     *List
+	blockFile *listFile
+	allowFile *listFile
+}
+
+func NewEngine(blocklistPath, allowlistPath string) (*Engine, error) {
+	engine := &Engine{}
+
+	if blocklistPath != "" {
+		engine.blockFile = &listFile{path: blocklistPath}
+	}
+	if allowlistPath != "" {
+		engine.allowFile = &listFile{path: allowlistPath}
+	}
+
+	if _, err := engine.Reload(); err != nil {
+		return nil, err
+	}
+
+	return engine, nil
+}
+
+// Reload rereads the lists whose files changed since the previous call
+// and reports whether anything was reloaded. Both lists are parsed before
+// either is applied: on error the previously loaded lists stay in effect
+// together and the changed files are read again on the next call.
+func (e *Engine) Reload() (bool, error) {
+	block, blockInfo, err := reloadList(e.blockFile)
+	if err != nil {
+		return false, err
+	}
+
+	allow, allowInfo, err := reloadList(e.allowFile)
+	if err != nil {
+		return false, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if blockInfo != nil {
+		e.block = block
+		e.blockFile.applied(blockInfo)
+	}
+	if allowInfo != nil {
+		e.allow = allow
+		e.allowFile.applied(allowInfo)
+	}
+
+	return blockInfo != nil || allowInfo != nil, nil
+}
+
+// reloadList loads the list of a changed file along with the file info to
+// record once the list is applied. Unchanged files give no info.
+func reloadList(file *listFile) (*List, os.FileInfo, error) {
+	if file == nil {
+		return nil, nil, nil
+	}
+
+	info, err := file.changed()
+	if err != nil || info == nil {
+		return nil, nil, err
+	}
+
+	list, err := LoadList(file.path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return list, info, nil
+}
+
+func (e *Engine) Watch(ctx context.Context, interval time.Duration, onChange func(), onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		changed, err := e.Reload()
+		if err != nil {
+			onError(err)
+			continue
+		}
+
+		if changed {
+			onChange()
+		}
+	}
+}
+
+func (e *Engine) IsBlocked(host string) bool {
+	if e == nil {
+		return false
+	}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return e.block.Matches(host)
+}
+
+func (e *Engine) Check(host string) error {
+	if e == nil {
+		return nil
+	}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.block.Matches(host) {
+		return ErrBlocked
+	}
+
+	if !e.allow.Empty() && !e.allow.Matches(host) {
+		return ErrNotAllowed
+	}
+
+	return nil
+}
@@ -0,0 +1,130 @@
+package domainlist
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_ListMatches(t *testing.T) {
+	list, err := ParseList(strings.NewReader(`
+# security team list
+phishing.com
+*.evil.org
+/^ads[0-9]+\.example\.net$/
+`))
+	require.NoError(t, err)
+
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{host: "phishing.com", want: true},
+		{host: "PHISHING.com.", want: true},
+		{host: "www.phishing.com", want: false},
+		{host: "a.evil.org", want: true},
+		{host: "a.b.evil.org", want: true},
+		{host: "evil.org", want: false},
+		{host: "ads42.example.net", want: true},
+		{host: "ads.example.net", want: false},
+		{host: "practicum.yandex.ru", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			assert.Equal(t, tt.want, list.Matches(tt.host))
+		})
+	}
+}
+
+func Test_EngineReload(t *testing.T) {
+	dir := t.TempDir()
+	blocklist := filepath.Join(dir, "blocklist.txt")
+	allowlist := filepath.Join(dir, "allowlist.txt")
+	require.NoError(t, os.WriteFile(blocklist, []byte("bad.com\n"), 0666))
+	require.NoError(t, os.WriteFile(allowlist, []byte("*.com\n"), 0666))
+
+	engine, err := NewEngine(blocklist, allowlist)
+	require.NoError(t, err)
+
+	assert.ErrorIs(t, engine.Check("bad.com"), ErrBlocked)
+	assert.ErrorIs(t, engine.Check("good.org"), ErrNotAllowed)
+	assert.NoError(t, engine.Check("good.com"))
+
+	require.NoError(t, os.WriteFile(blocklist, []byte("bad.com\ngood.com\n"), 0666))
+	require.NoError(t, os.Chtimes(blocklist, time.Now(), time.Now().Add(time.Second)))
+
+	changed, err := engine.Reload()
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.True(t, engine.IsBlocked("good.com"))
+}
+
+func Test_EngineReloadAllOrNothing(t *testing.T) {
+	dir := t.TempDir()
+	blocklist := filepath.Join(dir, "blocklist.txt")
+	allowlist := filepath.Join(dir, "allowlist.txt")
+	require.NoError(t, os.WriteFile(blocklist, []byte("bad.com\n"), 0666))
+	require.NoError(t, os.WriteFile(allowlist, []byte("*.com\n"), 0666))
+
+	engine, err := NewEngine(blocklist, allowlist)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(blocklist, []byte("bad.com\ngood.com\n"), 0666))
+	require.NoError(t, os.Chtimes(blocklist, time.Now(), time.Now().Add(time.Second)))
+	require.NoError(t, os.WriteFile(allowlist, []byte("/[/\n"), 0666))
+	require.NoError(t, os.Chtimes(allowlist, time.Now(), time.Now().Add(time.Second)))
+
+	_, err = engine.Reload()
+	assert.Error(t, err)
+	assert.False(t, engine.IsBlocked("good.com"), "the lists are applied together")
+	assert.NoError(t, engine.Check("good.com"))
+
+	require.NoError(t, os.WriteFile(allowlist, []byte("*.com\n*.org\n"), 0666))
+	require.NoError(t, os.Chtimes(allowlist, time.Now(), time.Now().Add(2*time.Second)))
+
+	changed, err := engine.Reload()
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.True(t, engine.IsBlocked("good.com"), "the blocklist is retried")
+	assert.NoError(t, engine.Check("good.org"))
+}
+
+func Test_EngineWatch(t *testing.T) {
+	blocklist := filepath.Join(t.TempDir(), "blocklist.txt")
+	require.NoError(t, os.WriteFile(blocklist, []byte("bad.com\n"), 0666))
+
+	engine, err := NewEngine(blocklist, "")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	changes := make(chan struct{}, 1)
+	done := make(chan struct{})
+	go func() {
+		engine.Watch(ctx, 5*time.Millisecond, func() { changes <- struct{}{} }, func(err error) {
+			t.Error(err)
+		})
+		close(done)
+	}()
+
+	require.NoError(t, os.WriteFile(blocklist, []byte("bad.com\ngood.com\n"), 0666))
+	require.NoError(t, os.Chtimes(blocklist, time.Now(), time.Now().Add(time.Second)))
+	select {
+	case <-changes:
+	case <-time.After(time.Second):
+		t.Fatal("the change isn't noticed")
+	}
+	assert.True(t, engine.IsBlocked("good.com"))
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the watcher doesn't stop")
+	}
+}
@@ -0,0 +1,250 @@
+package idempotency
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"github.com/DavidGQK/go-link-shortener/internal/logger"
+	"github.com/DavidGQK/go-link-shortener/internal/models"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	Header         = "Idempotency-Key"
+	ReplayedHeader = "Idempotent-Replayed"
+	MaxKeyLength   = 255
+	DefaultTTL     = 24 * time.Hour
+
+	CodeInvalidKey = "invalid_idempotency_key"
+	CodeKeyReused  = "idempotency_key_reused"
+	CodeInProgress = "idempotency_key_in_progress"
+)
+
+const sweepInterval = time.Minute
+
+// storedHeaders are replayed with the response. Headers like Set-Cookie
+// belong to the client of the first request and are left out, unless the
+// request came without a session: its retry is the same client, which
+// takes the session issued to the first request.
+var (
+	storedHeaders          = []string{"Content-Type"}
+	storedAnonymousHeaders = []string{"Content-Type", "Set-Cookie"}
+)
+
+type response struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+type entry struct {
+	fingerprint [sha256.Size]byte
+	expires     time.Time
+	// resp stays nil while the first request is being handled
+	resp *response
+}
+
+// Cache keeps the first response to every idempotency key for the TTL and
+// replays it to retries of the same request.
+type Cache struct {
+	ttl       time.Duration
+	mu        sync.Mutex
+	entries   map[string]*entry
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func New(ttl time.Duration) *Cache {
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+
+	return &Cache{
+		ttl:     ttl,
+		entries: make(map[string]*entry),
+		now:     time.Now,
+	}
+}
+
+// Wrap makes h idempotent for requests with an Idempotency-Key header.
+// Keys are separate for every scope, requests without a scope can't use
+// them. A scope issued to the request itself means the client had no
+// session yet: its retries are found by the key together with the request,
+// whether they come without a session again or with the issued one. A key
+// reused with another request is rejected with 422, a retry that comes
+// while the first request is still running gets 409. Server errors aren't
+// stored, so the request can be retried with the same key.
+func (c *Cache) Wrap(h http.HandlerFunc, scope func(*http.Request) (string, bool)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(Header)
+		if key == "" {
+			h(w, r)
+			return
+		}
+		if len(key) > MaxKeyLength {
+			writeError(w, http.StatusBadRequest, CodeInvalidKey, "Idempotency key is too long")
+			return
+		}
+		scope, issued := scope(r)
+		if scope == "" {
+			writeError(w, http.StatusBadRequest, CodeInvalidKey, "Idempotency key needs a session")
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, CodeInvalidKey, "Request body can't be read")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		hash := sha256.New()
+		hash.Write([]byte(r.Method + " " + r.URL.RequestURI() + "\n"))
+		hash.Write(body)
+		var fingerprint [sha256.Size]byte
+		copy(fingerprint[:], hash.Sum(nil))
+
+		// the first id finds the entry, the others name it as well
+		ids := []string{scope + "\x00" + key}
+		headers := storedHeaders
+		if issued {
+			ids = append([]string{"\x00" + key + "\x00" + string(fingerprint[:])}, ids...)
+			headers = storedAnonymousHeaders
+		}
+		e, resp, found := c.acquire(ids, fingerprint)
+		if found {
+			switch {
+			case e.fingerprint != fingerprint:
+				writeError(w, http.StatusUnprocessableEntity, CodeKeyReused,
+					"Idempotency key was used for another request")
+			case resp == nil:
+				writeError(w, http.StatusConflict, CodeInProgress,
+					"A request with this idempotency key is in progress")
+			default:
+				replay(w, resp, issued)
+			}
+			return
+		}
+
+		rec := &recorder{ResponseWriter: w, headers: headers}
+		defer func() {
+			c.release(ids, e, rec)
+		}()
+		h(rec, r)
+	}
+}
+
+func (c *Cache) acquire(ids []string, fingerprint [sha256.Size]byte) (*entry, *response, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	c.sweep(now)
+
+	if e, found := c.entries[ids[0]]; found && now.Before(e.expires) {
+		return e, e.resp, true
+	}
+
+	e := &entry{fingerprint: fingerprint, expires: now.Add(c.ttl)}
+	for _, id := range ids {
+		c.entries[id] = e
+	}
+	return e, nil, false
+}
+
+func (c *Cache) release(ids []string, e *entry, rec *recorder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// a panicking handler leaves no status behind
+	if rec.status == 0 || rec.status >= http.StatusInternalServerError {
+		for _, id := range ids {
+			if c.entries[id] == e {
+				delete(c.entries, id)
+			}
+		}
+		return
+	}
+
+	e.resp = &response{
+		status: rec.status,
+		header: rec.header,
+		body:   rec.body.Bytes(),
+	}
+}
+
+func (c *Cache) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < sweepInterval {
+		return
+	}
+	c.lastSweep = now
+
+	for id, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, id)
+		}
+	}
+}
+
+// replay writes a stored response. The session of the first request is
+// only handed to retries that came without one.
+func replay(w http.ResponseWriter, resp *response, issued bool) {
+	for name, values := range resp.header {
+		if name == "Set-Cookie" && !issued {
+			continue
+		}
+		w.Header()[name] = values
+	}
+	w.Header().Set(ReplayedHeader, "true")
+	w.WriteHeader(resp.status)
+
+	if _, err := w.Write(resp.body); err != nil {
+		logger.Log.Error(err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	encoder := json.NewEncoder(w)
+	_ = encoder.Encode(models.ResponseError{
+		Error: models.ErrorDetails{
+			Code:    code,
+			Message: message,
+		},
+	})
+}
+
+// recorder passes the response through and keeps a copy of it.
+type recorder struct {
+	http.ResponseWriter
+	headers []string
+	status  int
+	header  http.Header
+	body    bytes.Buffer
+}
+
+func (r *recorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+		r.header = make(http.Header)
+		for _, name := range r.headers {
+			if values := r.ResponseWriter.Header().Values(name); len(values) > 0 {
+				r.header[http.CanonicalHeaderKey(name)] = append([]string(nil), values...)
+			}
+		}
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
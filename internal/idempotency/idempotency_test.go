@@ -0,0 +1,164 @@
+package idempotency
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_Wrap(t *testing.T) {
+	var calls int32
+	status := http.StatusCreated
+	release := make(chan struct{})
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		body, _ := io.ReadAll(r.Body)
+		http.SetCookie(w, &http.Cookie{Name: "shortener_session", Value: "new"})
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(status)
+		w.Write([]byte(string(body) + "#" + string(rune('0'+n))))
+	}
+
+	now := time.Unix(1700000000, 0)
+	c := New(time.Hour)
+	c.now = func() time.Time { return now }
+	h := c.Wrap(handler, func(r *http.Request) (string, bool) { return r.Header.Get("Scope"), false })
+
+	do := func(path, key, scope, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		if key != "" {
+			r.Header.Set(Header, key)
+		}
+		r.Header.Set("Scope", scope)
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w
+	}
+
+	first := do("/", "a", "session", "url")
+	assert.Equal(t, http.StatusCreated, first.Code)
+	assert.Equal(t, "url#1", first.Body.String())
+	assert.Empty(t, first.Header().Get(ReplayedHeader))
+
+	retry := do("/", "a", "session", "url")
+	assert.Equal(t, http.StatusCreated, retry.Code)
+	assert.Equal(t, "url#1", retry.Body.String())
+	assert.Equal(t, "text/plain", retry.Header().Get("Content-Type"))
+	assert.Empty(t, retry.Header().Get("Set-Cookie"), "the cookie belongs to the first client")
+	assert.Equal(t, "true", retry.Header().Get(ReplayedHeader))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&calls))
+
+	w := do("/", "a", "session", "other")
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Contains(t, w.Body.String(), CodeKeyReused)
+	w = do("/api", "a", "session", "url")
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	w = do("/", "a", "user", "url")
+	assert.Equal(t, "url#2", w.Body.String())
+	w = do("/", "", "session", "url")
+	assert.Equal(t, "url#3", w.Body.String())
+	w = do("/", "a", "", "url")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = do("/", strings.Repeat("k", MaxKeyLength+1), "session", "url")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), CodeInvalidKey)
+
+	now = now.Add(time.Hour)
+	w = do("/", "a", "session", "other")
+	assert.Equal(t, "other#4", w.Body.String())
+
+	status = http.StatusInternalServerError
+	do("/", "b", "session", "url")
+	status = http.StatusCreated
+	w = do("/", "b", "session", "url")
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "url#6", w.Body.String())
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- do("/slow", "c", "session", "url")
+	}()
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&calls) == 7
+	}, time.Second, time.Millisecond)
+	w = do("/slow", "c", "session", "url")
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), CodeInProgress)
+	close(release)
+	assert.Equal(t, "url#7", (<-done).Body.String())
+	assert.Equal(t, "url#7", do("/slow", "c", "session", "url").Body.String())
+}
+
+func Test_WrapIssuedSession(t *testing.T) {
+	var calls int32
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		body, _ := io.ReadAll(r.Body)
+		http.SetCookie(w, &http.Cookie{Name: "shortener_session", Value: "call" + string(rune('0'+n))})
+		w.Write([]byte(string(body) + "#" + string(rune('0'+n))))
+	}
+	// the scope header is the session the client sent, a new one is issued
+	// when it's missing
+	issued := 0
+	h := New(time.Hour).Wrap(handler, func(r *http.Request) (string, bool) {
+		if scope := r.Header.Get("Scope"); scope != "" {
+			return scope, false
+		}
+		issued++
+		return "issued" + string(rune('0'+issued)), true
+	})
+
+	do := func(scope, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		r.Header.Set(Header, "a")
+		r.Header.Set("Scope", scope)
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w
+	}
+
+	assert.Equal(t, "url#1", do("", "url").Body.String())
+
+	retry := do("", "url")
+	assert.Equal(t, "url#1", retry.Body.String(), "a retry without a session is replayed")
+	assert.Equal(t, "true", retry.Header().Get(ReplayedHeader))
+	assert.Equal(t, "shortener_session=call1", retry.Header().Get("Set-Cookie"), "the retry takes the first session")
+	assert.Equal(t, "url#1", do("issued1", "url").Body.String(), "so is a retry with the issued session")
+
+	// clients without a session only share a key with the same request
+	assert.Equal(t, "other#2", do("", "other").Body.String())
+	assert.Equal(t, "url#3", do("session", "url").Body.String())
+	assert.EqualValues(t, 3, atomic.LoadInt32(&calls))
+}
+
+func Test_Sweep(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	c := New(time.Minute)
+	c.now = func() time.Time { return now }
+	h := c.Wrap(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}, func(*http.Request) (string, bool) { return "session", false })
+
+	for _, key := range []string{"a", "b"} {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.Header.Set(Header, key)
+		h(httptest.NewRecorder(), r)
+	}
+	require.Len(t, c.entries, 2)
+
+	now = now.Add(2 * time.Minute)
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set(Header, "c")
+	h(httptest.NewRecorder(), r)
+	assert.Len(t, c.entries, 1)
+}
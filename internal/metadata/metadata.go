@@ -0,0 +1,237 @@
+package metadata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/DavidGQK/go-link-shortener/internal/models"
+	"github.com/DavidGQK/go-link-shortener/internal/validation"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultTimeout      = 5 * time.Second
+	DefaultMaxBytes     = 1 << 20
+	DefaultMaxRedirects = 5
+)
+
+var (
+	ErrForbiddenAddress = validation.ErrForbiddenAddress
+	ErrNotHTML          = errors.New("response is not an html page")
+	ErrTooManyRedirects = errors.New("too many redirects")
+)
+
+type Options struct {
+	Timeout      time.Duration
+	MaxBytes     int64
+	MaxRedirects int
+	AllowPrivate bool
+}
+
+// Fetcher downloads the head of an html page and extracts link metadata.
+// Connections to private addresses are refused unless AllowPrivate is set.
+type Fetcher struct {
+	client   *http.Client
+	maxBytes int64
+}
+
+func NewFetcher(opts Options) *Fetcher {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = DefaultMaxBytes
+	}
+	if opts.MaxRedirects <= 0 {
+		opts.MaxRedirects = DefaultMaxRedirects
+	}
+
+	dialer := &net.Dialer{Timeout: opts.Timeout}
+	if !opts.AllowPrivate {
+		dialer.Control = validation.DialGuard
+	}
+
+	transport := &http.Transport{
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   opts.Timeout,
+		ResponseHeaderTimeout: opts.Timeout,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       30 * time.Second,
+	}
+
+	return &Fetcher{
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   opts.Timeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= opts.MaxRedirects {
+					return ErrTooManyRedirects
+				}
+				return checkScheme(req.URL)
+			},
+		},
+		maxBytes: opts.MaxBytes,
+	}
+}
+
+func checkScheme(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("scheme %q: %w", u.Scheme, ErrForbiddenAddress)
+	}
+	return nil
+}
+
+func (f *Fetcher) Fetch(ctx context.Context, rawURL string) (models.LinkMetadata, error) {
+	var meta models.LinkMetadata
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return meta, err
+	}
+	if err := checkScheme(u); err != nil {
+		return meta, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return meta, err
+	}
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	req.Header.Set("User-Agent", "go-link-shortener metadata fetcher")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return meta, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return meta, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if !strings.Contains(contentType, "text/html") && !strings.Contains(contentType, "application/xhtml+xml") {
+		return meta, ErrNotHTML
+	}
+
+	body, err := charset.NewReader(io.LimitReader(resp.Body, f.maxBytes), contentType)
+	if err != nil {
+		return meta, err
+	}
+
+	return Parse(body, resp.Request.URL), nil
+}
+
+// Parse reads the head of an html document. Relative image and icon
+// urls are resolved against base.
+func Parse(r io.Reader, base *url.URL) models.LinkMetadata {
+	var meta, og models.LinkMetadata
+
+	tokenizer := html.NewTokenizer(r)
+	inTitle := false
+
+loop:
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			break loop
+		case html.TextToken:
+			if inTitle && meta.Title == "" {
+				meta.Title = strings.TrimSpace(string(tokenizer.Text()))
+			}
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			switch string(name) {
+			case "title":
+				inTitle = false
+			case "head":
+				break loop
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := tokenizer.TagName()
+			attrs := readAttrs(tokenizer, hasAttr)
+
+			switch string(name) {
+			case "title":
+				inTitle = true
+			case "body":
+				break loop
+			case "meta":
+				content := strings.TrimSpace(attrs["content"])
+				switch strings.ToLower(attrs["property"]) {
+				case "og:title":
+					og.Title = content
+				case "og:description":
+					og.Description = content
+				case "og:image":
+					og.ImageURL = resolve(base, content)
+				}
+				if strings.EqualFold(attrs["name"], "description") {
+					meta.Description = content
+				}
+			case "link":
+				if meta.FaviconURL == "" && isIconRel(attrs["rel"]) {
+					meta.FaviconURL = resolve(base, attrs["href"])
+				}
+			}
+		}
+	}
+
+	if og.Title != "" {
+		meta.Title = og.Title
+	}
+	if og.Description != "" {
+		meta.Description = og.Description
+	}
+	meta.ImageURL = og.ImageURL
+	if meta.FaviconURL == "" && base != nil {
+		meta.FaviconURL = resolve(base, "/favicon.ico")
+	}
+
+	return meta
+}
+
+func readAttrs(tokenizer *html.Tokenizer, hasAttr bool) map[string]string {
+	attrs := make(map[string]string)
+	for hasAttr {
+		var key, value []byte
+		key, value, hasAttr = tokenizer.TagAttr()
+		attrs[string(key)] = string(value)
+	}
+	return attrs
+}
+
+func isIconRel(rel string) bool {
+	for _, value := range strings.Fields(strings.ToLower(rel)) {
+		if value == "icon" {
+			return true
+		}
+	}
+	return false
+}
+
+func resolve(base *url.URL, ref string) string {
+	ref = strings.TrimSpace(ref)
+	if ref == "" {
+		return ""
+	}
+
+	u, err := url.Parse(ref)
+	if err != nil {
+		return ""
+	}
+	if base != nil {
+		u = base.ResolveReference(u)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return ""
+	}
+	return u.String()
+}
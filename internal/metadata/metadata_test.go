@@ -0,0 +1,121 @@
+package metadata
+
+import (
+	"context"
+	"errors"
+	"github.com/DavidGQK/go-link-shortener/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPage = `<!DOCTYPE html>
+<html><head>
+<meta charset="utf-8">
+<title> Plain title </title>
+<meta name="description" content="Plain description">
+<meta property="og:title" content="Graph title">
+<meta property="og:image" content="/cover.png">
+<link rel="shortcut icon" href="/static/icon.png">
+</head><body><title>Not a title</title></body></html>`
+
+func newTestServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/page", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte(testPage))
+	})
+	mux.HandleFunc("/big", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<html><head>" + strings.Repeat(" ", 4096) + "<title>Too far</title></head></html>"))
+	})
+	mux.HandleFunc("/file", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/pdf")
+		_, _ = w.Write([]byte("%PDF"))
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/page", http.StatusFound)
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func Test_Fetch(t *testing.T) {
+	server := newTestServer(t)
+	fetcher := NewFetcher(Options{AllowPrivate: true, MaxBytes: 1024})
+
+	meta, err := fetcher.Fetch(context.Background(), server.URL+"/redirect")
+	require.NoError(t, err)
+	assert.Equal(t, models.LinkMetadata{
+		Title:       "Graph title",
+		Description: "Plain description",
+		ImageURL:    server.URL + "/cover.png",
+		FaviconURL:  server.URL + "/static/icon.png",
+	}, meta)
+
+	meta, err = fetcher.Fetch(context.Background(), server.URL+"/big")
+	require.NoError(t, err)
+	assert.Empty(t, meta.Title)
+	assert.Equal(t, server.URL+"/favicon.ico", meta.FaviconURL)
+
+	_, err = fetcher.Fetch(context.Background(), server.URL+"/file")
+	assert.ErrorIs(t, err, ErrNotHTML)
+
+	_, err = fetcher.Fetch(context.Background(), "file:///etc/passwd")
+	assert.ErrorIs(t, err, ErrForbiddenAddress)
+}
+
+func Test_FetchGuard(t *testing.T) {
+	server := newTestServer(t)
+	fetcher := NewFetcher(Options{})
+
+	_, err := fetcher.Fetch(context.Background(), server.URL+"/page")
+	assert.True(t, errors.Is(err, ErrForbiddenAddress), err)
+}
+
+func Test_Pool(t *testing.T) {
+	server := newTestServer(t)
+
+	results := make(chan models.LinkMetadata, 1)
+	pool := NewPool(NewFetcher(Options{AllowPrivate: true}), 2, 1, time.Second,
+		func(job Job, meta models.LinkMetadata, err error) {
+			assert.Equal(t, "abc", job.Key)
+			assert.NoError(t, err)
+			results <- meta
+		})
+	defer pool.Close()
+
+	require.True(t, pool.Enqueue(Job{Key: "abc", URL: server.URL + "/page"}))
+
+	select {
+	case meta := <-results:
+		assert.Equal(t, "Graph title", meta.Title)
+	case <-time.After(3 * time.Second):
+		t.Fatal("metadata wasn't fetched")
+	}
+}
+
+func Test_PoolClose(t *testing.T) {
+	server := newTestServer(t)
+
+	var fetched []string
+	pool := NewPool(NewFetcher(Options{AllowPrivate: true}), 1, 3, time.Second,
+		func(job Job, meta models.LinkMetadata, err error) {
+			fetched = append(fetched, job.Key)
+		})
+
+	for _, key := range []string{"a", "b", "c"} {
+		require.True(t, pool.Enqueue(Job{Key: key, URL: server.URL + "/page"}))
+	}
+	pool.Close()
+
+	assert.ElementsMatch(t, []string{"a", "b", "c"}, fetched)
+	assert.False(t, pool.Enqueue(Job{Key: "d", URL: server.URL + "/page"}))
+	pool.Close()
+}
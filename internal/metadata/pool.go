@@ -0,0 +1,111 @@
+package metadata
+
+import (
+	"context"
+	"github.com/DavidGQK/go-link-shortener/internal/models"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultWorkers   = 4
+	DefaultQueueSize = 100
+)
+
+type Job struct {
+	Key string
+	URL string
+}
+
+type HandleFunc func(Job, models.LinkMetadata, error)
+
+// Pool fetches metadata in the background with a fixed number of workers.
+type Pool struct {
+	fetcher *Fetcher
+	timeout time.Duration
+	jobs    chan Job
+	handle  HandleFunc
+	done    chan struct{}
+	once    sync.Once
+	wg      sync.WaitGroup
+}
+
+func NewPool(fetcher *Fetcher, workers, queueSize int, timeout time.Duration, handle HandleFunc) *Pool {
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	if queueSize <= 0 {
+		queueSize = DefaultQueueSize
+	}
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	p := &Pool{
+		fetcher: fetcher,
+		timeout: timeout,
+		jobs:    make(chan Job, queueSize),
+		handle:  handle,
+		done:    make(chan struct{}),
+	}
+
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+
+	return p
+}
+
+// Enqueue never blocks: a job is dropped when the queue is full or the
+// pool is closed.
+func (p *Pool) Enqueue(job Job) bool {
+	select {
+	case <-p.done:
+		return false
+	default:
+	}
+
+	select {
+	case p.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops taking jobs and waits for the queued ones to be fetched.
+func (p *Pool) Close() {
+	p.once.Do(func() {
+		close(p.done)
+	})
+	p.wg.Wait()
+}
+
+func (p *Pool) work() {
+	defer p.wg.Done()
+
+	for {
+		select {
+		case job := <-p.jobs:
+			p.fetch(job)
+		case <-p.done:
+			for {
+				select {
+				case job := <-p.jobs:
+					p.fetch(job)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (p *Pool) fetch(job Job) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	meta, err := p.fetcher.Fetch(ctx, job.URL)
+	cancel()
+
+	p.handle(job, meta, err)
+}
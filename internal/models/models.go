@@ -2,23 +2,102 @@ package models
 
 import (
 	"context"
+	"database/sql/driver"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"time"
 )
 
 var ErrConflict = errors.New(`already exists`)
 var ErrDeleted = errors.New(`was deleted`)
+var ErrNotFound = errors.New(`not found`)
+
+const (
+	DedupScopeGlobal = "global"
+	DedupScopeUser   = "user"
+	DedupScopeNone   = "none"
+
+	QueryPolicyAppend        = "append"
+	QueryPolicyMergeIncoming = "merge_incoming"
+	QueryPolicyMergeStored   = "merge_stored"
+	QueryPolicyDrop          = "drop"
+
+	LabelTag    = "tag"
+	LabelFolder = "folder"
+
+	SortCreated = "created"
+	SortClicks  = "clicks"
+	SortAlias   = "alias"
+)
+
+type LinkOptions struct {
+	RedirectStatus int           `json:"redirect_status,omitempty"`
+	Password       string        `json:"password,omitempty"`
+	MaxClicks      int           `json:"max_clicks,omitempty"`
+	ActiveFrom     *time.Time    `json:"active_from,omitempty"`
+	ActiveUntil    *time.Time    `json:"active_until,omitempty"`
+	Rules          RedirectRules `json:"rules,omitempty"`
+	Variants       Variants      `json:"variants,omitempty"`
+	QueryPolicy    string        `json:"query_policy,omitempty"`
+	ForwardPath    bool          `json:"forward_path,omitempty"`
+	Domain         string        `json:"domain,omitempty"`
+	Tags           []string      `json:"tags,omitempty"`
+	Folder         string        `json:"folder,omitempty"`
+	Title          string        `json:"title,omitempty"`
+	Description    string        `json:"description,omitempty"`
+	UTM            *UTMParams    `json:"utm,omitempty"`
+}
+
+// UTMParams are attached to the destination when a link is created,
+// unless the destination already sets them.
+type UTMParams struct {
+	Source   string `json:"utm_source,omitempty"`
+	Medium   string `json:"utm_medium,omitempty"`
+	Campaign string `json:"utm_campaign,omitempty"`
+	Term     string `json:"utm_term,omitempty"`
+	Content  string `json:"utm_content,omitempty"`
+}
 
 type RequestShortenLink struct {
 	URL string `json:"url"`
+	QR  bool   `json:"qr,omitempty"`
+	LinkOptions
 }
 
 type ResponseShortenLink struct {
 	Result string `json:"result"`
+	QR     string `json:"qr,omitempty"`
+}
+
+type ResponseError struct {
+	Error ErrorDetails `json:"error"`
+}
+
+type ErrorDetails struct {
+	Code          string `json:"code"`
+	Message       string `json:"message"`
+	CorrelationID string `json:"correlation_id,omitempty"`
+}
+
+// ResponseEnvelope is the body of every /api/v2 response, exactly one of
+// Data and Error is set.
+type ResponseEnvelope struct {
+	Data  interface{}   `json:"data"`
+	Error *ErrorDetails `json:"error"`
+	Meta  ResponseMeta  `json:"meta"`
+}
+
+type ResponseMeta struct {
+	Created    *bool  `json:"created,omitempty"`
+	Total      *int   `json:"total,omitempty"`
+	NextCursor string `json:"next_cursor,omitempty"`
 }
 
 type RequestLinks struct {
 	CorrelationID string `json:"correlation_id"`
 	OriginalURL   string `json:"original_url"`
+	LinkOptions
 }
 
 type RequestBatchLinks []RequestLinks
@@ -31,11 +110,137 @@ type ResponseLinks struct {
 type ResponseBatchLinks []ResponseLinks
 
 type Record struct {
-	UUID        string `json:"UUID"`
-	ShortURL    string `json:"short_url"`
-	OriginalURL string `json:"original_url"`
-	DeletedFlag bool   `json:"is_deleted"`
-	UserID      int    `json:"user_id"`
+	UUID           string        `json:"UUID"`
+	ShortURL       string        `json:"short_url"`
+	OriginalURL    string        `json:"original_url"`
+	DeletedFlag    bool          `json:"is_deleted"`
+	UserID         int           `json:"user_id"`
+	RedirectStatus int           `json:"redirect_status,omitempty"`
+	Clicks         int           `json:"clicks"`
+	CreatedAt      time.Time     `json:"created_at"`
+	UpdatedAt      time.Time     `json:"updated_at"`
+	PasswordHash   string        `json:"password_hash,omitempty"`
+	MaxClicks      int           `json:"max_clicks,omitempty"`
+	ActiveFrom     *time.Time    `json:"active_from,omitempty"`
+	ActiveUntil    *time.Time    `json:"active_until,omitempty"`
+	Rules          RedirectRules `json:"rules,omitempty"`
+	Variants       Variants      `json:"variants,omitempty"`
+	QueryPolicy    string        `json:"query_policy,omitempty"`
+	ForwardPath    bool          `json:"forward_path,omitempty"`
+	Domain         string        `json:"domain,omitempty"`
+	Tags           Tags          `json:"tags,omitempty"`
+	Folder         string        `json:"folder,omitempty"`
+	Title          string        `json:"title,omitempty"`
+	Description    string        `json:"description,omitempty"`
+	ImageURL       string        `json:"image_url,omitempty"`
+	FaviconURL     string        `json:"favicon_url,omitempty"`
+}
+
+// LinkMetadata is what the destination page tells about itself.
+type LinkMetadata struct {
+	Title       string
+	Description string
+	ImageURL    string
+	FaviconURL  string
+}
+
+type RedirectRule struct {
+	UserAgent  string `json:"user_agent,omitempty"`
+	OS         string `json:"os,omitempty"`
+	Language   string `json:"language,omitempty"`
+	QueryParam string `json:"query_param,omitempty"`
+	QueryValue string `json:"query_value,omitempty"`
+	URL        string `json:"url"`
+}
+
+type RedirectRules []RedirectRule
+
+func (r RedirectRules) Value() (driver.Value, error) {
+	if len(r) == 0 {
+		return nil, nil
+	}
+	return jsonValue(r)
+}
+
+func (r *RedirectRules) Scan(src any) error {
+	*r = nil
+	return scanJSON(src, r)
+}
+
+type Tags []string
+
+func (t *Tags) Scan(src any) error {
+	*t = nil
+	return scanJSON(src, t)
+}
+
+type Variant struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+	Clicks int    `json:"clicks"`
+}
+
+type Variants []Variant
+
+func (v Variants) Value() (driver.Value, error) {
+	if len(v) == 0 {
+		return nil, nil
+	}
+	return jsonValue(v)
+}
+
+func (v *Variants) Scan(src any) error {
+	*v = nil
+	return scanJSON(src, v)
+}
+
+func jsonValue(v any) (driver.Value, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func scanJSON(src any, dest any) error {
+	switch data := src.(type) {
+	case nil:
+		return nil
+	case []byte:
+		return json.Unmarshal(data, dest)
+	case string:
+		return json.Unmarshal([]byte(data), dest)
+	}
+	return fmt.Errorf("unsupported json column type %T", src)
+}
+
+type RequestEditLink struct {
+	URL            *string        `json:"url"`
+	RedirectStatus *int           `json:"redirect_status"`
+	Password       *string        `json:"password"`
+	MaxClicks      *int           `json:"max_clicks"`
+	ActiveFrom     NullableTime   `json:"active_from"`
+	ActiveUntil    NullableTime   `json:"active_until"`
+	Rules          *RedirectRules `json:"rules"`
+	Variants       *Variants      `json:"variants"`
+	QueryPolicy    *string        `json:"query_policy"`
+	ForwardPath    *bool          `json:"forward_path"`
+	Tags           *[]string      `json:"tags"`
+	Folder         *string        `json:"folder"`
+	Title          *string        `json:"title"`
+	Description    *string        `json:"description"`
+}
+
+// NullableTime tells an absent field apart from an explicit null,
+// so that edit requests can clear a time without touching the others.
+type NullableTime struct {
+	Set  bool
+	Time *time.Time
+}
+
+func (t *NullableTime) UnmarshalJSON(data []byte) error {
+	t.Set = true
+	return json.Unmarshal(data, &t.Time)
 }
 
 type DeletedURLMessage struct {
@@ -47,18 +252,35 @@ type RequestDeletedUserURLS []string
 
 type StorageInterface interface {
 	Restore() error
-	Add(string, string, string) error
-	AddBatch(context.Context, []Record) error
-	Get(string) (string, error)
+	Add(Record, string) error
+	AddBatch(context.Context, []Record, string) error
+	Get(string) (Record, error)
+	GetUserRecord(context.Context, string, string) (Record, error)
 	GetMode() int
-	GetByOriginURL(string) (string, error)
+	GetByOriginURL(string, string) (string, error)
 	HealthCheck() error
 	CloseStorage() error
-	GetUserRecords(context.Context, string) ([]Record, error)
+	GetUserRecords(context.Context, string, ListQuery) ([]Record, int, error)
 	FindUserByID(context.Context, int) (*User, error)
 	CreateUser(context.Context) (*User, error)
 	UpdateUser(context.Context, int, string) error
 	DeleteUserURLs(context.Context, DeletedURLMessage) error
+	GetAllRecords(context.Context) ([]Record, error)
+	DeleteBatchRecords(context.Context, []Record) error
+	RegisterClick(context.Context, string) (int, error)
+	UpdateRecord(context.Context, Record, string) error
+	RegisterVariantClick(context.Context, string, int) error
+	GetUserLabels(context.Context, string, string) ([]LabelCount, error)
+	RenameUserLabel(context.Context, string, string, string, string) error
+	DeleteUserLabel(context.Context, string, string, string) error
+	UpdateMetadata(context.Context, string, LinkMetadata) error
+	CreateWebhook(context.Context, string, Webhook) error
+	GetUserWebhooks(context.Context, string) ([]Webhook, error)
+	DeleteWebhook(context.Context, string, string) error
+	GetLinkWebhooks(context.Context, string) ([]Webhook, error)
+	AddWebhookDelivery(context.Context, WebhookDelivery) error
+	AddWebhookDeadLetter(context.Context, WebhookDelivery) error
+	GetWebhookDeliveries(context.Context, string, DeliveryQuery) ([]WebhookDelivery, error)
 }
 
 type User struct {
@@ -66,9 +288,157 @@ type User struct {
 	Cookie string `json:"cookie"`
 }
 
+type ResponsePreview struct {
+	ShortURL    string    `json:"short_url"`
+	OriginalURL string    `json:"original_url,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	Clicks      int       `json:"clicks"`
+	MaxClicks   int       `json:"max_clicks,omitempty"`
+	Protected   bool      `json:"protected"`
+}
+
 type ResponseUserURLs []ResponseUserURL
 
 type ResponseUserURL struct {
-	ShortURL    string `json:"short_url"`
-	OriginalURL string `json:"original_url"`
+	ShortURL    string        `json:"short_url"`
+	OriginalURL string        `json:"original_url"`
+	Title       string        `json:"title,omitempty"`
+	Description string        `json:"description,omitempty"`
+	ImageURL    string        `json:"image_url,omitempty"`
+	FaviconURL  string        `json:"favicon_url,omitempty"`
+	CreatedAt   time.Time     `json:"created_at"`
+	UpdatedAt   time.Time     `json:"updated_at"`
+	ActiveFrom  *time.Time    `json:"active_from,omitempty"`
+	ActiveUntil *time.Time    `json:"active_until,omitempty"`
+	Rules       RedirectRules `json:"rules,omitempty"`
+	Variants    Variants      `json:"variants,omitempty"`
+	QueryPolicy string        `json:"query_policy,omitempty"`
+	ForwardPath bool          `json:"forward_path,omitempty"`
+	Domain      string        `json:"domain,omitempty"`
+	Tags        Tags          `json:"tags,omitempty"`
+	Folder      string        `json:"folder,omitempty"`
+}
+
+// ListQuery selects a page of user records. Total counts ignore After
+// and Limit, a zero Limit means no limit.
+type ListQuery struct {
+	Tags           []string
+	Folder         *string
+	Search         string
+	Sort           string
+	Desc           bool
+	IncludeDeleted bool
+	After          *ListCursor
+	Limit          int
+}
+
+// ListCursor points at the last record of the previous page.
+type ListCursor struct {
+	CreatedAt time.Time `json:"c,omitempty"`
+	Clicks    int       `json:"n,omitempty"`
+	ShortURL  string    `json:"s"`
+}
+
+type LabelCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+type ResponseLabels []LabelCount
+
+type RequestRenameLabel struct {
+	Name string `json:"name"`
+}
+
+const (
+	EventLinkCreated        = "link.created"
+	EventLinkUpdated        = "link.updated"
+	EventLinkDeleted        = "link.deleted"
+	EventLinkClickThreshold = "link.click_threshold"
+)
+
+type WebhookEvents []string
+
+func (e WebhookEvents) Value() (driver.Value, error) {
+	return jsonValue(e)
+}
+
+func (e *WebhookEvents) Scan(src any) error {
+	*e = nil
+	return scanJSON(src, e)
+}
+
+func (e WebhookEvents) Has(event string) bool {
+	for _, value := range e {
+		if value == event {
+			return true
+		}
+	}
+	return false
+}
+
+type ClickThresholds []int
+
+func (t ClickThresholds) Value() (driver.Value, error) {
+	return jsonValue(t)
+}
+
+func (t *ClickThresholds) Scan(src any) error {
+	*t = nil
+	return scanJSON(src, t)
+}
+
+func (t ClickThresholds) Has(clicks int) bool {
+	for _, value := range t {
+		if value == clicks {
+			return true
+		}
+	}
+	return false
+}
+
+type Webhook struct {
+	ID              string          `json:"id"`
+	URL             string          `json:"url"`
+	Secret          string          `json:"secret,omitempty"`
+	Events          WebhookEvents   `json:"events"`
+	ClickThresholds ClickThresholds `json:"click_thresholds,omitempty"`
+	CreatedAt       time.Time       `json:"created_at"`
+}
+
+type RequestWebhook struct {
+	URL             string          `json:"url"`
+	Secret          string          `json:"secret"`
+	Events          WebhookEvents   `json:"events"`
+	ClickThresholds ClickThresholds `json:"click_thresholds"`
+}
+
+// WebhookEvent is the json payload posted to webhook endpoints.
+type WebhookEvent struct {
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	CreatedAt time.Time       `json:"created_at"`
+	Link      ResponseUserURL `json:"link"`
+	Clicks    int             `json:"clicks,omitempty"`
+}
+
+// WebhookDelivery is one delivery attempt. Dead letters keep the payload
+// of events that failed their final attempt.
+type WebhookDelivery struct {
+	ID         string          `json:"id"`
+	WebhookID  string          `json:"webhook_id"`
+	EventID    string          `json:"event_id"`
+	EventType  string          `json:"event_type"`
+	Attempt    int             `json:"attempt"`
+	StatusCode int             `json:"status_code,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	Success    bool            `json:"success"`
+	Payload    json.RawMessage `json:"payload,omitempty"`
+	CreatedAt  time.Time       `json:"created_at"`
+}
+
+type DeliveryQuery struct {
+	WebhookID   string
+	DeadLetters bool
+	Limit       int
 }
@@ -0,0 +1,159 @@
+package openapi
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/DavidGQK/go-link-shortener/internal/logger"
+	"github.com/DavidGQK/go-link-shortener/internal/validation"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/go-chi/chi/v5"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+//go:embed openapi.json
+var spec []byte
+
+var (
+	loadOnce sync.Once
+	document *openapi3.T
+	loadErr  error
+)
+
+// Spec returns the raw OpenAPI document.
+func Spec() []byte {
+	return spec
+}
+
+// Load parses and validates the embedded document once.
+func Load() (*openapi3.T, error) {
+	loadOnce.Do(func() {
+		loader := openapi3.NewLoader()
+		document, loadErr = loader.LoadFromData(spec)
+		if loadErr == nil {
+			loadErr = document.Validate(loader.Context)
+		}
+	})
+	return document, loadErr
+}
+
+func Handler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(spec); err != nil {
+		logger.Log.Error(err)
+	}
+}
+
+// PathFromRoute converts a chi route pattern to the path of the document,
+// the wildcard of forwarded paths is documented as {path}. chi trims the
+// trailing slash of matched patterns, so the root comes in empty.
+func PathFromRoute(pattern string) string {
+	if pattern == "" {
+		return "/"
+	}
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.TrimSuffix(pattern, "*") + "{path}"
+	}
+	return pattern
+}
+
+// Operation finds the documented operation of a chi route.
+func Operation(doc *openapi3.T, method, pattern string) *openapi3.Operation {
+	item := doc.Paths.Find(PathFromRoute(pattern))
+	if item == nil {
+		return nil
+	}
+	return item.GetOperation(method)
+}
+
+// ErrorWriter writes validation errors in the format of a route group.
+type ErrorWriter func(w http.ResponseWriter, status int, code, message string)
+
+// Validator checks json request bodies against the schema of the matched
+// route and writes errors in the format of the route group. Bodies that
+// aren't json are reported with 400, bodies that don't match the schema
+// with 422. It has to be installed on a route group, where the route
+// pattern is already known.
+func Validator(writeError ErrorWriter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return validate(next, writeError)
+	}
+}
+
+func validate(next http.Handler, writeError ErrorWriter) http.Handler {
+	doc, err := Load()
+	if err != nil {
+		logger.Log.Errorw("openapi document error, request validation is disabled", "error", err)
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		schema := requestSchema(doc, r)
+		if schema == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, validation.CodeInvalidJSON, "Request body can't be read")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		var value interface{}
+		if err := json.Unmarshal(body, &value); err != nil {
+			writeError(w, http.StatusBadRequest, validation.CodeInvalidJSON, "Request body isn't valid JSON")
+			return
+		}
+
+		if err := schema.VisitJSON(value); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, validation.CodeInvalidRequest, schemaMessage(err))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func requestSchema(doc *openapi3.T, r *http.Request) *openapi3.Schema {
+	rctx := chi.RouteContext(r.Context())
+	if rctx == nil {
+		return nil
+	}
+
+	op := Operation(doc, r.Method, rctx.RoutePattern())
+	if op == nil || op.RequestBody == nil || op.RequestBody.Value == nil {
+		return nil
+	}
+
+	media := op.RequestBody.Value.Content.Get("application/json")
+	if media == nil || media.Schema == nil {
+		return nil
+	}
+	return media.Schema.Value
+}
+
+func schemaMessage(err error) string {
+	var schemaErr *openapi3.SchemaError
+	if !errors.As(err, &schemaErr) {
+		return err.Error()
+	}
+
+	// errors of allOf and similar keep the failing property in their
+	// origin, with a pointer relative to the outer error
+	pointer := schemaErr.JSONPointer()
+	var originErr *openapi3.SchemaError
+	for errors.As(schemaErr.Origin, &originErr) {
+		schemaErr = originErr
+		pointer = append(pointer, schemaErr.JSONPointer()...)
+	}
+
+	return fmt.Sprintf("/%s: %s", strings.Join(pointer, "/"), schemaErr.Reason)
+}
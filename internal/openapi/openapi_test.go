@@ -0,0 +1,495 @@
+package openapi_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/DavidGQK/go-link-shortener/internal/config"
+	"github.com/DavidGQK/go-link-shortener/internal/logger"
+	"github.com/DavidGQK/go-link-shortener/internal/models"
+	"github.com/DavidGQK/go-link-shortener/internal/openapi"
+	"github.com/DavidGQK/go-link-shortener/internal/router"
+	"github.com/DavidGQK/go-link-shortener/internal/server"
+	"github.com/DavidGQK/go-link-shortener/internal/storage/initstorage"
+	"github.com/DavidGQK/go-link-shortener/internal/validation"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	if err := logger.Initialize("fatal"); err != nil {
+		panic(err)
+	}
+
+	for _, contentType := range []string{"image/png", "image/svg+xml", "text/html"} {
+		openapi3filter.RegisterBodyDecoder(contentType, openapi3filter.FileBodyDecoder)
+	}
+
+	os.Exit(m.Run())
+}
+
+func newRouter(t *testing.T) chi.Router {
+	st, err := initstorage.NewStorage("", "", models.DedupScopeGlobal)
+	require.NoError(t, err)
+
+	s, err := server.New(&config.Config{
+		ServerURL:      "localhost:8080",
+		ShortURLBase:   "http://localhost:8080",
+		IdempotencyTTL: time.Hour,
+	}, st)
+	require.NoError(t, err)
+	t.Cleanup(s.Close)
+
+	return router.NewRouter(s)
+}
+
+func Test_Load(t *testing.T) {
+	doc, err := openapi.Load()
+	require.NoError(t, err)
+	assert.Equal(t, "3.0.3", doc.OpenAPI)
+}
+
+// Test_Routes keeps the document and the router in sync in both directions.
+func Test_Routes(t *testing.T) {
+	doc, err := openapi.Load()
+	require.NoError(t, err)
+
+	var routes []string
+	err = chi.Walk(newRouter(t), func(method, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		routes = append(routes, method+" "+openapi.PathFromRoute(route))
+		return nil
+	})
+	require.NoError(t, err)
+
+	var documented []string
+	for path, item := range doc.Paths {
+		for method := range item.Operations() {
+			documented = append(documented, method+" "+path)
+		}
+	}
+
+	sort.Strings(routes)
+	sort.Strings(documented)
+	assert.Equal(t, documented, routes)
+}
+
+type contractClient struct {
+	t      *testing.T
+	doc    *openapi3.T
+	router chi.Router
+	cookie *http.Cookie
+}
+
+// do sends a request through the router and validates the response
+// against the document, undocumented status codes fail the test as well.
+func (c *contractClient) do(method, target, contentType, body string, headers ...string) *httptest.ResponseRecorder {
+	c.t.Helper()
+
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	if c.cookie != nil {
+		req.AddCookie(c.cookie)
+	}
+
+	rctx := chi.NewRouteContext()
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+
+	w := httptest.NewRecorder()
+	c.router.ServeHTTP(w, req)
+
+	if c.cookie == nil {
+		for _, cookie := range w.Result().Cookies() {
+			if cookie.Name == "shortener_session" {
+				c.cookie = cookie
+			}
+		}
+	}
+
+	path := openapi.PathFromRoute(rctx.RoutePattern())
+	item := c.doc.Paths.Find(path)
+	require.NotNil(c.t, item, "%s isn't documented", path)
+	op := item.GetOperation(method)
+	require.NotNil(c.t, op, "%s %s isn't documented", method, path)
+
+	err := openapi3filter.ValidateResponse(context.Background(), &openapi3filter.ResponseValidationInput{
+		RequestValidationInput: &openapi3filter.RequestValidationInput{
+			Request: req,
+			Route: &routers.Route{
+				Spec:      c.doc,
+				Path:      path,
+				PathItem:  item,
+				Method:    method,
+				Operation: op,
+			},
+		},
+		Status:  w.Code,
+		Header:  w.Header(),
+		Body:    io.NopCloser(bytes.NewReader(w.Body.Bytes())),
+		Options: &openapi3filter.Options{IncludeResponseStatus: true},
+	})
+	assert.NoError(c.t, err, "%s %s answered %d: %s", method, target, w.Code, w.Body.String())
+
+	return w
+}
+
+func shortID(shortURL string) string {
+	return shortURL[strings.LastIndex(shortURL, "/")+1:]
+}
+
+func Test_Contract(t *testing.T) {
+	doc, err := openapi.Load()
+	require.NoError(t, err)
+
+	c := &contractClient{t: t, doc: doc, router: newRouter(t)}
+
+	w := c.do(http.MethodPost, "/", "text/plain", "https://practicum.yandex.ru/plain")
+	require.Equal(t, http.StatusCreated, w.Code)
+	plainID := shortID(w.Body.String())
+
+	w = c.do(http.MethodPost, "/", "text/plain", "not a url")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = c.do(http.MethodPost, "/api/shorten", "application/json",
+		`{"url": "https://practicum.yandex.ru/json", "tags": ["docs"], "folder": "work", "qr": true}`)
+	require.Equal(t, http.StatusCreated, w.Code)
+	var created models.ResponseShortenLink
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	id := shortID(created.Result)
+
+	w = c.do(http.MethodPost, "/api/shorten", "application/json", `{"url": "ftp://practicum.yandex.ru"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	w = c.do(http.MethodPost, "/api/shorten/batch", "application/json",
+		`[{"correlation_id": "1", "original_url": "https://practicum.yandex.ru/batch"}]`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	for i := 0; i < 2; i++ {
+		w = c.do(http.MethodPost, "/api/shorten/batch", "application/json",
+			`[{"correlation_id": "1", "original_url": "https://practicum.yandex.ru/retry"}]`, "Idempotency-Key", "batch")
+		assert.Equal(t, http.StatusCreated, w.Code)
+	}
+	assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"))
+	w = c.do(http.MethodPost, "/api/shorten/batch", "application/json",
+		`[{"correlation_id": "2", "original_url": "https://practicum.yandex.ru/retry"}]`, "Idempotency-Key", "batch")
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	c.do(http.MethodGet, "/"+id, "", "")
+	c.do(http.MethodHead, "/"+id, "", "")
+	w = c.do(http.MethodGet, "/"+id+"+", "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = c.do(http.MethodGet, "/"+id+"+", "", "", "Accept", "application/json")
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = c.do(http.MethodGet, "/"+id+"/docs", "", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = c.do(http.MethodGet, "/unknown", "", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = c.do(http.MethodGet, "/"+id+"/qr", "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = c.do(http.MethodGet, "/"+id+"/qr?format=svg", "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = c.do(http.MethodGet, "/"+id+"/qr?size=1", "", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = c.do(http.MethodGet, "/unknown/qr", "", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = c.do(http.MethodPatch, "/api/user/urls/"+id, "application/json",
+		`{"title": "Docs", "active_until": null, "tags": ["docs", "go"]}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = c.do(http.MethodPatch, "/api/user/urls/unknown", "application/json", `{"title": "Docs"}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = c.do(http.MethodGet, "/api/user/urls?sort=clicks&limit=1", "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotEmpty(t, w.Header().Get("X-Next-Cursor"))
+	w = c.do(http.MethodGet, "/api/user/urls?sort=title", "", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	forged := &contractClient{t: t, doc: doc, router: c.router, cookie: &http.Cookie{Name: "shortener_session", Value: "forged"}}
+	w = forged.do(http.MethodGet, "/api/user/urls", "", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	anonymous := &contractClient{t: t, doc: doc, router: c.router}
+	w = anonymous.do(http.MethodGet, "/api/user/urls", "", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w = c.do(http.MethodGet, "/api/user/tags", "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = c.do(http.MethodPatch, "/api/user/tags/docs", "application/json", `{"name": "reference"}`)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = c.do(http.MethodDelete, "/api/user/tags/unknown", "", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = c.do(http.MethodGet, "/api/user/folders", "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = c.do(http.MethodPatch, "/api/user/folders/work", "application/json", `{"name": ""}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	w = c.do(http.MethodDelete, "/api/user/folders/work", "", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w = c.do(http.MethodPost, "/api/user/webhooks", "application/json",
+		`{"url": "https://example.com/hooks", "events": ["link.created", "link.click_threshold"], "click_thresholds": [10]}`)
+	require.Equal(t, http.StatusCreated, w.Code)
+	var hook models.Webhook
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &hook))
+	w = c.do(http.MethodGet, "/api/user/webhooks", "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = c.do(http.MethodGet, "/api/user/webhooks/"+hook.ID+"/deliveries?dead=true", "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = c.do(http.MethodGet, "/api/user/webhooks/"+hook.ID+"/deliveries?limit=0", "", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = c.do(http.MethodDelete, "/api/user/webhooks/"+hook.ID, "", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = c.do(http.MethodDelete, "/api/user/webhooks/"+hook.ID, "", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = c.do(http.MethodDelete, "/api/user/urls", "application/json", `["`+plainID+`"]`)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	w = c.do(http.MethodGet, "/ping", "", "")
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	w = c.do(http.MethodPost, "/api/v2/shorten", "application/json", `{"url": "https://practicum.yandex.ru/v2"}`)
+	require.Equal(t, http.StatusCreated, w.Code)
+	var envelope struct {
+		Data models.ResponseUserURL `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &envelope))
+	w = c.do(http.MethodPost, "/api/v2/shorten", "application/json", `{"url": "ftp://practicum.yandex.ru"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	w = c.do(http.MethodPost, "/api/v2/shorten/batch", "application/json",
+		`[{"correlation_id": "1", "original_url": "https://practicum.yandex.ru/v2/batch"}]`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w = c.do(http.MethodPatch, "/api/v2/user/urls/"+shortID(envelope.Data.ShortURL), "application/json", `{"title": "v2"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = c.do(http.MethodPatch, "/api/v2/user/urls/unknown", "application/json", `{"title": "v2"}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = forged.do(http.MethodGet, "/api/v2/user/urls", "", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = c.do(http.MethodGet, "/api/v2/user/urls?limit=1", "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = c.do(http.MethodDelete, "/api/v2/user/urls", "application/json", `["`+plainID+`"]`)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	w = c.do(http.MethodGet, "/api/v2/ping", "", "")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	w = c.do(http.MethodGet, "/api/openapi.json", "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, string(openapi.Spec()), w.Body.String())
+}
+
+// Test_MemoryMode checks that memory storage keeps the links of each
+// session apart.
+func Test_MemoryMode(t *testing.T) {
+	doc, err := openapi.Load()
+	require.NoError(t, err)
+
+	st, err := initstorage.NewStorage("", "", "")
+	require.NoError(t, err)
+	s, err := server.New(&config.Config{ShortURLBase: "http://localhost:8080"}, st)
+	require.NoError(t, err)
+	t.Cleanup(s.Close)
+	r := router.NewRouter(s)
+
+	owner := &contractClient{t: t, doc: doc, router: r}
+	w := owner.do(http.MethodPost, "/api/shorten", "application/json", `{"url": "https://practicum.yandex.ru", "tags": ["docs"]}`)
+	require.Equal(t, http.StatusCreated, w.Code)
+	var created models.ResponseShortenLink
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	id := shortID(created.Result)
+
+	other := &contractClient{t: t, doc: doc, router: r}
+	w = other.do(http.MethodGet, "/api/user/urls", "", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = other.do(http.MethodPatch, "/api/user/urls/"+id, "application/json", `{"url": "https://example.com"}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = other.do(http.MethodGet, "/api/user/tags", "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `[]`, w.Body.String())
+	w = other.do(http.MethodPatch, "/api/user/tags/docs", "application/json", `{"name": "other"}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = other.do(http.MethodDelete, "/api/user/tags/docs", "", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = owner.do(http.MethodGet, "/"+id, "", "")
+	assert.Equal(t, "https://practicum.yandex.ru/", w.Header().Get("Location"), "the link is unchanged")
+
+	w = owner.do(http.MethodGet, "/api/user/urls", "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "1", w.Header().Get("X-Total-Count"))
+	w = owner.do(http.MethodPatch, "/api/user/tags/docs", "application/json", `{"name": "reference"}`)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = owner.do(http.MethodGet, "/api/user/tags", "", "")
+	assert.JSONEq(t, `[{"name": "reference", "count": 1}]`, w.Body.String())
+	w = owner.do(http.MethodPatch, "/api/user/urls/"+id, "application/json", `{"url": "https://example.com"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = owner.do(http.MethodGet, "/"+id, "", "")
+	assert.Equal(t, "https://example.com/", w.Header().Get("Location"))
+}
+
+// Test_RedirectWithoutSession checks that anonymous reads neither get
+// a session nor create a user.
+func Test_RedirectWithoutSession(t *testing.T) {
+	doc, err := openapi.Load()
+	require.NoError(t, err)
+	r := newRouter(t)
+
+	owner := &contractClient{t: t, doc: doc, router: r}
+	w := owner.do(http.MethodPost, "/api/shorten", "application/json", `{"url": "https://practicum.yandex.ru"}`)
+	require.Equal(t, http.StatusCreated, w.Code)
+	require.NotNil(t, owner.cookie)
+	var created models.ResponseShortenLink
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	id := shortID(created.Result)
+
+	for _, target := range []string{"/" + id, "/" + id + "/qr", "/ping"} {
+		visitor := &contractClient{t: t, doc: doc, router: r}
+		w = visitor.do(http.MethodGet, target, "", "")
+		assert.Empty(t, w.Header().Values("Set-Cookie"), target)
+	}
+}
+
+// Test_QRCodeForwardPath checks that /qr of a link forwarding paths is
+// redirected, while other links get their qr code.
+func Test_QRCodeForwardPath(t *testing.T) {
+	doc, err := openapi.Load()
+	require.NoError(t, err)
+	c := &contractClient{t: t, doc: doc, router: newRouter(t)}
+
+	shorten := func(body string) string {
+		w := c.do(http.MethodPost, "/api/shorten", "application/json", body)
+		require.Equal(t, http.StatusCreated, w.Code)
+		var created models.ResponseShortenLink
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+		return shortID(created.Result)
+	}
+	forwarded := shorten(`{"url": "https://practicum.yandex.ru/docs/", "forward_path": true}`)
+	plain := shorten(`{"url": "https://practicum.yandex.ru/"}`)
+
+	w := c.do(http.MethodGet, "/"+forwarded+"/qr", "", "")
+	assert.Equal(t, http.StatusTemporaryRedirect, w.Code)
+	assert.Equal(t, "https://practicum.yandex.ru/docs/qr", w.Header().Get("Location"))
+
+	w = c.do(http.MethodGet, "/"+plain+"/qr", "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+}
+
+// Test_Validate checks the error formats: v1 answers bodies that aren't
+// json with a plain 400 and schema violations with its json 422, v2
+// reports json envelopes with 400 and 422.
+func Test_Validate(t *testing.T) {
+	doc, err := openapi.Load()
+	require.NoError(t, err)
+
+	tests := []struct {
+		name         string
+		method       string
+		target       string
+		body         string
+		expectedCode int
+		errorCode    string
+		message      string
+	}{
+		{
+			name:         "malformed json",
+			method:       http.MethodPost,
+			target:       "/api/shorten",
+			body:         `{"url": `,
+			expectedCode: http.StatusBadRequest,
+			message:      "isn't valid JSON",
+		},
+		{
+			name:         "empty body",
+			method:       http.MethodPost,
+			target:       "/api/shorten/batch",
+			expectedCode: http.StatusBadRequest,
+			message:      "isn't valid JSON",
+		},
+		{
+			name:         "missing property",
+			method:       http.MethodPost,
+			target:       "/api/shorten",
+			body:         `{"tags": ["docs"]}`,
+			expectedCode: http.StatusUnprocessableEntity,
+			errorCode:    validation.CodeInvalidRequest,
+			message:      `property "url" is missing`,
+		},
+		{
+			name:         "wrong type",
+			method:       http.MethodPost,
+			target:       "/api/shorten/batch",
+			body:         `[{"correlation_id": 1, "original_url": "https://practicum.yandex.ru"}]`,
+			expectedCode: http.StatusUnprocessableEntity,
+			errorCode:    validation.CodeInvalidRequest,
+			message:      "/0/correlation_id",
+		},
+		{
+			name:         "unknown event",
+			method:       http.MethodPost,
+			target:       "/api/user/webhooks",
+			body:         `{"url": "https://example.com", "events": ["link.visited"]}`,
+			expectedCode: http.StatusUnprocessableEntity,
+			errorCode:    validation.CodeInvalidRequest,
+			message:      "/events/0",
+		},
+		{
+			name:         "not an array",
+			method:       http.MethodDelete,
+			target:       "/api/user/urls",
+			body:         `"abcdf12345"`,
+			expectedCode: http.StatusUnprocessableEntity,
+			errorCode:    validation.CodeInvalidRequest,
+		},
+		{
+			name:         "v2 malformed json",
+			method:       http.MethodPost,
+			target:       "/api/v2/shorten",
+			body:         `{"url": `,
+			expectedCode: http.StatusBadRequest,
+			errorCode:    validation.CodeInvalidJSON,
+		},
+		{
+			name:         "v2 wrong type",
+			method:       http.MethodPost,
+			target:       "/api/v2/shorten",
+			body:         `{"url": 1}`,
+			expectedCode: http.StatusUnprocessableEntity,
+			errorCode:    validation.CodeInvalidRequest,
+			message:      "/url",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &contractClient{t: t, doc: doc, router: newRouter(t)}
+			w := c.do(tt.method, tt.target, "application/json", tt.body)
+			assert.Equal(t, tt.expectedCode, w.Code)
+
+			if tt.errorCode == "" {
+				assert.Equal(t, "text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+				assert.Contains(t, w.Body.String(), tt.message)
+				return
+			}
+
+			var response models.ResponseError
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+			assert.Equal(t, tt.errorCode, response.Error.Code)
+			assert.Contains(t, response.Error.Message, tt.message)
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package qr
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/skip2/go-qrcode"
+	"image"
+	"image/color"
+	"image/png"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	FormatPNG = "png"
+	FormatSVG = "svg"
+
+	DefaultSize   = 256
+	MinSize       = 64
+	MaxSize       = 2048
+	DefaultMargin = 4
+	MaxMargin     = 16
+)
+
+var ErrInvalidOptions = errors.New("invalid qr code options")
+
+var levels = map[string]qrcode.RecoveryLevel{
+	"L": qrcode.Low,
+	"M": qrcode.Medium,
+	"Q": qrcode.High,
+	"H": qrcode.Highest,
+}
+
+type Options struct {
+	Format     string
+	Size       int
+	Margin     int
+	Level      string
+	Foreground color.RGBA
+	Background color.RGBA
+}
+
+func DefaultOptions() Options {
+	return Options{
+		Format:     FormatPNG,
+		Size:       DefaultSize,
+		Margin:     DefaultMargin,
+		Level:      "M",
+		Foreground: color.RGBA{A: 0xff},
+		Background: color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff},
+	}
+}
+
+// ParseOptions reads format, size, margin, level, fg and bg
+// query parameters on top of the defaults.
+func ParseOptions(values url.Values) (Options, error) {
+	opts := DefaultOptions()
+
+	if format := strings.ToLower(values.Get("format")); format != "" {
+		if format != FormatPNG && format != FormatSVG {
+			return opts, fmt.Errorf("%w: format %q", ErrInvalidOptions, format)
+		}
+		opts.Format = format
+	}
+
+	if size := values.Get("size"); size != "" {
+		parsed, err := strconv.Atoi(size)
+		if err != nil || parsed < MinSize || parsed > MaxSize {
+			return opts, fmt.Errorf("%w: size must be between %d and %d", ErrInvalidOptions, MinSize, MaxSize)
+		}
+		opts.Size = parsed
+	}
+
+	if margin := values.Get("margin"); margin != "" {
+		parsed, err := strconv.Atoi(margin)
+		if err != nil || parsed < 0 || parsed > MaxMargin {
+			return opts, fmt.Errorf("%w: margin must be between 0 and %d", ErrInvalidOptions, MaxMargin)
+		}
+		opts.Margin = parsed
+	}
+
+	if level := strings.ToUpper(values.Get("level")); level != "" {
+		if _, found := levels[level]; !found {
+			return opts, fmt.Errorf("%w: level must be one of L, M, Q, H", ErrInvalidOptions)
+		}
+		opts.Level = level
+	}
+
+	var err error
+	if fg := values.Get("fg"); fg != "" {
+		if opts.Foreground, err = parseColor(fg); err != nil {
+			return opts, err
+		}
+	}
+	if bg := values.Get("bg"); bg != "" {
+		if opts.Background, err = parseColor(bg); err != nil {
+			return opts, err
+		}
+	}
+
+	return opts, nil
+}
+
+// parseColor accepts RRGGBB and RRGGBBAA hex colors, with or without #.
+func parseColor(value string) (color.RGBA, error) {
+	value = strings.TrimPrefix(value, "#")
+	if len(value) != 6 && len(value) != 8 {
+		return color.RGBA{}, fmt.Errorf("%w: color %q", ErrInvalidOptions, value)
+	}
+	if len(value) == 6 {
+		value += "ff"
+	}
+
+	parsed, err := strconv.ParseUint(value, 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("%w: color %q", ErrInvalidOptions, value)
+	}
+
+	return color.RGBA{
+		R: uint8(parsed >> 24),
+		G: uint8(parsed >> 16),
+		B: uint8(parsed >> 8),
+		A: uint8(parsed),
+	}, nil
+}
+
+func (o Options) ContentType() string {
+	if o.Format == FormatSVG {
+		return "image/svg+xml"
+	}
+	return "image/png"
+}
+
+func Render(content string, opts Options) ([]byte, error) {
+	if opts.Format == FormatSVG {
+		return SVG(content, opts)
+	}
+	return PNG(content, opts)
+}
+
+func modules(content string, opts Options) ([][]bool, error) {
+	level, found := levels[opts.Level]
+	if !found {
+		return nil, fmt.Errorf("%w: level %q", ErrInvalidOptions, opts.Level)
+	}
+
+	code, err := qrcode.New(content, level)
+	if err != nil {
+		return nil, err
+	}
+	code.DisableBorder = true
+
+	return code.Bitmap(), nil
+}
+
+// layout fits the symbol with its margin into the requested size and
+// returns the module scale and the offset of the first module.
+func layout(count int, opts Options) (size, scale, offset int) {
+	total := count + 2*opts.Margin
+	size = opts.Size
+	if size < total {
+		size = total
+	}
+
+	scale = size / total
+	offset = (size - count*scale) / 2
+	return size, scale, offset
+}
+
+func PNG(content string, opts Options) ([]byte, error) {
+	bitmap, err := modules(content, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	size, scale, offset := layout(len(bitmap), opts)
+	img := image.NewPaletted(image.Rect(0, 0, size, size),
+		color.Palette{opts.Background, opts.Foreground})
+
+	for y, row := range bitmap {
+		for x, set := range row {
+			if !set {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.SetColorIndex(offset+x*scale+dx, offset+y*scale+dy, 1)
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func SVG(content string, opts Options) ([]byte, error) {
+	bitmap, err := modules(content, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	size, scale, offset := layout(len(bitmap), opts)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		size, size, size, size)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="%s"/>`, size, size, svgColor(opts.Background))
+	fmt.Fprintf(&buf, `<path fill="%s" d="`, svgColor(opts.Foreground))
+	for y, row := range bitmap {
+		for x, set := range row {
+			if set {
+				fmt.Fprintf(&buf, "M%d %dh%dv%dh-%dz", offset+x*scale, offset+y*scale, scale, scale, scale)
+			}
+		}
+	}
+	buf.WriteString(`"/></svg>`)
+
+	return buf.Bytes(), nil
+}
+
+func svgColor(c color.RGBA) string {
+	if c.A == 0xff {
+		return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+	}
+	return fmt.Sprintf("rgba(%d,%d,%d,%.3f)", c.R, c.G, c.B, float64(c.A)/0xff)
+}
@@ -0,0 +1,80 @@
+package qr
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"image/color"
+	"image/png"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func Test_ParseOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    func(*Options)
+		wantErr bool
+	}{
+		{name: "defaults", query: "", want: func(*Options) {}},
+		{
+			name:  "all parameters",
+			query: "format=svg&size=512&margin=0&level=h&fg=%23ff0000&bg=00000000",
+			want: func(o *Options) {
+				o.Format = FormatSVG
+				o.Size = 512
+				o.Margin = 0
+				o.Level = "H"
+				o.Foreground = color.RGBA{R: 0xff, A: 0xff}
+				o.Background = color.RGBA{}
+			},
+		},
+		{name: "unknown format", query: "format=gif", wantErr: true},
+		{name: "size too small", query: "size=10", wantErr: true},
+		{name: "negative margin", query: "margin=-1", wantErr: true},
+		{name: "unknown level", query: "level=X", wantErr: true},
+		{name: "bad color", query: "fg=red", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values, err := url.ParseQuery(tt.query)
+			require.NoError(t, err)
+
+			opts, err := ParseOptions(values)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidOptions)
+				return
+			}
+			require.NoError(t, err)
+
+			want := DefaultOptions()
+			tt.want(&want)
+			assert.Equal(t, want, opts)
+		})
+	}
+}
+
+func Test_Render(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Size = 300
+
+	data, err := PNG("http://localhost:8080/abcdf12345", opts)
+	require.NoError(t, err)
+
+	img, err := png.Decode(bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.Equal(t, 300, img.Bounds().Dx())
+	assert.Equal(t, 300, img.Bounds().Dy())
+
+	r, g, b, _ := img.At(0, 0).RGBA()
+	assert.Equal(t, []uint32{0xffff, 0xffff, 0xffff}, []uint32{r, g, b}, "margin should be background")
+
+	opts.Format = FormatSVG
+	data, err = Render("http://localhost:8080/abcdf12345", opts)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(data), "<svg"))
+	assert.Contains(t, string(data), `fill="#000000"`)
+}
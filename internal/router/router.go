@@ -3,20 +3,65 @@ package router
 import (
 	"github.com/DavidGQK/go-link-shortener/internal/logger"
 	"github.com/DavidGQK/go-link-shortener/internal/middleware"
+	"github.com/DavidGQK/go-link-shortener/internal/openapi"
 	"github.com/DavidGQK/go-link-shortener/internal/server"
 	"github.com/go-chi/chi/v5"
+	"net/http"
 )
 
 func NewRouter(s server.Server) chi.Router {
 	r := chi.NewRouter()
 	r.Use(logger.Middleware, middleware.GzipMiddleware)
-	r.Get("/{id}", s.CookieMiddleware(s.GetContent))
-	r.Post("/", s.CookieMiddleware(s.PostShortenLink))
-	r.Post("/api/shorten", s.CookieMiddleware(s.PostAPIShortenLink))
-	r.Get("/ping", s.CookieMiddleware(s.Ping))
-	r.Post("/api/shorten/batch", s.CookieMiddleware(s.PostAPIShortenBatch))
-	r.Get("/api/user/urls", s.CookieMiddleware(s.GetUserUrlsAPI))
-	r.Delete("/api/user/urls", s.CookieMiddleware(s.DeleteUserUrls))
+	r.Get("/api/openapi.json", openapi.Handler)
+
+	r.Group(func(r chi.Router) {
+		r.Use(openapi.Validator(server.WriteValidationError))
+		// redirects and other reads don't need a session, only the routes
+		// that create or manage links issue one
+		r.Get("/{id}", s.GetContent)
+		r.Head("/{id}", s.GetContent)
+		r.Post("/{id}", s.GetContent)
+		r.Get("/{id}/qr", s.GetQRCode)
+		r.Head("/{id}/qr", s.GetQRCode)
+		r.Get("/{id}/*", s.GetContent)
+		r.Head("/{id}/*", s.GetContent)
+		r.Post("/{id}/*", s.GetContent)
+		r.Post("/", s.CookieMiddleware(s.IdempotencyMiddleware(s.PostShortenLink)))
+		r.Post("/api/shorten", s.CookieMiddleware(s.IdempotencyMiddleware(s.PostAPIShortenLink)))
+		r.Get("/ping", s.Ping)
+		r.Post("/api/shorten/batch", s.CookieMiddleware(s.IdempotencyMiddleware(s.PostAPIShortenBatch)))
+		r.Get("/api/user/urls", s.CookieMiddleware(s.GetUserUrlsAPI))
+		r.Delete("/api/user/urls", s.CookieMiddleware(s.DeleteUserUrls))
+		r.Patch("/api/user/urls/{id}", s.CookieMiddleware(s.EditUserURL))
+		r.Get("/api/user/tags", s.CookieMiddleware(s.GetUserTags))
+		r.Patch("/api/user/tags/{name}", s.CookieMiddleware(s.RenameUserTag))
+		r.Delete("/api/user/tags/{name}", s.CookieMiddleware(s.DeleteUserTag))
+		r.Get("/api/user/folders", s.CookieMiddleware(s.GetUserFolders))
+		r.Patch("/api/user/folders/{name}", s.CookieMiddleware(s.RenameUserFolder))
+		r.Delete("/api/user/folders/{name}", s.CookieMiddleware(s.DeleteUserFolder))
+		r.Get("/api/user/webhooks", s.CookieMiddleware(s.GetUserWebhooks))
+		r.Post("/api/user/webhooks", s.CookieMiddleware(s.CreateWebhook))
+		r.Delete("/api/user/webhooks/{id}", s.CookieMiddleware(s.DeleteWebhook))
+		r.Get("/api/user/webhooks/{id}/deliveries", s.CookieMiddleware(s.GetWebhookDeliveries))
+	})
+
+	r.Route("/api/v2", func(r chi.Router) {
+		r.NotFound(func(w http.ResponseWriter, _ *http.Request) {
+			server.WriteEnvelopeError(w, http.StatusNotFound, server.CodeNotFound, "Not found")
+		})
+		r.MethodNotAllowed(func(w http.ResponseWriter, _ *http.Request) {
+			server.WriteEnvelopeError(w, http.StatusMethodNotAllowed, server.CodeMethodNotAllowed, "Method not allowed")
+		})
+		r.Group(func(r chi.Router) {
+			r.Use(openapi.Validator(server.WriteEnvelopeError))
+			r.Post("/shorten", s.CookieMiddleware(s.PostAPIShortenLinkV2))
+			r.Post("/shorten/batch", s.CookieMiddleware(s.PostAPIShortenBatchV2))
+			r.Get("/user/urls", s.CookieMiddleware(s.GetUserURLsV2))
+			r.Delete("/user/urls", s.CookieMiddleware(s.DeleteUserURLsV2))
+			r.Patch("/user/urls/{id}", s.CookieMiddleware(s.EditUserURLV2))
+			r.Get("/ping", s.PingV2)
+		})
+	})
 
 	return r
 }
@@ -2,9 +2,9 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/DavidGQK/go-link-shortener/internal/logger"
-	"github.com/DavidGQK/go-link-shortener/internal/storage/initstorage"
 	"github.com/golang-jwt/jwt/v4"
 	"go.uber.org/zap"
 	"net/http"
@@ -18,76 +18,103 @@ type Claims struct {
 
 const SecretKey = "VerySecretKey"
 
+var errInvalidSession = errors.New("invalid session")
+
+type sessionContextKey struct{}
+
+// issuedSessionContextKey marks requests that came without a valid session
+// and were issued one.
+type issuedSessionContextKey struct{}
+
 func (s *Server) CookieMiddleware(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		path := r.URL.Path
-		cookie, err := r.Cookie("shortener_session")
+		var token string
+		if cookie, err := r.Cookie("shortener_session"); err == nil {
+			token = cookie.Value
+		}
+
+		required := r.URL.Path == "/api/user/urls" || r.URL.Path == v2Prefix+"user/urls"
+		session, err := s.session(token, required)
 		if err != nil {
-			newCookie, err := createNewCookie(s.storage)
-			if err != nil {
-				logger.Log.Error("create cookie error", zap.Error(err))
-				http.Error(w, "Internal Backend Error", http.StatusInternalServerError)
-				return
-			}
-			http.SetCookie(w, &http.Cookie{
-				Name:  "shortener_session",
-				Value: newCookie,
-			})
-			r.AddCookie(&http.Cookie{
-				Name:  "shortener_session",
-				Value: newCookie,
-			})
-		} else if !isCookieValid(cookie.Value, s.storage) {
-			if path == "/api/user/urls" {
-				logger.Log.Error("invalid cookie", zap.Error(err))
+			if err == errInvalidSession {
+				logger.Log.Error("invalid cookie")
+				if isV2(r) {
+					WriteEnvelopeError(w, http.StatusUnauthorized, CodeUnauthorized, "Invalid session")
+					return
+				}
 				http.Error(w, "invalid cookie", http.StatusUnauthorized)
 				return
 			}
-
-			newCookie, err := createNewCookie(s.storage)
-			if err != nil {
-				logger.Log.Error("create cookie error", zap.Error(err))
-				http.Error(w, "Internal Backend Error", http.StatusInternalServerError)
+			logger.Log.Error("create cookie error", zap.Error(err))
+			if isV2(r) {
+				WriteEnvelopeError(w, http.StatusInternalServerError, CodeInternal, "Internal Backend Error")
 				return
 			}
+			http.Error(w, "Internal Backend Error", http.StatusInternalServerError)
+			return
+		}
+
+		if session != token {
 			http.SetCookie(w, &http.Cookie{
 				Name:  "shortener_session",
-				Value: newCookie,
-			})
-			r.AddCookie(&http.Cookie{
-				Name:  "shortener_session",
-				Value: newCookie,
+				Value: session,
 			})
 		}
-		h.ServeHTTP(w, r)
+		ctx := context.WithValue(r.Context(), sessionContextKey{}, session)
+		if session != token {
+			ctx = context.WithValue(ctx, issuedSessionContextKey{}, true)
+		}
+		h.ServeHTTP(w, r.WithContext(ctx))
+	}
+}
+
+// requestSession returns the session CookieMiddleware settled on, which
+// isn't always the cookie of the request. Handlers read the session from
+// here and never from the request cookies.
+func requestSession(r *http.Request) string {
+	session, _ := r.Context().Value(sessionContextKey{}).(string)
+	return session
+}
+
+// issuedSession returns the session of the request and whether it was
+// issued to this request rather than sent by the client.
+func issuedSession(r *http.Request) (string, bool) {
+	issued, _ := r.Context().Value(issuedSessionContextKey{}).(bool)
+	return requestSession(r), issued
+}
+
+// session returns the token itself when it's valid and a new token when
+// it's missing or invalid. Calls that need an existing session get
+// errInvalidSession for an invalid token instead.
+func (s *Server) session(token string, required bool) (string, error) {
+	if token == "" {
+		return createNewCookie(s.storage)
+	}
+	if isCookieValid(token, s.storage) {
+		return token, nil
 	}
+	if required {
+		return "", errInvalidSession
+	}
+	return createNewCookie(s.storage)
 }
 
 func createNewCookie(rep repository) (cookie string, err error) {
-	if rep.GetMode() == initstorage.DBMode {
-		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-		defer cancel()
-		user, err := rep.CreateUser(ctx)
-		if err != nil {
-			return "", err
-		}
-		userID := user.UserID
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	user, err := rep.CreateUser(ctx)
+	if err != nil {
+		return "", err
+	}
+	userID := user.UserID
 
-		cookie, err = BuildJWTString(userID)
-		if err != nil {
-			return cookie, err
-		}
-		err = rep.UpdateUser(ctx, userID, cookie)
-		if err != nil {
-			return cookie, err
-		}
-	} else {
-		logger.Log.Infow("not database mode")
-		userID := 1
-		cookie, err = BuildJWTString(userID)
-		if err != nil {
-			return cookie, err
-		}
+	cookie, err = BuildJWTString(userID)
+	if err != nil {
+		return cookie, err
+	}
+	err = rep.UpdateUser(ctx, userID, cookie)
+	if err != nil {
+		return cookie, err
 	}
 
 	return cookie, nil
@@ -106,7 +133,8 @@ func BuildJWTString(userID int) (string, error) {
 	return tokenString, nil
 }
 
-func isCookieValid(cookie string, rep repository) bool {
+// sessionUserID returns the user of a signed session token.
+func sessionUserID(cookie string) (int, error) {
 	claims := &Claims{}
 	token, err := jwt.ParseWithClaims(cookie, claims,
 		func(t *jwt.Token) (interface{}, error) {
@@ -116,18 +144,30 @@ func isCookieValid(cookie string, rep repository) bool {
 			return []byte(SecretKey), nil
 		})
 	if err != nil {
-		logger.Log.Error("parse jwt error", zap.Error(err))
-		return false
+		return 0, err
 	}
-
 	if !token.Valid {
-		logger.Log.Error("token is not valid")
+		return 0, errInvalidSession
+	}
+	return claims.UserID, nil
+}
+
+func isCookieValid(cookie string, rep repository) bool {
+	userID, err := sessionUserID(cookie)
+	if err != nil {
+		logger.Log.Error("parse jwt error", zap.Error(err))
 		return false
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	userID := claims.UserID
-	_, err = rep.FindUserByID(ctx, userID)
-	return err == nil
+	user, err := rep.FindUserByID(ctx, userID)
+	if err != nil {
+		return false
+	}
+	// the file storage restores the users of its links without their sessions
+	if user != nil && user.Cookie != cookie {
+		return rep.UpdateUser(ctx, userID, cookie) == nil
+	}
+	return true
 }
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/DavidGQK/go-link-shortener/internal/domainlist"
+	"github.com/DavidGQK/go-link-shortener/internal/logger"
+	"github.com/DavidGQK/go-link-shortener/internal/models"
+	"github.com/DavidGQK/go-link-shortener/internal/validation"
+	"go.uber.org/zap"
+	"net/url"
+	"time"
+)
+
+func (s *Server) checkDomain(longURLStr string) error {
+	longURL, err := url.Parse(longURLStr)
+	if err != nil {
+		return err
+	}
+
+	host := longURL.Hostname()
+	err = s.domains.Check(host)
+	switch {
+	case errors.Is(err, domainlist.ErrBlocked):
+		return &validation.Error{
+			Code:    validation.CodeDomainBlocked,
+			Message: fmt.Sprintf("domain %q is blocked", host),
+		}
+	case errors.Is(err, domainlist.ErrNotAllowed):
+		return &validation.Error{
+			Code:    validation.CodeDomainNotAllowed,
+			Message: fmt.Sprintf("domain %q is not in the allowlist", host),
+		}
+	}
+
+	return err
+}
+
+func (s *Server) watchDomainLists(ctx context.Context) {
+	rescan := func() {
+		s.rescanBlockedURLs(ctx)
+	}
+
+	rescan()
+	s.domains.Watch(ctx, domainlist.DefaultReloadInterval, rescan, func(err error) {
+		logger.Log.Error("domain lists reloading error", zap.Error(err))
+	})
+}
+
+// rescanBlockedURLs deletes links with a blocked destination, rules and
+// variants included.
+func (s *Server) rescanBlockedURLs(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	records, err := s.storage.GetAllRecords(ctx)
+	if err != nil {
+		logger.Log.Error("get records for domain rescan error", zap.Error(err))
+		return
+	}
+
+	var blocked []models.Record
+	for _, rec := range records {
+		if s.hasBlockedDestination(rec) {
+			blocked = append(blocked, rec)
+		}
+	}
+
+	if len(blocked) == 0 {
+		return
+	}
+
+	if err := s.storage.DeleteBatchRecords(ctx, blocked); err != nil {
+		logger.Log.Error("delete blocked urls error", zap.Error(err))
+		return
+	}
+	s.emitDeleted(blocked)
+
+	logger.Log.Infow("blocked urls deleted", "count", len(blocked))
+}
+
+func (s *Server) hasBlockedDestination(rec models.Record) bool {
+	destinations := []string{rec.OriginalURL}
+	for _, rule := range rec.Rules {
+		destinations = append(destinations, rule.URL)
+	}
+	for _, variant := range rec.Variants {
+		destinations = append(destinations, variant.URL)
+	}
+
+	for _, destination := range destinations {
+		longURL, err := url.Parse(destination)
+		if err != nil {
+			continue
+		}
+		if s.domains.IsBlocked(longURL.Hostname()) {
+			return true
+		}
+	}
+	return false
+}
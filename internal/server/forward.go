@@ -0,0 +1,38 @@
+package server
+
+import (
+	"errors"
+	"net/url"
+	"path"
+	"strings"
+)
+
+var errInvalidSuffix = errors.New("invalid path suffix")
+
+// joinPath appends the part of the request path after the short id to the
+// destination path. Only the path of the destination is touched, so the
+// suffix can't change its scheme or host, and dot segments are resolved
+// before joining, so it can't climb above the destination path either.
+func joinPath(destination, suffix string) (string, error) {
+	if strings.ContainsAny(suffix, "\\\x00") {
+		return "", errInvalidSuffix
+	}
+
+	u, err := url.Parse(destination)
+	if err != nil {
+		return "", err
+	}
+
+	cleaned := path.Clean("/" + suffix)
+	if cleaned == "/" {
+		return destination, nil
+	}
+	if strings.HasSuffix(suffix, "/") {
+		cleaned += "/"
+	}
+
+	u.Path = strings.TrimSuffix(u.Path, "/") + cleaned
+	u.RawPath = ""
+
+	return u.String(), nil
+}
@@ -0,0 +1,409 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/DavidGQK/go-link-shortener/internal/logger"
+	"github.com/DavidGQK/go-link-shortener/internal/models"
+	pb "github.com/DavidGQK/go-link-shortener/internal/proto"
+	"github.com/DavidGQK/go-link-shortener/internal/storage/initstorage"
+	"github.com/DavidGQK/go-link-shortener/internal/validation"
+	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TokenMetadata carries the session token of gRPC calls, the same token
+// the HTTP API keeps in the shortener_session cookie.
+const TokenMetadata = "token"
+
+const errorDomain = "go-link-shortener"
+
+type sessionKey struct{}
+
+// GRPCServer serves the gRPC API with the storage and sessions of the
+// HTTP server.
+type GRPCServer struct {
+	pb.UnimplementedShortenerServer
+	s *Server
+}
+
+func NewGRPCServer(s *Server, opts ...grpc.ServerOption) *grpc.Server {
+	opts = append([]grpc.ServerOption{grpc.UnaryInterceptor(s.sessionInterceptor)}, opts...)
+	srv := grpc.NewServer(opts...)
+	pb.RegisterShortenerServer(srv, &GRPCServer{s: s})
+	return srv
+}
+
+// sessionInterceptor is the CookieMiddleware of gRPC calls. A new token
+// is sent back in the response header.
+func (s *Server) sessionInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	var token string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(TokenMetadata); len(values) > 0 {
+			token = values[0]
+		}
+	}
+
+	session, err := s.session(token, info.FullMethod == pb.Shortener_ListUserURLs_FullMethodName)
+	if err != nil {
+		if err == errInvalidSession {
+			return nil, status.Error(codes.Unauthenticated, "invalid token")
+		}
+		logger.Log.Error("create token error", zap.Error(err))
+		return nil, status.Error(codes.Internal, "Internal Backend Error")
+	}
+
+	if session != token {
+		if err := grpc.SetHeader(ctx, metadata.Pairs(TokenMetadata, session)); err != nil {
+			logger.Log.Error(err)
+		}
+	}
+
+	return handler(context.WithValue(ctx, sessionKey{}, session), req)
+}
+
+func sessionToken(ctx context.Context) string {
+	token, _ := ctx.Value(sessionKey{}).(string)
+	return token
+}
+
+// grpcURLError is writeURLError for gRPC: the code of validation errors
+// goes to the ErrorInfo reason.
+func grpcURLError(err error, correlationID string) error {
+	var validationErr *validation.Error
+	if !errors.As(err, &validationErr) {
+		return status.Error(codes.InvalidArgument, "Invalid request")
+	}
+
+	info := &errdetails.ErrorInfo{Reason: validationErr.Code, Domain: errorDomain}
+	if correlationID != "" {
+		info.Metadata = map[string]string{"correlation_id": correlationID}
+	}
+
+	st, detailsErr := status.New(codes.InvalidArgument, validationErr.Message).WithDetails(info)
+	if detailsErr != nil {
+		return status.Error(codes.InvalidArgument, validationErr.Message)
+	}
+	return st.Err()
+}
+
+func (g *GRPCServer) Shorten(ctx context.Context, req *pb.ShortenRequest) (*pb.ShortenResponse, error) {
+	token := sessionToken(ctx)
+
+	longURLStr := strings.Replace(req.GetUrl(), " ", "", -1)
+	if longURLStr == "" {
+		return nil, status.Error(codes.InvalidArgument, "URL is empty")
+	}
+
+	longURLStr, err := g.s.prepareURL(longURLStr)
+	if err != nil {
+		return nil, grpcURLError(err, "")
+	}
+
+	id := makeRandStringBytes(shortenedURLLength)
+	rec, err := g.s.newRecord(id, longURLStr, linkOptions(req.GetOptions()))
+	if err != nil {
+		return nil, grpcURLError(err, "")
+	}
+
+	err = g.s.storage.Add(rec, token)
+	if err != nil {
+		if err != models.ErrConflict {
+			logger.Log.Error(err)
+			return nil, status.Error(codes.Internal, "Internal Server Error")
+		}
+
+		key, err := g.s.storage.GetByOriginURL(rec.OriginalURL, token)
+		if err == models.ErrNotFound {
+			return nil, status.Error(codes.AlreadyExists, foreignConflictMessage)
+		}
+		if err != nil {
+			logger.Log.Error(err)
+			return nil, status.Error(codes.Internal, "Internal Server Error")
+		}
+		return &pb.ShortenResponse{ShortUrl: g.s.shortURL(key), Conflict: true}, nil
+	}
+
+	g.s.fetchMetadata(rec)
+	g.s.emitEvent(models.EventLinkCreated, rec)
+	return &pb.ShortenResponse{ShortUrl: g.s.shortURL(rec.ShortURL)}, nil
+}
+
+func (g *GRPCServer) ShortenBatch(ctx context.Context, req *pb.ShortenBatchRequest) (*pb.ShortenBatchResponse, error) {
+	var records []models.Record
+	response := &pb.ShortenBatchResponse{}
+
+	for _, item := range req.GetItems() {
+		longURLStr, err := g.s.prepareURL(item.GetOriginalUrl())
+		if err != nil {
+			return nil, grpcURLError(err, item.GetCorrelationId())
+		}
+
+		id := makeRandStringBytes(shortenedURLLength)
+		rec, err := g.s.newRecord(id, longURLStr, linkOptions(item.GetOptions()))
+		if err != nil {
+			return nil, grpcURLError(err, item.GetCorrelationId())
+		}
+		rec.UUID = item.GetCorrelationId()
+
+		records = append(records, rec)
+		response.Results = append(response.Results, &pb.BatchResult{
+			CorrelationId: rec.UUID,
+			ShortUrl:      g.s.shortURL(rec.ShortURL),
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	if err := g.s.storage.AddBatch(ctx, records, sessionToken(ctx)); err != nil {
+		if err == models.ErrConflict {
+			return nil, status.Error(codes.AlreadyExists, "One of the urls is already shortened")
+		}
+		logger.Log.Error(err)
+		return nil, status.Error(codes.Internal, "Internal Backend Error")
+	}
+	g.s.fetchMetadata(records...)
+	g.s.emitEvent(models.EventLinkCreated, records...)
+
+	return response, nil
+}
+
+// Get looks a link up without following it, so no click is registered.
+// Like the preview page it hides destinations that need a password, a click
+// or waiting, and only the owner sees the rules and variants.
+func (g *GRPCServer) Get(ctx context.Context, req *pb.GetRequest) (*pb.GetResponse, error) {
+	if req.GetId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "id is required")
+	}
+
+	domain, err := g.s.linkDomain(req.GetDomain())
+	if err != nil {
+		return nil, grpcURLError(err, "")
+	}
+
+	rec, err := g.s.storage.Get(linkKey(domain, req.GetId()))
+	if err != nil {
+		if err == models.ErrDeleted {
+			return nil, status.Error(codes.NotFound, "URL was deleted")
+		}
+		return nil, status.Error(codes.NotFound, "URL not found")
+	}
+	now := time.Now()
+	if isExpired(rec, now) {
+		return nil, status.Error(codes.NotFound, "URL was deleted")
+	}
+
+	link := g.s.link(rec)
+	if hidesDestination(rec, now) {
+		link.OriginalUrl = ""
+	}
+	if !g.s.isOwner(sessionToken(ctx), rec) {
+		link.Rules = nil
+		link.Variants = nil
+	}
+	return &pb.GetResponse{Link: link}, nil
+}
+
+// isOwner tells whether the session belongs to the user who created the
+// link. Links saved before they had owners belong to nobody.
+func (s *Server) isOwner(session string, rec models.Record) bool {
+	userID, err := sessionUserID(session)
+	return err == nil && rec.UserID > 0 && userID == rec.UserID
+}
+
+func (g *GRPCServer) ListUserURLs(ctx context.Context, req *pb.ListUserURLsRequest) (*pb.ListUserURLsResponse, error) {
+	values := url.Values{"tag": req.GetTags()}
+	if req.Folder != nil {
+		values.Set("folder", req.GetFolder())
+	}
+	if req.GetQuery() != "" {
+		values.Set("q", req.GetQuery())
+	}
+	if req.GetSort() != "" {
+		values.Set("sort", req.GetSort())
+	}
+	if req.GetDesc() {
+		values.Set("order", "desc")
+	}
+	if req.GetIncludeDeleted() {
+		values.Set("include_deleted", "true")
+	}
+	if req.GetLimit() != 0 {
+		values.Set("limit", strconv.Itoa(int(req.GetLimit())))
+	}
+	if req.GetCursor() != "" {
+		values.Set("cursor", req.GetCursor())
+	}
+
+	query, err := listQuery(values)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "Invalid request")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	records, total, next, err := g.s.userRecordsPage(ctx, sessionToken(ctx), query)
+	if err != nil {
+		logger.Log.Error(err)
+		return nil, status.Error(codes.Internal, "Internal Backend Error")
+	}
+
+	response := &pb.ListUserURLsResponse{Total: int32(total), NextCursor: next}
+	for _, rec := range records {
+		response.Urls = append(response.Urls, g.s.link(rec))
+	}
+	return response, nil
+}
+
+// DeleteUserURLs queues the deletion like the HTTP API does. Links on
+// branded domains are named by their full short url.
+func (g *GRPCServer) DeleteUserURLs(ctx context.Context, req *pb.DeleteUserURLsRequest) (*pb.DeleteUserURLsResponse, error) {
+	keys, err := g.s.deletedLinkKeys("", req.GetIds())
+	if err != nil {
+		return nil, grpcURLError(err, "")
+	}
+
+	select {
+	case g.s.DeletedURLsChan <- models.DeletedURLMessage{
+		ShortURLs:  keys,
+		UserCookie: sessionToken(ctx),
+	}:
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+
+	return &pb.DeleteUserURLsResponse{}, nil
+}
+
+func (g *GRPCServer) Ping(_ context.Context, _ *pb.PingRequest) (*pb.PingResponse, error) {
+	if g.s.storage.GetMode() != initstorage.DBMode {
+		return nil, status.Error(codes.Unavailable, "database isn't used")
+	}
+
+	if err := g.s.storage.HealthCheck(); err != nil {
+		logger.Log.Error(err)
+		return nil, status.Error(codes.Unavailable, "database is unavailable")
+	}
+
+	return &pb.PingResponse{}, nil
+}
+
+func linkOptions(opts *pb.LinkOptions) models.LinkOptions {
+	if opts == nil {
+		return models.LinkOptions{}
+	}
+
+	result := models.LinkOptions{
+		RedirectStatus: int(opts.GetRedirectStatus()),
+		Password:       opts.GetPassword(),
+		MaxClicks:      int(opts.GetMaxClicks()),
+		ActiveFrom:     fromTimestamp(opts.GetActiveFrom()),
+		ActiveUntil:    fromTimestamp(opts.GetActiveUntil()),
+		QueryPolicy:    opts.GetQueryPolicy(),
+		ForwardPath:    opts.GetForwardPath(),
+		Domain:         opts.GetDomain(),
+		Tags:           opts.GetTags(),
+		Folder:         opts.GetFolder(),
+		Title:          opts.GetTitle(),
+		Description:    opts.GetDescription(),
+	}
+
+	for _, rule := range opts.GetRules() {
+		result.Rules = append(result.Rules, models.RedirectRule{
+			UserAgent:  rule.GetUserAgent(),
+			OS:         rule.GetOs(),
+			Language:   rule.GetLanguage(),
+			QueryParam: rule.GetQueryParam(),
+			QueryValue: rule.GetQueryValue(),
+			URL:        rule.GetUrl(),
+		})
+	}
+	for _, variant := range opts.GetVariants() {
+		result.Variants = append(result.Variants, models.Variant{
+			URL:    variant.GetUrl(),
+			Weight: int(variant.GetWeight()),
+		})
+	}
+	if utm := opts.GetUtm(); utm != nil {
+		result.UTM = &models.UTMParams{
+			Source:   utm.GetSource(),
+			Medium:   utm.GetMedium(),
+			Campaign: utm.GetCampaign(),
+			Term:     utm.GetTerm(),
+			Content:  utm.GetContent(),
+		}
+	}
+
+	return result
+}
+
+func (s *Server) link(rec models.Record) *pb.Link {
+	resp := s.userURLResponse(rec)
+	link := &pb.Link{
+		ShortUrl:    resp.ShortURL,
+		OriginalUrl: resp.OriginalURL,
+		Title:       resp.Title,
+		Description: resp.Description,
+		ImageUrl:    resp.ImageURL,
+		FaviconUrl:  resp.FaviconURL,
+		CreatedAt:   toTimestamp(&resp.CreatedAt),
+		UpdatedAt:   toTimestamp(&resp.UpdatedAt),
+		ActiveFrom:  toTimestamp(resp.ActiveFrom),
+		ActiveUntil: toTimestamp(resp.ActiveUntil),
+		QueryPolicy: resp.QueryPolicy,
+		ForwardPath: resp.ForwardPath,
+		Domain:      resp.Domain,
+		Tags:        resp.Tags,
+		Folder:      resp.Folder,
+		Clicks:      int32(rec.Clicks),
+		MaxClicks:   int32(rec.MaxClicks),
+		Protected:   rec.PasswordHash != "",
+		Deleted:     rec.DeletedFlag,
+	}
+
+	for _, rule := range resp.Rules {
+		link.Rules = append(link.Rules, &pb.RedirectRule{
+			UserAgent:  rule.UserAgent,
+			Os:         rule.OS,
+			Language:   rule.Language,
+			QueryParam: rule.QueryParam,
+			QueryValue: rule.QueryValue,
+			Url:        rule.URL,
+		})
+	}
+	for _, variant := range resp.Variants {
+		link.Variants = append(link.Variants, &pb.Variant{
+			Url:    variant.URL,
+			Weight: int32(variant.Weight),
+			Clicks: int32(variant.Clicks),
+		})
+	}
+
+	return link
+}
+
+func fromTimestamp(ts *timestamppb.Timestamp) *time.Time {
+	if ts == nil {
+		return nil
+	}
+	t := ts.AsTime()
+	return &t
+}
+
+func toTimestamp(t *time.Time) *timestamppb.Timestamp {
+	if t == nil || t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(*t)
+}
@@ -3,19 +3,25 @@ package server
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"github.com/DavidGQK/go-link-shortener/internal/logger"
 	"github.com/DavidGQK/go-link-shortener/internal/models"
 	"github.com/DavidGQK/go-link-shortener/internal/storage/initstorage"
+	"github.com/DavidGQK/go-link-shortener/internal/targeting"
+	"go.uber.org/zap"
 	"io"
 	"math/rand"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 	"unicode/utf8"
 )
 
+// foreignConflictMessage answers a conflict with a link of another user, which
+// the global dedup scope doesn't hand out.
+const foreignConflictMessage = "The url is already shortened by another user"
+
 func (s *Server) PostShortenLink(w http.ResponseWriter, r *http.Request) {
 	var resp []byte
 	var respStatus int
@@ -37,32 +43,48 @@ func (s *Server) PostShortenLink(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cookie, err := r.Cookie("shortener_session")
+	longURLStr, err = s.prepareURL(longURLStr)
 	if err != nil {
+		writeURLError(w, err, "")
+		return
+	}
+
+	cookie := requestSession(r)
+	if cookie == "" {
 		http.Error(w, "User unauthorized", http.StatusBadRequest)
 		return
 	}
 
 	id := makeRandStringBytes(shortenedURLLength)
-	err = s.storage.Add(id, longURLStr, cookie.Value)
+	rec := models.Record{
+		ShortURL:    id,
+		OriginalURL: longURLStr,
+	}
+	err = s.storage.Add(rec, cookie)
 	if err != nil {
 		if err == models.ErrConflict {
-			id, err = s.storage.GetByOriginURL(longURLStr)
+			id, err = s.storage.GetByOriginURL(longURLStr, cookie)
+			if err == models.ErrNotFound {
+				http.Error(w, foreignConflictMessage, http.StatusConflict)
+				return
+			}
 			if err != nil {
 				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 				return
 			}
 
 			respStatus = http.StatusConflict
-			shortURLStr := fmt.Sprintf("%s/%s", s.config.ShortURLBase, id)
+			shortURLStr := s.shortURL(id)
 			resp = []byte(shortURLStr)
 		} else {
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
 	} else {
+		s.fetchMetadata(rec)
+		s.emitEvent(models.EventLinkCreated, rec)
 		respStatus = http.StatusCreated
-		shortURLStr := fmt.Sprintf("%s/%s", s.config.ShortURLBase, id)
+		shortURLStr := s.shortURL(id)
 		resp = []byte(shortURLStr)
 	}
 
@@ -78,20 +100,78 @@ func (s *Server) PostShortenLink(w http.ResponseWriter, r *http.Request) {
 func (s *Server) GetContent(w http.ResponseWriter, r *http.Request) {
 	relPath := r.URL.Path
 
-	id := strings.Split(relPath, "/")[1]
+	id, suffix, _ := strings.Cut(strings.TrimPrefix(relPath, "/"), "/")
 	if utf8.RuneCountInString(id) == 0 {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	if longURLStr, err := s.storage.Get(id); err == nil {
-		w.Header().Set("Location", longURLStr)
-		w.WriteHeader(http.StatusTemporaryRedirect)
-		_, err := w.Write([]byte(longURLStr))
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+	domain := s.requestDomain(r)
+	if strings.HasSuffix(id, previewSuffix) && suffix == "" {
+		s.previewLink(w, r, linkKey(domain, strings.TrimSuffix(id, previewSuffix)))
+		return
+	}
+
+	key := linkKey(domain, id)
+	if rec, err := s.storage.Get(key); err == nil {
+		if suffix != "" && !rec.ForwardPath {
+			http.NotFound(w, r)
+			return
+		}
+
+		now := time.Now()
+		if isExpired(rec, now) {
+			http.Error(w, "URL was deleted", http.StatusGone)
 			return
 		}
+
+		if isNotYetActive(rec, now) {
+			s.notYetAvailable(w, r, rec)
+			return
+		}
+
+		if !s.checkLinkPassword(w, r, rec) {
+			return
+		}
+
+		// unfurlers and crawlers check links with HEAD, that isn't a click
+		if r.Method != http.MethodHead {
+			ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+			defer cancel()
+			clicks, err := s.storage.RegisterClick(ctx, key)
+			if err != nil {
+				if err == models.ErrDeleted {
+					http.Error(w, "URL was deleted", http.StatusGone)
+					return
+				}
+
+				logger.Log.Error("register click error", zap.Error(err))
+				if rec.MaxClicks > 0 {
+					http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+					return
+				}
+			} else {
+				s.emitClick(rec, clicks)
+			}
+		}
+
+		destination, matched := targeting.Match(rec.Rules, r)
+		if !matched {
+			destination = rec.OriginalURL
+			if len(rec.Variants) > 0 {
+				destination = s.chooseVariant(w, r, rec)
+			}
+		}
+
+		if suffix != "" {
+			destination, err = joinPath(destination, suffix)
+			if err != nil {
+				http.NotFound(w, r)
+				return
+			}
+		}
+
+		s.redirect(w, r, rec, passQuery(destination, r.URL.RawQuery, s.queryPolicy(rec)))
 	} else {
 		if err == models.ErrDeleted {
 			http.Error(w, "URL was deleted", http.StatusGone)
@@ -119,24 +199,40 @@ func (s *Server) PostAPIShortenLink(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cookie, err := r.Cookie("shortener_session")
+	longURLStr, err := s.prepareURL(longURLStr)
 	if err != nil {
+		writeURLError(w, err, "")
+		return
+	}
+
+	cookie := requestSession(r)
+	if cookie == "" {
 		http.Error(w, "User unauthorized", http.StatusBadRequest)
 		return
 	}
 
 	id := makeRandStringBytes(shortenedURLLength)
-	err = s.storage.Add(id, longURLStr, cookie.Value)
+	rec, err := s.newRecord(id, longURLStr, body.LinkOptions)
+	if err != nil {
+		writeURLError(w, err, "")
+		return
+	}
+
+	err = s.storage.Add(rec, cookie)
 	if err != nil {
 		if err == models.ErrConflict {
-			id, err = s.storage.GetByOriginURL(longURLStr)
+			id, err = s.storage.GetByOriginURL(rec.OriginalURL, cookie)
+			if err == models.ErrNotFound {
+				writeError(w, http.StatusConflict, CodeConflict, foreignConflictMessage, "")
+				return
+			}
 			if err != nil {
 				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 				return
 			}
 
 			respStatus = http.StatusConflict
-			shortURLStr := fmt.Sprintf("%s/%s", s.config.ShortURLBase, id)
+			shortURLStr := s.shortURL(id)
 			resp = models.ResponseShortenLink{
 				Result: shortURLStr,
 			}
@@ -145,13 +241,22 @@ func (s *Server) PostAPIShortenLink(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	} else {
+		s.fetchMetadata(rec)
+		s.emitEvent(models.EventLinkCreated, rec)
 		respStatus = http.StatusCreated
-		shortURLStr := fmt.Sprintf("%s/%s", s.config.ShortURLBase, id)
+		shortURLStr := s.shortURL(rec.ShortURL)
 		resp = models.ResponseShortenLink{
 			Result: shortURLStr,
 		}
 	}
 
+	if body.QR {
+		resp.QR, err = qrDataURI(resp.Result)
+		if err != nil {
+			logger.Log.Error(err)
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(respStatus)
 
@@ -195,14 +300,20 @@ func (s *Server) PostAPIShortenBatch(w http.ResponseWriter, r *http.Request) {
 	}
 
 	for _, el := range body {
-		id := makeRandStringBytes(shortenedURLLength)
-		shortURLStr := s.config.ShortURLBase + "/" + id
+		longURLStr, err := s.prepareURL(el.OriginalURL)
+		if err != nil {
+			writeURLError(w, err, el.CorrelationID)
+			return
+		}
 
-		rec := models.Record{
-			UUID:        el.CorrelationID,
-			OriginalURL: el.OriginalURL,
-			ShortURL:    id,
+		id := makeRandStringBytes(shortenedURLLength)
+		rec, err := s.newRecord(id, longURLStr, el.LinkOptions)
+		if err != nil {
+			writeURLError(w, err, el.CorrelationID)
+			return
 		}
+		rec.UUID = el.CorrelationID
+		shortURLStr := s.shortURL(rec.ShortURL)
 
 		records = append(records, rec)
 
@@ -212,13 +323,22 @@ func (s *Server) PostAPIShortenBatch(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 
+	userCookie := requestSession(r)
+
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	err := s.storage.AddBatch(ctx, records)
+	err := s.storage.AddBatch(ctx, records, userCookie)
+	if err == models.ErrConflict {
+		writeError(w, http.StatusConflict, CodeConflict, "One of the urls is already shortened", "")
+		return
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		logger.Log.Error(err)
+		http.Error(w, "Internal Backend Error", http.StatusInternalServerError)
 		return
 	}
+	s.fetchMetadata(records...)
+	s.emitEvent(models.EventLinkCreated, records...)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
@@ -231,34 +351,40 @@ func (s *Server) PostAPIShortenBatch(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) GetUserUrlsAPI(w http.ResponseWriter, r *http.Request) {
-	userCookie, err := r.Cookie("shortener_session")
-	if err != nil {
-		logger.Log.Error(err)
+	userCookie := requestSession(r)
+	if userCookie == "" {
 		http.Error(w, "Invalid cookie", http.StatusUnauthorized)
 		return
 	}
 
+	query, err := parseListQuery(r)
+	if err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	records, err := s.storage.GetUserRecords(ctx, userCookie.Value)
+	records, total, next, err := s.userRecordsPage(ctx, userCookie, query)
 	if err != nil {
 		logger.Log.Error(err)
 		http.Error(w, "Internal Backend Error", http.StatusInternalServerError)
 		return
 	}
-	if len(records) == 0 {
-		http.Error(w, "User doesn't have urls", http.StatusNoContent)
+	if total == 0 {
+		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	if next != "" {
+		w.Header().Set("X-Next-Cursor", next)
+	}
+
 	response := models.ResponseUserURLs{}
 	for _, rec := range records {
-		respEl := models.ResponseUserURL{
-			ShortURL:    fmt.Sprintf("%s/%s", s.config.ShortURLBase, rec.ShortURL),
-			OriginalURL: rec.OriginalURL,
-		}
-		response = append(response, respEl)
+		response = append(response, s.userURLResponse(rec))
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -280,16 +406,21 @@ func (s *Server) DeleteUserUrls(writer http.ResponseWriter, request *http.Reques
 		return
 	}
 
-	userCookie, err := request.Cookie("shortener_session")
-	if err != nil {
-		logger.Log.Error(err)
+	userCookie := requestSession(request)
+	if userCookie == "" {
 		http.Error(writer, "Invalid cookie", http.StatusUnauthorized)
 		return
 	}
 
+	keys, err := s.deletedLinkKeys(request.URL.Query().Get("domain"), urls)
+	if err != nil {
+		writeURLError(writer, err, "")
+		return
+	}
+
 	s.DeletedURLsChan <- models.DeletedURLMessage{
-		ShortURLs:  urls,
-		UserCookie: userCookie.Value,
+		ShortURLs:  keys,
+		UserCookie: userCookie,
 	}
 
 	writer.WriteHeader(http.StatusAccepted)
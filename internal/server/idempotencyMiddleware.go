@@ -0,0 +1,18 @@
+package server
+
+import (
+	"net/http"
+)
+
+// IdempotencyMiddleware replays the stored response to requests repeating
+// an Idempotency-Key of the same session. It goes inside CookieMiddleware,
+// so keys are scoped by the session the request ends up with. A client
+// retrying before it got its first session is found by the request itself
+// and replayed that session.
+func (s *Server) IdempotencyMiddleware(h http.HandlerFunc) http.HandlerFunc {
+	if s.idempotency == nil {
+		return h
+	}
+
+	return s.idempotency.Wrap(h, issuedSession)
+}
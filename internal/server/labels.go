@@ -0,0 +1,214 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/DavidGQK/go-link-shortener/internal/logger"
+	"github.com/DavidGQK/go-link-shortener/internal/models"
+	"github.com/DavidGQK/go-link-shortener/internal/validation"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	maxTags        = 20
+	maxLabelLength = 64
+)
+
+func prepareTags(tags []string) (models.Tags, error) {
+	seen := make(map[string]bool)
+	prepared := make(models.Tags, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || utf8.RuneCountInString(tag) > maxLabelLength {
+			return nil, &validation.Error{
+				Code:    validation.CodeTags,
+				Message: fmt.Sprintf("tags must be 1 to %d characters long", maxLabelLength),
+			}
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			prepared = append(prepared, tag)
+		}
+	}
+
+	if len(prepared) > maxTags {
+		return nil, &validation.Error{
+			Code:    validation.CodeTags,
+			Message: fmt.Sprintf("a link can't have more than %d tags", maxTags),
+		}
+	}
+
+	if len(prepared) == 0 {
+		return nil, nil
+	}
+	sort.Strings(prepared)
+	return prepared, nil
+}
+
+func prepareFolder(folder string) (string, error) {
+	folder = strings.TrimSpace(folder)
+	if utf8.RuneCountInString(folder) > maxLabelLength {
+		return "", &validation.Error{
+			Code:    validation.CodeFolder,
+			Message: fmt.Sprintf("folder can't be longer than %d characters", maxLabelLength),
+		}
+	}
+	return folder, nil
+}
+
+func (s *Server) GetUserTags(w http.ResponseWriter, r *http.Request) {
+	s.listLabels(w, r, models.LabelTag)
+}
+
+func (s *Server) GetUserFolders(w http.ResponseWriter, r *http.Request) {
+	s.listLabels(w, r, models.LabelFolder)
+}
+
+func (s *Server) RenameUserTag(w http.ResponseWriter, r *http.Request) {
+	s.renameLabel(w, r, models.LabelTag)
+}
+
+func (s *Server) RenameUserFolder(w http.ResponseWriter, r *http.Request) {
+	s.renameLabel(w, r, models.LabelFolder)
+}
+
+func (s *Server) DeleteUserTag(w http.ResponseWriter, r *http.Request) {
+	s.deleteLabel(w, r, models.LabelTag)
+}
+
+func (s *Server) DeleteUserFolder(w http.ResponseWriter, r *http.Request) {
+	s.deleteLabel(w, r, models.LabelFolder)
+}
+
+func (s *Server) listLabels(w http.ResponseWriter, r *http.Request, kind string) {
+	userCookie := requestSession(r)
+	if userCookie == "" {
+		http.Error(w, "Invalid cookie", http.StatusUnauthorized)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	labels, err := s.storage.GetUserLabels(ctx, userCookie, kind)
+	if err != nil {
+		logger.Log.Error(err)
+		http.Error(w, "Internal Backend Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(models.ResponseLabels(labels)); err != nil {
+		logger.Log.Error(err)
+	}
+}
+
+func (s *Server) renameLabel(w http.ResponseWriter, r *http.Request, kind string) {
+	var body models.RequestRenameLabel
+
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&body); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	newName, err := prepareLabel(kind, body.Name)
+	if err != nil {
+		writeURLError(w, err, "")
+		return
+	}
+	s.changeLabel(w, r, kind, func(ctx context.Context, cookie, name string) error {
+		return s.storage.RenameUserLabel(ctx, cookie, kind, name, newName)
+	})
+}
+
+func (s *Server) deleteLabel(w http.ResponseWriter, r *http.Request, kind string) {
+	s.changeLabel(w, r, kind, func(ctx context.Context, cookie, name string) error {
+		return s.storage.DeleteUserLabel(ctx, cookie, kind, name)
+	})
+}
+
+func (s *Server) changeLabel(w http.ResponseWriter, r *http.Request, kind string,
+	change func(ctx context.Context, cookie, name string) error) {
+	userCookie := requestSession(r)
+	if userCookie == "" {
+		http.Error(w, "Invalid cookie", http.StatusUnauthorized)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	name := chi.URLParam(r, "name")
+	var labeled []models.Record
+	if s.webhooks != nil {
+		labeled = s.labeledRecords(ctx, userCookie, kind, name)
+	}
+
+	err := change(ctx, userCookie, name)
+	if err != nil {
+		if err == models.ErrNotFound {
+			http.Error(w, "Label not found", http.StatusNotFound)
+			return
+		}
+		logger.Log.Error(err)
+		http.Error(w, "Internal Backend Error", http.StatusInternalServerError)
+		return
+	}
+	s.emitRelabeled(labeled)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// labeledRecords returns the live records of the user that carry a label.
+func (s *Server) labeledRecords(ctx context.Context, cookie, kind, name string) []models.Record {
+	var query models.ListQuery
+	if kind == models.LabelFolder {
+		query.Folder = &name
+	} else {
+		query.Tags = []string{name}
+	}
+
+	records, _, err := s.storage.GetUserRecords(ctx, cookie, query)
+	if err != nil {
+		logger.Log.Errorw("labeled records lookup error", "error", err)
+	}
+	return records
+}
+
+// emitRelabeled sends update events with the relabeled state of records.
+func (s *Server) emitRelabeled(records []models.Record) {
+	var updated []models.Record
+	for _, rec := range records {
+		if rec, err := s.storage.Get(rec.ShortURL); err == nil {
+			updated = append(updated, rec)
+		}
+	}
+
+	s.emitEvent(models.EventLinkUpdated, updated...)
+}
+
+func prepareLabel(kind, name string) (string, error) {
+	if kind == models.LabelFolder {
+		folder, err := prepareFolder(name)
+		if err == nil && folder == "" {
+			err = &validation.Error{Code: validation.CodeFolder, Message: "folder name can't be empty"}
+		}
+		return folder, err
+	}
+
+	tags, err := prepareTags([]string{name})
+	if err != nil {
+		return "", err
+	}
+	return tags[0], nil
+}
@@ -0,0 +1,304 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/DavidGQK/go-link-shortener/internal/logger"
+	"github.com/DavidGQK/go-link-shortener/internal/models"
+	"github.com/DavidGQK/go-link-shortener/internal/validation"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	maxTitleLength       = 256
+	maxDescriptionLength = 2048
+)
+
+func (s *Server) newRecord(id, longURLStr string, opts models.LinkOptions) (models.Record, error) {
+	longURLStr, err := s.utmURL(longURLStr, opts.UTM)
+	if err != nil {
+		return models.Record{}, err
+	}
+
+	rec := models.Record{
+		ShortURL:       id,
+		OriginalURL:    longURLStr,
+		RedirectStatus: opts.RedirectStatus,
+		MaxClicks:      opts.MaxClicks,
+		ActiveFrom:     opts.ActiveFrom,
+		ActiveUntil:    opts.ActiveUntil,
+		QueryPolicy:    opts.QueryPolicy,
+		ForwardPath:    opts.ForwardPath,
+	}
+
+	if err := validateRecord(rec); err != nil {
+		return rec, err
+	}
+
+	domain, err := s.linkDomain(opts.Domain)
+	if err != nil {
+		return rec, err
+	}
+	rec.Domain = domain
+	rec.ShortURL = linkKey(domain, id)
+
+	rec.Tags, err = prepareTags(opts.Tags)
+	if err != nil {
+		return rec, err
+	}
+
+	rec.Folder, err = prepareFolder(opts.Folder)
+	if err != nil {
+		return rec, err
+	}
+
+	rec.Title, rec.Description = strings.TrimSpace(opts.Title), strings.TrimSpace(opts.Description)
+	if err := validateMetadata(rec); err != nil {
+		return rec, err
+	}
+
+	rec.Rules, err = s.prepareRules(opts.Rules)
+	if err != nil {
+		return rec, err
+	}
+
+	rec.Variants, err = s.prepareVariants(opts.Variants)
+	if err != nil {
+		return rec, err
+	}
+	for i := range rec.Variants {
+		rec.Variants[i].URL, err = s.utmURL(rec.Variants[i].URL, opts.UTM)
+		if err != nil {
+			return rec, err
+		}
+	}
+
+	rec.PasswordHash, err = hashLinkPassword(opts.Password)
+	if err != nil {
+		return rec, err
+	}
+
+	return rec, nil
+}
+
+func validateRecord(rec models.Record) error {
+	if err := validateRedirectStatus(rec.RedirectStatus); err != nil {
+		return err
+	}
+
+	if err := validateMaxClicks(rec.MaxClicks); err != nil {
+		return err
+	}
+
+	if err := validateQueryPolicy(rec.QueryPolicy); err != nil {
+		return err
+	}
+
+	return validateSchedule(rec.ActiveFrom, rec.ActiveUntil)
+}
+
+func validateMetadata(rec models.Record) error {
+	if utf8.RuneCountInString(rec.Title) > maxTitleLength {
+		return &validation.Error{
+			Code:    validation.CodeMetadata,
+			Message: fmt.Sprintf("title can't be longer than %d characters", maxTitleLength),
+		}
+	}
+
+	if utf8.RuneCountInString(rec.Description) > maxDescriptionLength {
+		return &validation.Error{
+			Code:    validation.CodeMetadata,
+			Message: fmt.Sprintf("description can't be longer than %d characters", maxDescriptionLength),
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) applyEdit(rec *models.Record, edit models.RequestEditLink) error {
+	if edit.URL != nil {
+		longURLStr, err := s.prepareURL(*edit.URL)
+		if err != nil {
+			return err
+		}
+		rec.OriginalURL = longURLStr
+	}
+
+	if edit.RedirectStatus != nil {
+		rec.RedirectStatus = *edit.RedirectStatus
+	}
+
+	if edit.MaxClicks != nil {
+		rec.MaxClicks = *edit.MaxClicks
+	}
+
+	if edit.ActiveFrom.Set {
+		rec.ActiveFrom = edit.ActiveFrom.Time
+	}
+
+	if edit.ActiveUntil.Set {
+		rec.ActiveUntil = edit.ActiveUntil.Time
+	}
+
+	if edit.QueryPolicy != nil {
+		rec.QueryPolicy = *edit.QueryPolicy
+	}
+
+	if edit.ForwardPath != nil {
+		rec.ForwardPath = *edit.ForwardPath
+	}
+
+	if edit.Tags != nil {
+		tags, err := prepareTags(*edit.Tags)
+		if err != nil {
+			return err
+		}
+		rec.Tags = tags
+	}
+
+	if edit.Folder != nil {
+		folder, err := prepareFolder(*edit.Folder)
+		if err != nil {
+			return err
+		}
+		rec.Folder = folder
+	}
+
+	if edit.Title != nil {
+		rec.Title = strings.TrimSpace(*edit.Title)
+	}
+
+	if edit.Description != nil {
+		rec.Description = strings.TrimSpace(*edit.Description)
+	}
+
+	if err := validateMetadata(*rec); err != nil {
+		return err
+	}
+
+	if err := validateRecord(*rec); err != nil {
+		return err
+	}
+
+	if edit.Rules != nil {
+		rules, err := s.prepareRules(*edit.Rules)
+		if err != nil {
+			return err
+		}
+		rec.Rules = rules
+	}
+
+	if edit.Variants != nil {
+		variants, err := s.prepareVariants(*edit.Variants)
+		if err != nil {
+			return err
+		}
+		keepVariantClicks(rec.Variants, variants)
+		rec.Variants = variants
+	}
+
+	if edit.Password != nil {
+		passwordHash, err := hashLinkPassword(*edit.Password)
+		if err != nil {
+			return err
+		}
+		rec.PasswordHash = passwordHash
+	}
+
+	return nil
+}
+
+func (s *Server) EditUserURL(w http.ResponseWriter, r *http.Request) {
+	var body models.RequestEditLink
+
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&body); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	userCookie := requestSession(r)
+	if userCookie == "" {
+		http.Error(w, "Invalid cookie", http.StatusUnauthorized)
+		return
+	}
+
+	id, err := s.editedLinkKey(r)
+	if err != nil {
+		writeURLError(w, err, "")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// links of other users are not found before anything about them is checked
+	rec, err := s.storage.GetUserRecord(ctx, userCookie, id)
+	if err != nil {
+		if err != models.ErrNotFound && err != models.ErrDeleted {
+			logger.Log.Error(err)
+			http.Error(w, "Internal Backend Error", http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, "URL not found", http.StatusNotFound)
+		return
+	}
+
+	if err := s.applyEdit(&rec, body); err != nil {
+		writeURLError(w, err, "")
+		return
+	}
+
+	err = s.storage.UpdateRecord(ctx, rec, userCookie)
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "URL not found", http.StatusNotFound)
+		case models.ErrConflict:
+			http.Error(w, "URL already exists", http.StatusConflict)
+		default:
+			logger.Log.Error(err)
+			http.Error(w, "Internal Backend Error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if body.URL != nil {
+		s.fetchMetadata(rec)
+	}
+	s.emitEvent(models.EventLinkUpdated, rec)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(s.userURLResponse(rec)); err != nil {
+		logger.Log.Error(err)
+	}
+}
+
+func (s *Server) userURLResponse(rec models.Record) models.ResponseUserURL {
+	return models.ResponseUserURL{
+		ShortURL:    s.shortURL(rec.ShortURL),
+		OriginalURL: rec.OriginalURL,
+		Title:       rec.Title,
+		Description: rec.Description,
+		ImageURL:    rec.ImageURL,
+		FaviconURL:  rec.FaviconURL,
+		CreatedAt:   rec.CreatedAt,
+		UpdatedAt:   rec.UpdatedAt,
+		ActiveFrom:  rec.ActiveFrom,
+		ActiveUntil: rec.ActiveUntil,
+		Rules:       rec.Rules,
+		Variants:    rec.Variants,
+		QueryPolicy: rec.QueryPolicy,
+		ForwardPath: rec.ForwardPath,
+		Domain:      rec.Domain,
+		Tags:        rec.Tags,
+		Folder:      rec.Folder,
+	}
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/DavidGQK/go-link-shortener/internal/models"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+const maxListLimit = 1000
+
+var errInvalidListQuery = errors.New("invalid list query")
+
+func parseListQuery(r *http.Request) (models.ListQuery, error) {
+	return listQuery(r.URL.Query())
+}
+
+func listQuery(values url.Values) (models.ListQuery, error) {
+	query := models.ListQuery{
+		Tags:   values["tag"],
+		Search: values.Get("q"),
+		Sort:   values.Get("sort"),
+	}
+
+	switch query.Sort {
+	case "", models.SortCreated, models.SortClicks, models.SortAlias:
+	default:
+		return query, errInvalidListQuery
+	}
+
+	switch values.Get("order") {
+	case "", "asc":
+	case "desc":
+		query.Desc = true
+	default:
+		return query, errInvalidListQuery
+	}
+
+	if values.Has("folder") {
+		folder := values.Get("folder")
+		query.Folder = &folder
+	}
+
+	if values.Has("include_deleted") {
+		includeDeleted, err := strconv.ParseBool(values.Get("include_deleted"))
+		if err != nil {
+			return query, errInvalidListQuery
+		}
+		query.IncludeDeleted = includeDeleted
+	}
+
+	if values.Has("limit") {
+		limit, err := strconv.Atoi(values.Get("limit"))
+		if err != nil || limit <= 0 || limit > maxListLimit {
+			return query, errInvalidListQuery
+		}
+		query.Limit = limit
+	}
+
+	if cursor := values.Get("cursor"); cursor != "" {
+		after, err := decodeCursor(cursor)
+		if err != nil {
+			return query, errInvalidListQuery
+		}
+		query.After = after
+	}
+
+	return query, nil
+}
+
+// userRecordsPage returns a page of the user's records and the cursor of
+// the next page, if there is one.
+func (s *Server) userRecordsPage(ctx context.Context, cookie string, query models.ListQuery) ([]models.Record, int, string, error) {
+	limit := query.Limit
+	if limit > 0 {
+		query.Limit++
+	}
+
+	records, total, err := s.storage.GetUserRecords(ctx, cookie, query)
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	var next string
+	if limit > 0 && len(records) > limit {
+		records = records[:limit]
+		next = encodeCursor(records[limit-1])
+	}
+	return records, total, next, nil
+}
+
+func encodeCursor(rec models.Record) string {
+	data, _ := json.Marshal(models.ListCursor{
+		CreatedAt: rec.CreatedAt,
+		Clicks:    rec.Clicks,
+		ShortURL:  rec.ShortURL,
+	})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(cursor string) (*models.ListCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	var after models.ListCursor
+	if err := json.Unmarshal(data, &after); err != nil {
+		return nil, err
+	}
+	return &after, nil
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"context"
+	"github.com/DavidGQK/go-link-shortener/internal/logger"
+	"github.com/DavidGQK/go-link-shortener/internal/metadata"
+	"github.com/DavidGQK/go-link-shortener/internal/models"
+	"time"
+)
+
+func (s *Server) fetchMetadata(records ...models.Record) {
+	if s.metadataPool == nil {
+		return
+	}
+
+	for _, rec := range records {
+		job := metadata.Job{Key: rec.ShortURL, URL: rec.OriginalURL}
+		if !s.metadataPool.Enqueue(job) {
+			logger.Log.Warnw("metadata queue is full", "short_url", rec.ShortURL)
+		}
+	}
+}
+
+func (s *Server) storeMetadata(job metadata.Job, meta models.LinkMetadata, err error) {
+	if err != nil {
+		logger.Log.Infow("metadata fetch error", "short_url", job.Key, "url", job.URL, "error", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	if err := s.storage.UpdateMetadata(ctx, job.Key, meta); err != nil {
+		logger.Log.Errorw("metadata update error", "short_url", job.Key, "error", err)
+	}
+}
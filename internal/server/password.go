@@ -0,0 +1,198 @@
+package server
+
+import (
+	"fmt"
+	"github.com/DavidGQK/go-link-shortener/internal/logger"
+	"github.com/DavidGQK/go-link-shortener/internal/models"
+	"github.com/DavidGQK/go-link-shortener/internal/validation"
+	"golang.org/x/crypto/bcrypt"
+	"html/template"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const linkPasswordHeader = "X-Link-Password"
+const maxPasswordLength = 72
+
+var passwordFormTemplate = template.Must(template.New("password").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="robots" content="noindex">
+<title>Password required</title>
+</head>
+<body>
+<h1>This link is password protected</h1>
+{{if .Error}}<p><b>{{.Error}}</b></p>{{end}}
+<form method="post" action="">
+<input type="password" name="password" autofocus required>
+<button type="submit">Continue</button>
+</form>
+</body>
+</html>
+`))
+
+func hashLinkPassword(password string) (string, error) {
+	if password == "" {
+		return "", nil
+	}
+
+	if len(password) > maxPasswordLength {
+		return "", &validation.Error{
+			Code:    validation.CodeInvalidPassword,
+			Message: fmt.Sprintf("password is longer than %d bytes", maxPasswordLength),
+		}
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+func (s *Server) checkLinkPassword(w http.ResponseWriter, r *http.Request, rec models.Record) bool {
+	if rec.PasswordHash == "" {
+		return true
+	}
+
+	password := r.Header.Get(linkPasswordHeader)
+	if password == "" && r.Method == http.MethodPost {
+		password = r.PostFormValue("password")
+	}
+
+	if password == "" {
+		renderPasswordForm(w, rec, "", http.StatusUnauthorized)
+		return false
+	}
+
+	attemptKey := clientIP(r) + "|" + rec.ShortURL
+	if retryAfter := s.passwordAttempts.blockedFor(attemptKey); retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+		http.Error(w, "Too many password attempts", http.StatusTooManyRequests)
+		return false
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(rec.PasswordHash), []byte(password)); err != nil {
+		s.passwordAttempts.fail(attemptKey)
+		logger.Log.Warnw("bad link password attempt",
+			"short_url", rec.ShortURL,
+			"remote_addr", clientIP(r),
+			"user_agent", r.UserAgent(),
+		)
+		renderPasswordForm(w, rec, "Wrong password", http.StatusUnauthorized)
+		return false
+	}
+
+	s.passwordAttempts.reset(attemptKey)
+	return true
+}
+
+func renderPasswordForm(w http.ResponseWriter, rec models.Record, errMsg string, status int) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.WriteHeader(status)
+
+	err := passwordFormTemplate.Execute(w, struct {
+		ShortURL string
+		Error    string
+	}{
+		ShortURL: rec.ShortURL,
+		Error:    errMsg,
+	})
+	if err != nil {
+		logger.Log.Error(err)
+	}
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+type attempt struct {
+	failures int
+	since    time.Time
+}
+
+type attemptLimiter struct {
+	mu          sync.Mutex
+	maxAttempts int
+	lockout     time.Duration
+	attempts    map[string]attempt
+}
+
+func newAttemptLimiter(maxAttempts int, lockout time.Duration) *attemptLimiter {
+	return &attemptLimiter{
+		maxAttempts: maxAttempts,
+		lockout:     lockout,
+		attempts:    make(map[string]attempt),
+	}
+}
+
+func (l *attemptLimiter) blockedFor(key string) time.Duration {
+	if l == nil || l.maxAttempts <= 0 {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	a, found := l.attempts[key]
+	if !found {
+		return 0
+	}
+
+	elapsed := time.Since(a.since)
+	if elapsed >= l.lockout {
+		delete(l.attempts, key)
+		return 0
+	}
+
+	if a.failures < l.maxAttempts {
+		return 0
+	}
+
+	return l.lockout - elapsed
+}
+
+func (l *attemptLimiter) fail(key string) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for k, a := range l.attempts {
+		if now.Sub(a.since) >= l.lockout {
+			delete(l.attempts, k)
+		}
+	}
+
+	a, found := l.attempts[key]
+	if !found {
+		a.since = now
+	}
+	a.failures++
+	l.attempts[key] = a
+}
+
+func (l *attemptLimiter) reset(key string) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.attempts, key)
+}
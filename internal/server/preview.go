@@ -0,0 +1,84 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/DavidGQK/go-link-shortener/internal/logger"
+	"github.com/DavidGQK/go-link-shortener/internal/models"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const previewSuffix = "+"
+
+var previewTemplate = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="robots" content="noindex">
+<title>Link preview</title>
+</head>
+<body>
+<h1>Link preview</h1>
+{{if .OriginalURL}}<p>The short link <b>{{.ShortURL}}</b> leads to:</p>
+<p><code>{{.OriginalURL}}</code></p>
+{{else}}<p>The destination of the short link <b>{{.ShortURL}}</b> is hidden.</p>
+{{end}}{{if .Protected}}<p>This link is password protected.</p>
+{{end}}
+<ul>
+<li>Created: {{if .CreatedAt.IsZero}}unknown{{else}}{{.CreatedAt.Format "2006-01-02 15:04 MST"}}{{end}}</li>
+<li>Clicks: {{.Clicks}}{{if .MaxClicks}} of {{.MaxClicks}}{{end}}</li>
+</ul>
+<p><a href="{{if .OriginalURL}}{{.OriginalURL}}{{else}}{{.ShortURL}}{{end}}" rel="noopener noreferrer nofollow"><button type="button">Continue</button></a></p>
+</body>
+</html>
+`))
+
+// hidesDestination tells whether previews keep the destination of a link to
+// themselves, it's only for visitors who pass the password, the click limit
+// or the start of the schedule.
+func hidesDestination(rec models.Record, now time.Time) bool {
+	return rec.PasswordHash != "" || rec.MaxClicks > 0 || isNotYetActive(rec, now)
+}
+
+func (s *Server) previewLink(w http.ResponseWriter, r *http.Request, id string) {
+	rec, err := s.storage.Get(id)
+	if err != nil {
+		if err == models.ErrDeleted {
+			http.Error(w, "URL was deleted", http.StatusGone)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	preview := models.ResponsePreview{
+		ShortURL:    s.shortURL(rec.ShortURL),
+		OriginalURL: rec.OriginalURL,
+		CreatedAt:   rec.CreatedAt.In(time.UTC),
+		Clicks:      rec.Clicks,
+		MaxClicks:   rec.MaxClicks,
+		Protected:   rec.PasswordHash != "",
+	}
+	if hidesDestination(rec, time.Now()) {
+		preview.OriginalURL = ""
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		encoder := json.NewEncoder(w)
+		if err := encoder.Encode(preview); err != nil {
+			logger.Log.Error(err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	if err := previewTemplate.Execute(w, preview); err != nil {
+		logger.Log.Error(err)
+	}
+}
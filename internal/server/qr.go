@@ -0,0 +1,64 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"github.com/DavidGQK/go-link-shortener/internal/logger"
+	"github.com/DavidGQK/go-link-shortener/internal/models"
+	"github.com/DavidGQK/go-link-shortener/internal/qr"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"time"
+)
+
+const qrCacheMaxAge = 86400
+
+// GetQRCode renders the qr code of a link. Links that forward paths own
+// every path below them, /qr included, so they are redirected instead.
+func (s *Server) GetQRCode(w http.ResponseWriter, r *http.Request) {
+	key := linkKey(s.requestDomain(r), chi.URLParam(r, "id"))
+	rec, err := s.storage.Get(key)
+	if err == nil && rec.ForwardPath {
+		s.GetContent(w, r)
+		return
+	}
+	if err != nil {
+		if err == models.ErrDeleted {
+			http.Error(w, "URL was deleted", http.StatusGone)
+			return
+		}
+		http.Error(w, "URL not found", http.StatusNotFound)
+		return
+	}
+
+	opts, err := qr.ParseOptions(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	data, err := qr.Render(s.shortURL(key), opts)
+	if err != nil {
+		logger.Log.Error(err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	sum := sha256.Sum256(data)
+	w.Header().Set("Content-Type", opts.ContentType())
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", qrCacheMaxAge))
+	w.Header().Set("ETag", fmt.Sprintf(`"%x"`, sum[:16]))
+
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+// qrDataURI renders the default png qr code of a short url for embedding.
+func qrDataURI(shortURL string) (string, error) {
+	data, err := qr.PNG(shortURL, qr.DefaultOptions())
+	if err != nil {
+		return "", err
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(data), nil
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"github.com/DavidGQK/go-link-shortener/internal/models"
+	"github.com/DavidGQK/go-link-shortener/internal/validation"
+	"net/url"
+)
+
+func isQueryPolicy(policy string) bool {
+	switch policy {
+	case models.QueryPolicyAppend, models.QueryPolicyMergeIncoming,
+		models.QueryPolicyMergeStored, models.QueryPolicyDrop:
+		return true
+	}
+	return false
+}
+
+func validateQueryPolicy(policy string) error {
+	if policy == "" || isQueryPolicy(policy) {
+		return nil
+	}
+
+	return &validation.Error{
+		Code:    validation.CodeQueryPolicy,
+		Message: "query policy must be one of append, merge_incoming, merge_stored, drop",
+	}
+}
+
+func (s *Server) queryPolicy(rec models.Record) string {
+	if isQueryPolicy(rec.QueryPolicy) {
+		return rec.QueryPolicy
+	}
+	if isQueryPolicy(s.config.QueryPolicy) {
+		return s.config.QueryPolicy
+	}
+	return models.QueryPolicyDrop
+}
+
+// passQuery carries the query string of a short url visit over to the
+// destination according to the policy.
+func passQuery(destination, rawQuery, policy string) string {
+	if rawQuery == "" || policy == models.QueryPolicyDrop {
+		return destination
+	}
+
+	u, err := url.Parse(destination)
+	if err != nil {
+		return destination
+	}
+
+	incoming, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return destination
+	}
+
+	switch policy {
+	case models.QueryPolicyAppend:
+		if u.RawQuery == "" {
+			u.RawQuery = incoming.Encode()
+		} else {
+			u.RawQuery += "&" + incoming.Encode()
+		}
+	case models.QueryPolicyMergeIncoming, models.QueryPolicyMergeStored:
+		stored := u.Query()
+		for key, values := range incoming {
+			if _, found := stored[key]; found && policy == models.QueryPolicyMergeStored {
+				continue
+			}
+			stored[key] = values
+		}
+		u.RawQuery = stored.Encode()
+	default:
+		return destination
+	}
+
+	return u.String()
+}
+
+func withUTM(destination string, utm *models.UTMParams) string {
+	if utm == nil {
+		return destination
+	}
+
+	u, err := url.Parse(destination)
+	if err != nil {
+		return destination
+	}
+
+	query := u.Query()
+	params := []struct{ key, value string }{
+		{"utm_source", utm.Source},
+		{"utm_medium", utm.Medium},
+		{"utm_campaign", utm.Campaign},
+		{"utm_term", utm.Term},
+		{"utm_content", utm.Content},
+	}
+
+	// the parameters are appended to the raw query, encoding the whole
+	// query would turn keys without a value like ?flag into ?flag=
+	added := make(url.Values)
+	for _, p := range params {
+		if p.value == "" || query.Has(p.key) {
+			continue
+		}
+		added.Set(p.key, p.value)
+	}
+	if len(added) == 0 {
+		return destination
+	}
+
+	if u.RawQuery != "" {
+		u.RawQuery += "&"
+	}
+	u.RawQuery += added.Encode()
+	return u.String()
+}
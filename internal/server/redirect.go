@@ -0,0 +1,138 @@
+package server
+
+import (
+	"fmt"
+	"github.com/DavidGQK/go-link-shortener/internal/models"
+	"github.com/DavidGQK/go-link-shortener/internal/validation"
+	"net/http"
+	"time"
+)
+
+const maxRedirectRules = 20
+
+func isRedirectStatus(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+func validateRedirectStatus(status int) error {
+	if status == 0 || isRedirectStatus(status) {
+		return nil
+	}
+
+	return &validation.Error{
+		Code:    validation.CodeRedirectStatus,
+		Message: fmt.Sprintf("redirect status %d is not one of 301, 302, 307, 308", status),
+	}
+}
+
+func validateMaxClicks(maxClicks int) error {
+	if maxClicks >= 0 {
+		return nil
+	}
+
+	return &validation.Error{
+		Code:    validation.CodeMaxClicks,
+		Message: "max clicks can't be negative",
+	}
+}
+
+func (s *Server) redirectStatus(rec models.Record) int {
+	if isRedirectStatus(rec.RedirectStatus) {
+		return rec.RedirectStatus
+	}
+	if isRedirectStatus(s.config.RedirectStatus) {
+		return s.config.RedirectStatus
+	}
+	return http.StatusTemporaryRedirect
+}
+
+// redirectCacheMaxAge is how long caches may keep a redirect, 0 if they
+// mustn't. Only permanent redirects to the same destination for every visitor
+// are cached, and not past the end of the link schedule.
+func (s *Server) redirectCacheMaxAge(rec models.Record, status int, now time.Time) int {
+	if status != http.StatusMovedPermanently && status != http.StatusPermanentRedirect {
+		return 0
+	}
+	if rec.PasswordHash != "" || rec.MaxClicks > 0 || len(rec.Rules) > 0 || len(rec.Variants) > 0 ||
+		s.queryPolicy(rec) != models.QueryPolicyDrop {
+		return 0
+	}
+
+	maxAge := s.config.RedirectCacheMaxAge
+	if rec.ActiveUntil != nil {
+		if left := int(rec.ActiveUntil.Sub(now) / time.Second); left < maxAge {
+			maxAge = left
+		}
+	}
+	if maxAge < 0 {
+		return 0
+	}
+	return maxAge
+}
+
+func (s *Server) redirect(w http.ResponseWriter, r *http.Request, rec models.Record, destination string) {
+	status := s.redirectStatus(rec)
+	if r.Method == http.MethodPost {
+		status = http.StatusSeeOther
+	}
+
+	if len(rec.Rules) > 0 {
+		w.Header().Set("Vary", "User-Agent, Accept-Language")
+	}
+
+	if maxAge := s.redirectCacheMaxAge(rec, status, time.Now()); maxAge > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", maxAge))
+	} else {
+		w.Header().Set("Cache-Control", "private, no-store")
+	}
+
+	w.Header().Set("Location", destination)
+	w.WriteHeader(status)
+
+	if !s.config.RedirectBody || r.Method == http.MethodHead {
+		return
+	}
+
+	_, err := w.Write([]byte(destination))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+}
+
+func (s *Server) prepareRules(rules models.RedirectRules) (models.RedirectRules, error) {
+	if len(rules) > maxRedirectRules {
+		return nil, &validation.Error{
+			Code:    validation.CodeRules,
+			Message: fmt.Sprintf("a link can't have more than %d rules", maxRedirectRules),
+		}
+	}
+
+	prepared := make(models.RedirectRules, 0, len(rules))
+	for i, rule := range rules {
+		if rule.UserAgent == "" && rule.OS == "" && rule.Language == "" && rule.QueryParam == "" {
+			return nil, &validation.Error{
+				Code:    validation.CodeRules,
+				Message: fmt.Sprintf("rule %d has no conditions", i+1),
+			}
+		}
+
+		longURLStr, err := s.prepareURL(rule.URL)
+		if err != nil {
+			return nil, err
+		}
+		rule.URL = longURLStr
+
+		prepared = append(prepared, rule)
+	}
+
+	if len(prepared) == 0 {
+		return nil, nil
+	}
+	return prepared, nil
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"github.com/DavidGQK/go-link-shortener/internal/logger"
+	"github.com/DavidGQK/go-link-shortener/internal/models"
+	"github.com/DavidGQK/go-link-shortener/internal/validation"
+	"html/template"
+	"net/http"
+	"time"
+)
+
+var notYetAvailableTemplate = template.Must(template.New("scheduled").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="robots" content="noindex">
+<title>Not yet available</title>
+</head>
+<body>
+<h1>This link is not yet available</h1>
+<p>Please come back on {{.ActiveFrom.Format "2006-01-02 15:04 MST"}}.</p>
+</body>
+</html>
+`))
+
+func validateSchedule(activeFrom, activeUntil *time.Time) error {
+	if activeFrom == nil || activeUntil == nil || activeFrom.Before(*activeUntil) {
+		return nil
+	}
+
+	return &validation.Error{
+		Code:    validation.CodeSchedule,
+		Message: "active_from must be before active_until",
+	}
+}
+
+func isExpired(rec models.Record, now time.Time) bool {
+	return rec.ActiveUntil != nil && !now.Before(*rec.ActiveUntil)
+}
+
+func isNotYetActive(rec models.Record, now time.Time) bool {
+	return rec.ActiveFrom != nil && now.Before(*rec.ActiveFrom)
+}
+
+func (s *Server) notYetAvailable(w http.ResponseWriter, r *http.Request, rec models.Record) {
+	w.Header().Set("Cache-Control", "private, no-store")
+
+	if s.config.ScheduleFallbackURL != "" {
+		http.Redirect(w, r, s.config.ScheduleFallbackURL, http.StatusFound)
+		return
+	}
+
+	page := s.schedulePage
+	if page == nil {
+		page = notYetAvailableTemplate
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusNotFound)
+
+	err := page.Execute(w, struct {
+		ShortURL   string
+		ActiveFrom time.Time
+	}{
+		ShortURL:   s.shortURL(rec.ShortURL),
+		ActiveFrom: rec.ActiveFrom.UTC(),
+	})
+	if err != nil {
+		logger.Log.Error(err)
+	}
+}
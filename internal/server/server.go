@@ -2,42 +2,150 @@ package server
 
 import (
 	"context"
+	"fmt"
 	"github.com/DavidGQK/go-link-shortener/internal/config"
+	"github.com/DavidGQK/go-link-shortener/internal/domainlist"
+	"github.com/DavidGQK/go-link-shortener/internal/idempotency"
 	"github.com/DavidGQK/go-link-shortener/internal/logger"
+	"github.com/DavidGQK/go-link-shortener/internal/metadata"
 	"github.com/DavidGQK/go-link-shortener/internal/models"
+	"github.com/DavidGQK/go-link-shortener/internal/webhook"
+	"go.uber.org/zap"
+	"html/template"
 	"time"
 )
 
 type repository interface {
-	Add(string, string, string) error
-	Get(string) (string, error)
+	Add(models.Record, string) error
+	Get(string) (models.Record, error)
+	GetUserRecord(context.Context, string, string) (models.Record, error)
 	HealthCheck() error
 	GetMode() int
-	AddBatch(context.Context, []models.Record) error
-	GetByOriginURL(string) (string, error)
-	GetUserRecords(context.Context, string) ([]models.Record, error)
+	AddBatch(context.Context, []models.Record, string) error
+	GetByOriginURL(string, string) (string, error)
+	GetUserRecords(context.Context, string, models.ListQuery) ([]models.Record, int, error)
 	FindUserByID(context.Context, int) (*models.User, error)
 	CreateUser(context.Context) (*models.User, error)
 	UpdateUser(context.Context, int, string) error
 	DeleteUserURLs(context.Context, models.DeletedURLMessage) error
+	GetAllRecords(context.Context) ([]models.Record, error)
+	DeleteBatchRecords(context.Context, []models.Record) error
+	RegisterClick(context.Context, string) (int, error)
+	UpdateRecord(context.Context, models.Record, string) error
+	RegisterVariantClick(context.Context, string, int) error
+	GetUserLabels(context.Context, string, string) ([]models.LabelCount, error)
+	RenameUserLabel(context.Context, string, string, string, string) error
+	DeleteUserLabel(context.Context, string, string, string) error
+	UpdateMetadata(context.Context, string, models.LinkMetadata) error
+	CreateWebhook(context.Context, string, models.Webhook) error
+	GetUserWebhooks(context.Context, string) ([]models.Webhook, error)
+	DeleteWebhook(context.Context, string, string) error
+	GetLinkWebhooks(context.Context, string) ([]models.Webhook, error)
+	AddWebhookDelivery(context.Context, models.WebhookDelivery) error
+	AddWebhookDeadLetter(context.Context, models.WebhookDelivery) error
+	GetWebhookDeliveries(context.Context, string, models.DeliveryQuery) ([]models.WebhookDelivery, error)
 }
 
 type Server struct {
-	config          *config.Config
-	storage         repository
-	DeletedURLsChan chan models.DeletedURLMessage
+	config           *config.Config
+	storage          repository
+	domains          *domainlist.Engine
+	passwordAttempts *attemptLimiter
+	schedulePage     *template.Template
+	shortDomains     map[string]string
+	metadataPool     *metadata.Pool
+	webhooks         *webhook.Dispatcher
+	idempotency      *idempotency.Cache
+	DeletedURLsChan  chan models.DeletedURLMessage
+	// stop ends the background work started by New
+	stop context.CancelFunc
 }
 
-func New(c *config.Config, s repository) Server {
+// New fails when the domain lists can't be loaded, the server doesn't
+// start without the lists it was configured with.
+func New(c *config.Config, s repository) (Server, error) {
 	server := Server{
-		config:          c,
-		storage:         s,
-		DeletedURLsChan: make(chan models.DeletedURLMessage, 10),
+		config:           c,
+		storage:          s,
+		passwordAttempts: newAttemptLimiter(c.PasswordMaxAttempts, c.PasswordLockout),
+		shortDomains:     parseShortDomains(c.ShortDomains, c.ShortURLBase),
+		DeletedURLsChan:  make(chan models.DeletedURLMessage, 10),
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	server.stop = stop
+
+	server.webhooks = webhook.NewDispatcher(s, webhook.Options{
+		Workers:      c.WebhookWorkers,
+		MaxAttempts:  c.WebhookMaxAttempts,
+		Backoff:      c.WebhookBackoff,
+		Timeout:      c.WebhookTimeout,
+		AllowPrivate: c.AllowPrivateHosts,
+	})
+
+	if c.IdempotencyTTL > 0 {
+		server.idempotency = idempotency.New(c.IdempotencyTTL)
 	}
 
 	go server.deleteMessageBatch()
 
-	return server
+	if c.FetchMetadata {
+		fetcher := metadata.NewFetcher(metadata.Options{
+			Timeout:      c.MetadataTimeout,
+			MaxBytes:     c.MetadataMaxBytes,
+			AllowPrivate: c.AllowPrivateHosts,
+		})
+		server.metadataPool = metadata.NewPool(fetcher, c.MetadataWorkers, 0, c.MetadataTimeout, server.storeMetadata)
+	}
+
+	if c.SchedulePageFile != "" {
+		page, err := template.ParseFiles(c.SchedulePageFile)
+		if err != nil {
+			logger.Log.Error("schedule page loading error", zap.Error(err))
+		} else {
+			server.schedulePage = page
+		}
+	}
+
+	if c.DomainBlocklist != "" || c.DomainAllowlist != "" {
+		domains, err := domainlist.NewEngine(c.DomainBlocklist, c.DomainAllowlist)
+		if err != nil {
+			server.Close()
+			return Server{}, fmt.Errorf("domain lists loading error: %w", err)
+		}
+		server.domains = domains
+		go server.watchDomainLists(ctx)
+	}
+
+	return server, nil
+}
+
+// closeTimeout bounds how long Close waits for queued metadata fetches
+// and webhook deliveries.
+var closeTimeout = 10 * time.Second
+
+// Close stops the background work of the server. Queued metadata fetches
+// and webhook deliveries are drained for at most closeTimeout.
+func (s *Server) Close() {
+	if s.stop != nil {
+		s.stop()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if s.metadataPool != nil {
+			s.metadataPool.Close()
+		}
+		if s.webhooks != nil {
+			s.webhooks.Close()
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(closeTimeout):
+		logger.Log.Warnw("server close timed out, background work is left behind", "timeout", closeTimeout)
+	}
 }
 
 func (s *Server) deleteMessageBatch() {
@@ -47,11 +155,17 @@ func (s *Server) deleteMessageBatch() {
 	for {
 		select {
 		case msg := <-s.DeletedURLsChan:
+			var live []models.Record
+			if s.webhooks != nil {
+				live = s.liveRecords(msg.ShortURLs)
+			}
+
 			err := s.storage.DeleteUserURLs(ctx, msg)
 			if err != nil {
 				logger.Log.Error(err)
 				continue
 			}
+			s.emitDeleted(live)
 		default:
 			continue
 		}
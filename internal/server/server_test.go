@@ -1,14 +1,38 @@
 package server
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"github.com/DavidGQK/go-link-shortener/internal/config"
+	"github.com/DavidGQK/go-link-shortener/internal/domainlist"
+	"github.com/DavidGQK/go-link-shortener/internal/idempotency"
+	"github.com/DavidGQK/go-link-shortener/internal/models"
+	pb "github.com/DavidGQK/go-link-shortener/internal/proto"
+	"github.com/DavidGQK/go-link-shortener/internal/storage/cachestorage"
+	"github.com/DavidGQK/go-link-shortener/internal/storage/initstorage"
+	"github.com/DavidGQK/go-link-shortener/internal/validation"
+	"github.com/DavidGQK/go-link-shortener/internal/webhook"
+	"github.com/go-chi/chi/v5"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 func Test_PostShortenLink(t *testing.T) {
@@ -63,10 +87,7 @@ func Test_PostShortenLink(t *testing.T) {
 				storage: tt.fields.storage,
 			}
 
-			req.AddCookie(&http.Cookie{
-				Name:  "shortener_session",
-				Value: "test",
-			})
+			req = withSession(req, "test")
 
 			s.PostShortenLink(w, req)
 			result := w.Result()
@@ -133,6 +154,967 @@ func Test_GetContent(t *testing.T) {
 	}
 }
 
+func Test_GetContentRedirectStatus(t *testing.T) {
+	cfg := TestCfg
+	cfg.RedirectStatus = http.StatusFound
+	cfg.RedirectCacheMaxAge = 60
+
+	storage := NewTestStorageWithRecords(
+		models.Record{ShortURL: "default123", OriginalURL: "https://practicum.yandex.ru/"},
+		models.Record{
+			ShortURL:       "moved12345",
+			OriginalURL:    "https://practicum.yandex.ru/moved",
+			RedirectStatus: http.StatusMovedPermanently,
+		},
+		models.Record{
+			ShortURL:       "passquery1",
+			OriginalURL:    "https://practicum.yandex.ru/moved",
+			RedirectStatus: http.StatusMovedPermanently,
+			QueryPolicy:    models.QueryPolicyAppend,
+		},
+	)
+
+	tests := []struct {
+		name         string
+		method       string
+		id           string
+		expectedCode int
+		cacheControl string
+	}{
+		{
+			name:         "Response 302 - global redirect status",
+			method:       http.MethodGet,
+			id:           "default123",
+			expectedCode: http.StatusFound,
+			cacheControl: "private, no-store",
+		},
+		{
+			name:         "Response 301 - per-link redirect status",
+			method:       http.MethodGet,
+			id:           "moved12345",
+			expectedCode: http.StatusMovedPermanently,
+			cacheControl: "public, max-age=60",
+		},
+		{
+			name:         "HEAD Response 301 - per-link redirect status",
+			method:       http.MethodHead,
+			id:           "moved12345",
+			expectedCode: http.StatusMovedPermanently,
+			cacheControl: "public, max-age=60",
+		},
+		{
+			name:         "Response 301 - destination depends on the query",
+			method:       http.MethodGet,
+			id:           "passquery1",
+			expectedCode: http.StatusMovedPermanently,
+			cacheControl: "private, no-store",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/"+tt.id, nil)
+			w := httptest.NewRecorder()
+
+			s := Server{
+				config:  &cfg,
+				storage: storage,
+			}
+
+			s.GetContent(w, req)
+			result := w.Result()
+			defer result.Body.Close()
+
+			assert.Equal(t, tt.expectedCode, result.StatusCode)
+			assert.Equal(t, tt.cacheControl, result.Header.Get("Cache-Control"))
+			assert.NotEmpty(t, result.Header.Get("Location"))
+		})
+	}
+}
+
+func Test_redirectCacheMaxAge(t *testing.T) {
+	cfg := TestCfg
+	cfg.RedirectCacheMaxAge = 60
+	s := Server{config: &cfg}
+
+	now := time.Now()
+	soon := now.Add(30 * time.Second)
+	later := now.Add(time.Hour)
+	past := now.Add(-time.Second)
+
+	tests := []struct {
+		name   string
+		rec    models.Record
+		status int
+		want   int
+	}{
+		{name: "permanent", status: http.StatusMovedPermanently, want: 60},
+		{name: "temporary", status: http.StatusTemporaryRedirect, want: 0},
+		{name: "ends after max-age", rec: models.Record{ActiveUntil: &later}, status: http.StatusPermanentRedirect, want: 60},
+		{name: "ends before max-age", rec: models.Record{ActiveUntil: &soon}, status: http.StatusMovedPermanently, want: 30},
+		{name: "ended", rec: models.Record{ActiveUntil: &past}, status: http.StatusMovedPermanently, want: 0},
+		{name: "query policy", rec: models.Record{QueryPolicy: models.QueryPolicyMergeIncoming}, status: http.StatusMovedPermanently, want: 0},
+		{name: "max clicks", rec: models.Record{MaxClicks: 3}, status: http.StatusMovedPermanently, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, s.redirectCacheMaxAge(tt.rec, tt.status, now))
+		})
+	}
+}
+
+func Test_GetContentPreview(t *testing.T) {
+	future := time.Now().Add(time.Hour)
+	storage := NewTestStorageWithRecords(
+		models.Record{
+			ShortURL:    "preview123",
+			OriginalURL: "https://practicum.yandex.ru/",
+			Clicks:      5,
+		},
+		models.Record{
+			ShortURL:    "upcoming12",
+			OriginalURL: "https://practicum.yandex.ru/launch",
+			ActiveFrom:  &future,
+		},
+	)
+
+	tests := []struct {
+		name        string
+		id          string
+		accept      string
+		contentType string
+		contains    string
+		notContains string
+	}{
+		{
+			name:        "HTML preview",
+			id:          "preview123",
+			contentType: "text/html; charset=utf-8",
+			contains:    "https://practicum.yandex.ru/",
+		},
+		{
+			name:        "JSON preview",
+			id:          "preview123",
+			accept:      "application/json",
+			contentType: "application/json",
+			contains:    `"clicks":5`,
+		},
+		{
+			name:        "HTML preview - not yet active",
+			id:          "upcoming12",
+			contentType: "text/html; charset=utf-8",
+			contains:    `/upcoming12" rel=`,
+			notContains: "/launch",
+		},
+		{
+			name:        "JSON preview - not yet active",
+			id:          "upcoming12",
+			accept:      "application/json",
+			contentType: "application/json",
+			contains:    `"short_url"`,
+			notContains: "/launch",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/"+tt.id+"+", nil)
+			req.Header.Set("Accept", tt.accept)
+			w := httptest.NewRecorder()
+
+			s := Server{
+				config:  &TestCfg,
+				storage: storage,
+			}
+
+			s.GetContent(w, req)
+			result := w.Result()
+			defer result.Body.Close()
+
+			assert.Equal(t, http.StatusOK, result.StatusCode)
+			assert.Equal(t, tt.contentType, result.Header.Get("Content-Type"))
+
+			resultBody, err := io.ReadAll(result.Body)
+			require.NoError(t, err)
+			assert.Contains(t, string(resultBody), tt.contains)
+			if tt.notContains != "" {
+				assert.NotContains(t, string(resultBody), tt.notContains)
+			}
+		})
+	}
+}
+
+func Test_GetContentPassword(t *testing.T) {
+	passwordHash, err := hashLinkPassword("secret")
+	require.NoError(t, err)
+
+	storage := NewTestStorageWithRecords(models.Record{
+		ShortURL:     "secret1234",
+		OriginalURL:  "https://practicum.yandex.ru/",
+		PasswordHash: passwordHash,
+	})
+
+	s := Server{
+		config:           &TestCfg,
+		storage:          storage,
+		passwordAttempts: newAttemptLimiter(2, time.Minute),
+	}
+
+	tests := []struct {
+		name         string
+		password     string
+		expectedCode int
+	}{
+		{
+			name:         "Response 401 - password form",
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "Response 401 - wrong password",
+			password:     "wrong",
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "Response 307 - correct password",
+			password:     "secret",
+			expectedCode: http.StatusTemporaryRedirect,
+		},
+		{
+			name:         "Response 401 - second wrong password",
+			password:     "wrong",
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "Response 401 - third wrong password",
+			password:     "wrong",
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "Response 429 - too many attempts",
+			password:     "secret",
+			expectedCode: http.StatusTooManyRequests,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/secret1234", nil)
+			if tt.password != "" {
+				req.Header.Set(linkPasswordHeader, tt.password)
+			}
+			w := httptest.NewRecorder()
+
+			s.GetContent(w, req)
+			result := w.Result()
+			defer result.Body.Close()
+
+			assert.Equal(t, tt.expectedCode, result.StatusCode)
+		})
+	}
+}
+
+func Test_GetContentMaxClicks(t *testing.T) {
+	s := Server{
+		config: &TestCfg,
+		storage: NewTestStorageWithRecords(models.Record{
+			ShortURL:    "onetime123",
+			OriginalURL: "https://practicum.yandex.ru/",
+			MaxClicks:   1,
+		}),
+	}
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodHead, "/onetime123", nil)
+		w := httptest.NewRecorder()
+
+		s.GetContent(w, req)
+		result := w.Result()
+		result.Body.Close()
+
+		assert.Equal(t, http.StatusTemporaryRedirect, result.StatusCode)
+		rec, err := s.storage.Get("onetime123")
+		require.NoError(t, err)
+		assert.Equal(t, 0, rec.Clicks, "HEAD isn't a click")
+	}
+
+	for _, expectedCode := range []int{http.StatusTemporaryRedirect, http.StatusGone, http.StatusGone} {
+		req := httptest.NewRequest(http.MethodGet, "/onetime123", nil)
+		w := httptest.NewRecorder()
+
+		s.GetContent(w, req)
+		result := w.Result()
+		result.Body.Close()
+
+		assert.Equal(t, expectedCode, result.StatusCode)
+	}
+}
+
+func Test_GetContentVariants(t *testing.T) {
+	storage := NewTestStorageWithRecords(models.Record{
+		ShortURL:    "splittest1",
+		OriginalURL: "https://practicum.yandex.ru/",
+		Variants: models.Variants{
+			{URL: "https://practicum.yandex.ru/a", Weight: 70},
+			{URL: "https://practicum.yandex.ru/b", Weight: 30},
+		},
+	})
+	s := Server{
+		config:  &TestCfg,
+		storage: storage,
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/splittest1", nil)
+	w := httptest.NewRecorder()
+	s.GetContent(w, req)
+	result := w.Result()
+	result.Body.Close()
+
+	require.Len(t, result.Cookies(), 1)
+	cookie := result.Cookies()[0]
+	assert.Equal(t, "shortener_variant_splittest1", cookie.Name)
+
+	first := result.Header.Get("Location")
+	assert.Contains(t, []string{"https://practicum.yandex.ru/a", "https://practicum.yandex.ru/b"}, first)
+
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/splittest1", nil)
+		req = withSession(req, cookie.Value)
+		w := httptest.NewRecorder()
+		s.GetContent(w, req)
+		result := w.Result()
+		result.Body.Close()
+
+		assert.Equal(t, first, result.Header.Get("Location"))
+		assert.Equal(t, "private, no-store", result.Header.Get("Cache-Control"))
+	}
+
+	variant, err := strconv.Atoi(cookie.Value)
+	require.NoError(t, err)
+	assert.Equal(t, 4, storage.links["splittest1"].Variants[variant].Clicks)
+}
+
+func Test_GetContentQueryPolicy(t *testing.T) {
+	storage := NewTestStorageWithRecords(
+		models.Record{ShortURL: "querydrop1", OriginalURL: "https://practicum.yandex.ru/?a=1"},
+		models.Record{
+			ShortURL:    "queryappnd",
+			OriginalURL: "https://practicum.yandex.ru/?a=1",
+			QueryPolicy: models.QueryPolicyAppend,
+		},
+		models.Record{
+			ShortURL:    "querymrgin",
+			OriginalURL: "https://practicum.yandex.ru/?a=1",
+			QueryPolicy: models.QueryPolicyMergeIncoming,
+		},
+		models.Record{
+			ShortURL:    "querymrgst",
+			OriginalURL: "https://practicum.yandex.ru/?a=1",
+			QueryPolicy: models.QueryPolicyMergeStored,
+		},
+	)
+
+	tests := []struct {
+		name             string
+		id               string
+		expectedLocation string
+	}{
+		{name: "drop by default", id: "querydrop1", expectedLocation: "https://practicum.yandex.ru/?a=1"},
+		{name: "append", id: "queryappnd", expectedLocation: "https://practicum.yandex.ru/?a=1&a=2&utm_source=mail"},
+		{name: "merge incoming wins", id: "querymrgin", expectedLocation: "https://practicum.yandex.ru/?a=2&utm_source=mail"},
+		{name: "merge stored wins", id: "querymrgst", expectedLocation: "https://practicum.yandex.ru/?a=1&utm_source=mail"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/"+tt.id+"?utm_source=mail&a=2", nil)
+			w := httptest.NewRecorder()
+
+			s := Server{
+				config:  &TestCfg,
+				storage: storage,
+			}
+
+			s.GetContent(w, req)
+			result := w.Result()
+			defer result.Body.Close()
+
+			assert.Equal(t, tt.expectedLocation, result.Header.Get("Location"))
+		})
+	}
+}
+
+func Test_GetContentForwardPath(t *testing.T) {
+	storage := NewTestStorageWithRecords(
+		models.Record{ShortURL: "docs", OriginalURL: "https://practicum.yandex.ru/docs/", ForwardPath: true},
+		models.Record{ShortURL: "plain12345", OriginalURL: "https://practicum.yandex.ru/"},
+	)
+
+	tests := []struct {
+		name             string
+		path             string
+		expectedCode     int
+		expectedLocation string
+	}{
+		{
+			name:             "Response 307 - suffix forwarded",
+			path:             "/docs/guide/intro",
+			expectedCode:     http.StatusTemporaryRedirect,
+			expectedLocation: "https://practicum.yandex.ru/docs/guide/intro",
+		},
+		{
+			name:             "Response 307 - dot segments can't escape destination",
+			path:             "/docs/../../admin",
+			expectedCode:     http.StatusTemporaryRedirect,
+			expectedLocation: "https://practicum.yandex.ru/docs/admin",
+		},
+		{
+			name:             "Response 307 - suffix can't change host",
+			path:             "/docs//evil.com/x",
+			expectedCode:     http.StatusTemporaryRedirect,
+			expectedLocation: "https://practicum.yandex.ru/docs/evil.com/x",
+		},
+		{
+			name:         "Response 404 - forwarding disabled",
+			path:         "/plain12345/guide",
+			expectedCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.URL.Path = tt.path
+			w := httptest.NewRecorder()
+
+			s := Server{
+				config:  &TestCfg,
+				storage: storage,
+			}
+
+			s.GetContent(w, req)
+			result := w.Result()
+			defer result.Body.Close()
+
+			assert.Equal(t, tt.expectedCode, result.StatusCode)
+			assert.Equal(t, tt.expectedLocation, result.Header.Get("Location"))
+		})
+	}
+}
+
+func Test_GetContentShortDomains(t *testing.T) {
+	cfg := TestCfg
+	cfg.ShortURLBase = "https://go.acme.com"
+	cfg.ShortDomains = "https://l.acme.io"
+
+	s := Server{
+		config: &cfg,
+		storage: NewTestStorageWithRecords(
+			models.Record{ShortURL: "promo", OriginalURL: "https://practicum.yandex.ru/public"},
+			models.Record{ShortURL: "l.acme.io/promo", OriginalURL: "https://practicum.yandex.ru/partners", Domain: "l.acme.io"},
+		),
+		shortDomains: parseShortDomains(cfg.ShortDomains, cfg.ShortURLBase),
+	}
+
+	tests := []struct {
+		host             string
+		expectedLocation string
+	}{
+		{host: "go.acme.com", expectedLocation: "https://practicum.yandex.ru/public"},
+		{host: "l.acme.io:443", expectedLocation: "https://practicum.yandex.ru/partners"},
+		{host: "localhost:8080", expectedLocation: "https://practicum.yandex.ru/public"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/promo", nil)
+			req.Host = tt.host
+			w := httptest.NewRecorder()
+
+			s.GetContent(w, req)
+			result := w.Result()
+			defer result.Body.Close()
+
+			assert.Equal(t, tt.expectedLocation, result.Header.Get("Location"))
+		})
+	}
+
+	rec, err := s.newRecord("abc", "https://practicum.yandex.ru/", models.LinkOptions{Domain: "L.acme.io"})
+	require.NoError(t, err)
+	assert.Equal(t, "l.acme.io/abc", rec.ShortURL)
+	assert.Equal(t, "https://l.acme.io/abc", s.shortURL(rec.ShortURL))
+
+	_, err = s.newRecord("abc", "https://practicum.yandex.ru/", models.LinkOptions{Domain: "evil.com"})
+	assert.Error(t, err)
+}
+
+func Test_DeleteUserUrlsShortDomains(t *testing.T) {
+	cfg := TestCfg
+	cfg.ShortURLBase = "https://go.acme.com"
+	cfg.ShortDomains = "https://l.acme.io"
+
+	storage, err := cachestorage.NewCacheStor(0, models.DedupScopeNone)
+	require.NoError(t, err)
+	s := Server{
+		config:          &cfg,
+		storage:         storage,
+		shortDomains:    parseShortDomains(cfg.ShortDomains, cfg.ShortURLBase),
+		DeletedURLsChan: make(chan models.DeletedURLMessage, 10),
+	}
+	session, err := createNewCookie(storage)
+	require.NoError(t, err)
+	for _, key := range []string{"promo", "l.acme.io/promo", "l.acme.io/sale"} {
+		require.NoError(t, storage.Add(models.Record{ShortURL: key, OriginalURL: "https://practicum.yandex.ru/"}, session))
+	}
+
+	tests := []struct {
+		name         string
+		target       string
+		body         string
+		expectedCode int
+		deleted      string
+	}{
+		{name: "Response 422 - unknown domain", target: "/api/user/urls?domain=evil.com", body: `["promo"]`,
+			expectedCode: http.StatusUnprocessableEntity},
+		{name: "Response 422 - unknown short url domain", target: "/api/user/urls", body: `["https://evil.com/promo"]`,
+			expectedCode: http.StatusUnprocessableEntity},
+		{name: "Response 202 - full short url", target: "/api/user/urls", body: `["https://l.acme.io/promo"]`,
+			expectedCode: http.StatusAccepted, deleted: "l.acme.io/promo"},
+		{name: "Response 202 - domain parameter", target: "/api/user/urls?domain=l.acme.io", body: `["sale"]`,
+			expectedCode: http.StatusAccepted, deleted: "l.acme.io/sale"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodDelete, tt.target, strings.NewReader(tt.body))
+			req = withSession(req, session)
+			w := httptest.NewRecorder()
+
+			s.DeleteUserUrls(w, req)
+			require.Equal(t, tt.expectedCode, w.Code)
+			if tt.deleted == "" {
+				assert.Empty(t, s.DeletedURLsChan)
+				return
+			}
+
+			require.NoError(t, storage.DeleteUserURLs(context.Background(), <-s.DeletedURLsChan))
+			_, err := storage.Get(tt.deleted)
+			assert.ErrorIs(t, err, models.ErrDeleted)
+		})
+	}
+
+	_, err = storage.Get("promo")
+	assert.NoError(t, err, "the link with the same id on the default domain stays")
+}
+
+func Test_RescanBlockedURLs(t *testing.T) {
+	blocklist := filepath.Join(t.TempDir(), "blocklist.txt")
+	require.NoError(t, os.WriteFile(blocklist, []byte("bad.com\n"), 0666))
+	domains, err := domainlist.NewEngine(blocklist, "")
+	require.NoError(t, err)
+
+	storage, err := initstorage.NewStorage("", "", models.DedupScopeNone)
+	require.NoError(t, err)
+	records := []models.Record{
+		{ShortURL: "clean12345", OriginalURL: "https://practicum.yandex.ru/"},
+		{ShortURL: "direct1234", OriginalURL: "https://bad.com/"},
+		{
+			ShortURL:    "ruled12345",
+			OriginalURL: "https://practicum.yandex.ru/",
+			Rules:       models.RedirectRules{{Language: "ru", URL: "https://bad.com/ru"}},
+		},
+		{
+			ShortURL:    "variant123",
+			OriginalURL: "https://practicum.yandex.ru/",
+			Variants:    models.Variants{{URL: "https://practicum.yandex.ru/a", Weight: 1}, {URL: "https://bad.com/b", Weight: 1}},
+		},
+	}
+	for _, rec := range records {
+		require.NoError(t, storage.Add(rec, ""))
+	}
+
+	s := Server{config: &TestCfg, storage: storage, domains: domains}
+	s.rescanBlockedURLs(context.Background())
+
+	_, err = storage.Get("clean12345")
+	assert.NoError(t, err)
+	for _, id := range []string{"direct1234", "ruled12345", "variant123"} {
+		_, err = storage.Get(id)
+		assert.ErrorIs(t, err, models.ErrDeleted, id)
+	}
+}
+
+func Test_NewDomainListsError(t *testing.T) {
+	cfg := TestCfg
+	cfg.DomainBlocklist = filepath.Join(t.TempDir(), "missing.txt")
+
+	_, err := New(&cfg, NewTestStorage())
+	assert.Error(t, err, "the server doesn't start without its blocklist")
+
+	allowlist := filepath.Join(t.TempDir(), "allowlist.txt")
+	require.NoError(t, os.WriteFile(allowlist, []byte("/[/\n"), 0666))
+	cfg.DomainBlocklist = ""
+	cfg.DomainAllowlist = allowlist
+
+	_, err = New(&cfg, NewTestStorage())
+	assert.Error(t, err, "the server doesn't start with a broken allowlist")
+}
+
+func Test_GetContentSchedule(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+
+	storage := NewTestStorageWithRecords(
+		models.Record{ShortURL: "upcoming12", OriginalURL: "https://practicum.yandex.ru/", ActiveFrom: &future},
+		models.Record{ShortURL: "expired123", OriginalURL: "https://practicum.yandex.ru/", ActiveUntil: &past},
+		models.Record{
+			ShortURL:    "active1234",
+			OriginalURL: "https://practicum.yandex.ru/",
+			ActiveFrom:  &past,
+			ActiveUntil: &future,
+		},
+	)
+
+	tests := []struct {
+		name         string
+		id           string
+		expectedCode int
+	}{
+		{name: "Response 404 - not yet available", id: "upcoming12", expectedCode: http.StatusNotFound},
+		{name: "Response 410 - window closed", id: "expired123", expectedCode: http.StatusGone},
+		{name: "Response 307 - inside window", id: "active1234", expectedCode: http.StatusTemporaryRedirect},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/"+tt.id, nil)
+			w := httptest.NewRecorder()
+
+			s := Server{
+				config:  &TestCfg,
+				storage: storage,
+			}
+
+			s.GetContent(w, req)
+			result := w.Result()
+			defer result.Body.Close()
+
+			assert.Equal(t, tt.expectedCode, result.StatusCode)
+		})
+	}
+}
+
+func Test_EditUserURL(t *testing.T) {
+	tests := []struct {
+		name         string
+		id           string
+		query        string
+		body         string
+		expectedCode int
+		expectedKey  string
+	}{
+		{
+			name:         "Response 200 - reschedule",
+			id:           "abcdf12345",
+			body:         `{ "active_from": "2030-01-01T00:00:00Z", "active_until": null }`,
+			expectedCode: http.StatusOK,
+			expectedKey:  "abcdf12345",
+		},
+		{
+			name:         "Response 200 - branded domain",
+			id:           "abcdf12345",
+			query:        "?domain=L.acme.io.",
+			body:         `{ "active_from": "2030-01-01T00:00:00Z", "active_until": null }`,
+			expectedCode: http.StatusOK,
+			expectedKey:  "l.acme.io/abcdf12345",
+		},
+		{
+			name:         "Response 422 - unknown domain",
+			id:           "abcdf12345",
+			query:        "?domain=evil.com",
+			body:         `{ "active_from": null }`,
+			expectedCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name:         "Response 422 - window ends before it starts",
+			id:           "abcdf12345",
+			body:         `{ "active_from": "2030-01-02T00:00:00Z", "active_until": "2030-01-01T00:00:00Z" }`,
+			expectedCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name:         "Response 422 - title too long",
+			id:           "abcdf12345",
+			body:         `{ "title": "` + strings.Repeat("a", 300) + `" }`,
+			expectedCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name:         "Response 404 - unknown link",
+			id:           "unknown123",
+			body:         `{ "active_from": null }`,
+			expectedCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := NewTestStorageWithRecords(
+				models.Record{ShortURL: "abcdf12345", OriginalURL: "https://practicum.yandex.ru/"},
+				models.Record{ShortURL: "l.acme.io/abcdf12345", OriginalURL: "https://practicum.yandex.ru/",
+					Domain: "l.acme.io"},
+			)
+
+			req := httptest.NewRequest(http.MethodPatch, "/api/user/urls/"+tt.id+tt.query, strings.NewReader(tt.body))
+			req = withSession(req, "test")
+			rctx := chi.NewRouteContext()
+			rctx.URLParams.Add("id", tt.id)
+			req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+			w := httptest.NewRecorder()
+
+			s := Server{
+				config:       &TestCfg,
+				storage:      storage,
+				shortDomains: parseShortDomains("https://l.acme.io", TestCfg.ShortURLBase),
+			}
+
+			s.EditUserURL(w, req)
+			result := w.Result()
+			defer result.Body.Close()
+
+			assert.Equal(t, tt.expectedCode, result.StatusCode)
+			if tt.expectedCode == http.StatusOK {
+				rec, err := storage.Get(tt.expectedKey)
+				require.NoError(t, err)
+				require.NotNil(t, rec.ActiveFrom)
+				assert.Equal(t, 2030, rec.ActiveFrom.Year())
+				assert.Nil(t, rec.ActiveUntil)
+			}
+		})
+	}
+}
+
+// Test_EditUserURLForeign checks that the links of other users are not
+// found whatever the edit asks for, while the owner gets the real answer.
+func Test_EditUserURLForeign(t *testing.T) {
+	storage, err := cachestorage.NewCacheStor(0, models.DedupScopeNone)
+	require.NoError(t, err)
+	s := Server{config: &TestCfg, storage: storage}
+
+	owner, err := createNewCookie(storage)
+	require.NoError(t, err)
+	other, err := createNewCookie(storage)
+	require.NoError(t, err)
+	require.NoError(t, storage.Add(models.Record{ShortURL: "live", OriginalURL: "https://practicum.yandex.ru/"}, owner))
+	require.NoError(t, storage.Add(models.Record{ShortURL: "gone", OriginalURL: "https://practicum.yandex.ru/gone"}, owner))
+	require.NoError(t, storage.DeleteUserURLs(context.Background(), models.DeletedURLMessage{UserCookie: owner, ShortURLs: []string{"gone"}}))
+
+	tests := []struct {
+		name         string
+		id           string
+		session      string
+		expectedCode int
+		expectedV2   int
+	}{
+		{name: "owner, invalid edit", id: "live", session: owner,
+			expectedCode: http.StatusUnprocessableEntity, expectedV2: http.StatusUnprocessableEntity},
+		{name: "owner, deleted link", id: "gone", session: owner,
+			expectedCode: http.StatusNotFound, expectedV2: http.StatusGone},
+		{name: "other user, invalid edit", id: "live", session: other,
+			expectedCode: http.StatusNotFound, expectedV2: http.StatusNotFound},
+		{name: "other user, deleted link", id: "gone", session: other,
+			expectedCode: http.StatusNotFound, expectedV2: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handlers := []struct {
+				handler      http.HandlerFunc
+				expectedCode int
+			}{
+				{handler: s.EditUserURL, expectedCode: tt.expectedCode},
+				{handler: s.EditUserURLV2, expectedCode: tt.expectedV2},
+			}
+
+			for _, h := range handlers {
+				req := httptest.NewRequest(http.MethodPatch, "/api/user/urls/"+tt.id, strings.NewReader(`{ "redirect_status": 200 }`))
+				req = withSession(req, tt.session)
+				rctx := chi.NewRouteContext()
+				rctx.URLParams.Add("id", tt.id)
+				req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+				w := httptest.NewRecorder()
+
+				h.handler(w, req)
+				assert.Equal(t, h.expectedCode, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func Test_UserURLLabels(t *testing.T) {
+	tagged := models.Record{ShortURL: "tagged1234", OriginalURL: "https://practicum.yandex.ru/1",
+		Tags: models.Tags{"go", "news"}, Folder: "work"}
+	cookie := &http.Cookie{Name: "shortener_session", Value: "session"}
+	work, noFolder := "work", ""
+
+	tests := []struct {
+		name           string
+		query          string
+		expectedTags   []string
+		expectedFolder *string
+	}{
+		{name: "no filter", query: ""},
+		{name: "by tag", query: "?tag=go", expectedTags: []string{"go"}},
+		{name: "by all tags", query: "?tag=go&tag=news", expectedTags: []string{"go", "news"}},
+		{name: "by folder", query: "?folder=work", expectedFolder: &work},
+		{name: "without folder", query: "?folder=", expectedFolder: &noFolder},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := &pagedStorage{
+				TestStorage: NewTestStorage(),
+				pages:       []listPage{{records: []models.Record{tagged}, total: 1}},
+			}
+			s := Server{config: &TestCfg, storage: storage}
+
+			req := httptest.NewRequest(http.MethodGet, "/api/user/urls"+tt.query, nil)
+			req = withSession(req, cookie.Value)
+			w := httptest.NewRecorder()
+
+			s.GetUserUrlsAPI(w, req)
+			result := w.Result()
+			defer result.Body.Close()
+
+			require.Len(t, storage.queries, 1)
+			assert.Equal(t, tt.expectedTags, storage.queries[0].Tags)
+			assert.Equal(t, tt.expectedFolder, storage.queries[0].Folder)
+
+			var response models.ResponseUserURLs
+			require.NoError(t, json.NewDecoder(result.Body).Decode(&response))
+			require.Len(t, response, 1)
+			assert.Equal(t, models.Tags{"go", "news"}, response[0].Tags)
+			assert.Equal(t, "work", response[0].Folder)
+		})
+	}
+
+	s := Server{
+		config: &TestCfg,
+		storage: NewTestStorageWithRecords(tagged,
+			models.Record{ShortURL: "tagged5678", OriginalURL: "https://practicum.yandex.ru/2",
+				Tags: models.Tags{"go"}},
+		),
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/user/tags", nil)
+	req = withSession(req, cookie.Value)
+	w := httptest.NewRecorder()
+
+	s.GetUserTags(w, req)
+	result := w.Result()
+	defer result.Body.Close()
+
+	var labels models.ResponseLabels
+	require.NoError(t, json.NewDecoder(result.Body).Decode(&labels))
+	assert.Equal(t, models.ResponseLabels{{Name: "go", Count: 2}, {Name: "news", Count: 1}}, labels)
+}
+
+func Test_GetUserUrlsAPIPagination(t *testing.T) {
+	var records []models.Record
+	for i := 0; i < 5; i++ {
+		records = append(records, models.Record{
+			ShortURL:    fmt.Sprintf("page%06d", i),
+			OriginalURL: fmt.Sprintf("https://practicum.yandex.ru/%d", i),
+			Clicks:      i,
+		})
+	}
+	deleted := models.Record{
+		ShortURL:    "deleted123",
+		OriginalURL: "https://practicum.yandex.ru/deleted",
+		Clicks:      10,
+		DeletedFlag: true,
+	}
+
+	// the handler asks for one record more than the limit to tell whether
+	// there is a next page
+	storage := &pagedStorage{
+		TestStorage: NewTestStorage(),
+		pages: []listPage{
+			{records: []models.Record{records[4], records[3], records[2]}, total: 5},
+			{records: []models.Record{records[2], records[1], records[0]}, total: 5},
+			{records: []models.Record{records[0]}, total: 5},
+			{records: []models.Record{deleted}, total: 1},
+			{},
+		},
+	}
+	s := Server{
+		config:  &TestCfg,
+		storage: storage,
+	}
+
+	list := func(query string) (models.ResponseUserURLs, *http.Response) {
+		req := httptest.NewRequest(http.MethodGet, "/api/user/urls"+query, nil)
+		req = withSession(req, "session")
+		w := httptest.NewRecorder()
+
+		s.GetUserUrlsAPI(w, req)
+		result := w.Result()
+		defer result.Body.Close()
+
+		var response models.ResponseUserURLs
+		if result.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(result.Body).Decode(&response))
+		}
+		return response, result
+	}
+
+	var seen []string
+	query := "?sort=clicks&order=desc&limit=2"
+	for pages := 0; pages < 5; pages++ {
+		response, result := list(query)
+		assert.Equal(t, "5", result.Header.Get("X-Total-Count"))
+		for _, link := range response {
+			seen = append(seen, link.OriginalURL)
+		}
+
+		cursor := result.Header.Get("X-Next-Cursor")
+		if cursor == "" {
+			break
+		}
+		query = "?sort=clicks&order=desc&limit=2&cursor=" + cursor
+	}
+
+	assert.Equal(t, []string{
+		"https://practicum.yandex.ru/4",
+		"https://practicum.yandex.ru/3",
+		"https://practicum.yandex.ru/2",
+		"https://practicum.yandex.ru/1",
+		"https://practicum.yandex.ru/0",
+	}, seen)
+
+	require.Len(t, storage.queries, 3)
+	assert.Equal(t, models.ListQuery{Sort: models.SortClicks, Desc: true, Limit: 3}, storage.queries[0])
+	assert.Equal(t, models.ListQuery{Sort: models.SortClicks, Desc: true, Limit: 3,
+		After: &models.ListCursor{ShortURL: "page000003", Clicks: 3}}, storage.queries[1])
+	assert.Equal(t, models.ListQuery{Sort: models.SortClicks, Desc: true, Limit: 3,
+		After: &models.ListCursor{ShortURL: "page000001", Clicks: 1}}, storage.queries[2])
+
+	response, result := list("?include_deleted=true&q=DELETED")
+	assert.Equal(t, "1", result.Header.Get("X-Total-Count"))
+	assert.Empty(t, result.Header.Get("X-Next-Cursor"))
+	require.Len(t, response, 1)
+	assert.Equal(t, "https://practicum.yandex.ru/deleted", response[0].OriginalURL)
+	assert.Equal(t, models.ListQuery{Search: "DELETED", IncludeDeleted: true}, storage.queries[3])
+
+	_, result = list("?folder=empty")
+	assert.Equal(t, http.StatusNoContent, result.StatusCode)
+	body, err := io.ReadAll(result.Body)
+	require.NoError(t, err)
+	assert.Empty(t, body)
+
+	_, result = list("?sort=title")
+	assert.Equal(t, http.StatusBadRequest, result.StatusCode)
+	assert.Len(t, storage.queries, 5, "an invalid query doesn't reach the storage")
+}
+
 func Test_PostAPIShortenLink(t *testing.T) {
 	type fields struct {
 		config  *config.Config
@@ -141,8 +1123,17 @@ func Test_PostAPIShortenLink(t *testing.T) {
 
 	type want struct {
 		expectedCode int
+		errorCode    string
+		originalURL  string
 	}
 
+	// the test base is on localhost, which the private host check rejects first
+	publicCfg := TestCfg
+	publicCfg.ShortURLBase = "https://sho.rt/"
+	// utm parameters are added before the length check
+	shortCfg := TestCfg
+	shortCfg.MaxURLLength = len("https://practicum.yandex.ru/?utm_source=mail")
+
 	tests := []struct {
 		name   string
 		body   string
@@ -150,25 +1141,108 @@ func Test_PostAPIShortenLink(t *testing.T) {
 		want   want
 	}{
 		{
-			name: "POST API Response 201 - StatusCreated",
-			body: `{ "url": "https://practicum.yandex.ru/" }`,
+			name: "POST API Response 201 - StatusCreated",
+			body: `{ "url": "https://practicum.yandex.ru/" }`,
+			fields: fields{
+				config:  &TestCfg,
+				storage: NewTestStorage(),
+			},
+			want: want{
+				expectedCode: http.StatusCreated,
+			},
+		},
+		{
+			name: "Response 400 - StatusBadRequest",
+			body: `{ "url": " " }`,
+			fields: fields{
+				config:  &TestCfg,
+				storage: NewTestStorage(),
+			},
+			want: want{
+				expectedCode: http.StatusBadRequest,
+			},
+		},
+		{
+			name: "Response 422 - javascript scheme",
+			body: `{ "url": "javascript:alert(1)" }`,
+			fields: fields{
+				config:  &TestCfg,
+				storage: NewTestStorage(),
+			},
+			want: want{
+				expectedCode: http.StatusUnprocessableEntity,
+			},
+		},
+		{
+			name: "Response 422 - loopback host",
+			body: `{ "url": "http://127.0.0.1/admin" }`,
+			fields: fields{
+				config:  &TestCfg,
+				storage: NewTestStorage(),
+			},
+			want: want{
+				expectedCode: http.StatusUnprocessableEntity,
+				errorCode:    validation.CodePrivateHost,
+			},
+		},
+		{
+			name: "Response 422 - link to the shortener itself",
+			body: `{ "url": "https://sho.rt/abcdf12345" }`,
+			fields: fields{
+				config:  &publicCfg,
+				storage: NewTestStorage(),
+			},
+			want: want{
+				expectedCode: http.StatusUnprocessableEntity,
+				errorCode:    validation.CodeSelfReferencing,
+			},
+		},
+		{
+			name: "Response 201 - utm within the length limit",
+			body: `{ "url": "https://practicum.yandex.ru/", "utm": { "utm_source": "mail" } }`,
+			fields: fields{
+				config:  &shortCfg,
+				storage: NewTestStorage(),
+			},
+			want: want{
+				expectedCode: http.StatusCreated,
+			},
+		},
+		{
+			name: "Response 201 - utm keeps keys without values",
+			body: `{ "url": "https://practicum.yandex.ru/?flag", "utm": { "utm_source": "mail" } }`,
 			fields: fields{
 				config:  &TestCfg,
 				storage: NewTestStorage(),
 			},
 			want: want{
 				expectedCode: http.StatusCreated,
+				originalURL:  "https://practicum.yandex.ru/?flag&utm_source=mail",
 			},
 		},
 		{
-			name: "Response 400 - StatusBadRequest",
-			body: `{ "url": " " }`,
+			name: "Response 422 - too long with utm",
+			body: `{ "url": "https://practicum.yandex.ru/", "utm": { "utm_source": "newsletter" } }`,
 			fields: fields{
-				config:  &TestCfg,
+				config:  &shortCfg,
 				storage: NewTestStorage(),
 			},
 			want: want{
-				expectedCode: http.StatusBadRequest,
+				expectedCode: http.StatusUnprocessableEntity,
+				errorCode:    validation.CodeTooLong,
+			},
+		},
+		{
+			name: "Response 422 - variant too long with utm",
+			body: `{ "url": "https://practicum.yandex.ru/", "utm": { "utm_source": "mail" },
+				"variants": [{ "url": "https://practicum.yandex.ru/a", "weight": 1 }] }`,
+			fields: fields{
+				config:  &shortCfg,
+				storage: NewTestStorage(),
+			},
+			want: want{
+				expectedCode: http.StatusUnprocessableEntity,
+				errorCode:    validation.CodeTooLong,
 			},
 		},
 	}
@@ -185,10 +1259,7 @@ func Test_PostAPIShortenLink(t *testing.T) {
 				storage: tt.fields.storage,
 			}
 
-			req.AddCookie(&http.Cookie{
-				Name:  "shortener_session",
-				Value: "test",
-			})
+			req = withSession(req, "test")
 
 			s.PostAPIShortenLink(w, req)
 			result := w.Result()
@@ -200,11 +1271,89 @@ func Test_PostAPIShortenLink(t *testing.T) {
 				resultBody, err := io.ReadAll(result.Body)
 				require.NoError(t, err)
 				assert.NotEmpty(t, string(resultBody))
+
+				if tt.want.originalURL != "" {
+					var response models.ResponseShortenLink
+					require.NoError(t, json.Unmarshal(resultBody, &response))
+					rec, err := tt.fields.storage.Get(response.Result[strings.LastIndex(response.Result, "/")+1:])
+					require.NoError(t, err)
+					assert.Equal(t, tt.want.originalURL, rec.OriginalURL)
+				}
 			} else {
 				assert.Equal(t, tt.want.expectedCode, result.StatusCode)
 			}
+
+			if tt.want.errorCode != "" {
+				var resp models.ResponseError
+				require.NoError(t, json.NewDecoder(result.Body).Decode(&resp))
+				assert.Equal(t, tt.want.errorCode, resp.Error.Code)
+			}
+		})
+	}
+}
+
+func Test_GetQRCode(t *testing.T) {
+	tests := []struct {
+		name         string
+		id           string
+		query        string
+		expectedCode int
+		contentType  string
+	}{
+		{name: "Response 200 - png", id: "abcdf12345", expectedCode: http.StatusOK, contentType: "image/png"},
+		{name: "Response 200 - svg", id: "abcdf12345", query: "?format=svg&fg=ff0000", expectedCode: http.StatusOK, contentType: "image/svg+xml"},
+		{name: "Response 400 - bad size", id: "abcdf12345", query: "?size=1", expectedCode: http.StatusBadRequest},
+		{name: "Response 404 - unknown link", id: "unknown123", expectedCode: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := Server{
+				config: &TestCfg,
+				storage: NewTestStorageWithRecords(models.Record{
+					ShortURL:    "abcdf12345",
+					OriginalURL: "https://practicum.yandex.ru/",
+				}),
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/"+tt.id+"/qr"+tt.query, nil)
+			rctx := chi.NewRouteContext()
+			rctx.URLParams.Add("id", tt.id)
+			req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+			w := httptest.NewRecorder()
+
+			s.GetQRCode(w, req)
+			result := w.Result()
+			defer result.Body.Close()
+
+			assert.Equal(t, tt.expectedCode, result.StatusCode)
+			if tt.expectedCode != http.StatusOK {
+				return
+			}
+			assert.Equal(t, tt.contentType, result.Header.Get("Content-Type"))
+			assert.Contains(t, result.Header.Get("Cache-Control"), "max-age=")
+			etag := result.Header.Get("ETag")
+			require.NotEmpty(t, etag)
+
+			req.Header.Set("If-None-Match", etag)
+			w = httptest.NewRecorder()
+			s.GetQRCode(w, req)
+			assert.Equal(t, http.StatusNotModified, w.Code)
 		})
 	}
+
+	s := Server{config: &TestCfg, storage: NewTestStorage()}
+	req := httptest.NewRequest(http.MethodPost, "/api/shorten",
+		strings.NewReader(`{ "url": "https://practicum.yandex.ru/", "qr": true }`))
+	req = withSession(req, "test")
+	w := httptest.NewRecorder()
+
+	s.PostAPIShortenLink(w, req)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	var response models.ResponseShortenLink
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+	assert.True(t, strings.HasPrefix(response.QR, "data:image/png;base64,"))
 }
 
 func Test_PostAPIShortenBatch(t *testing.T) {
@@ -254,6 +1403,25 @@ func Test_PostAPIShortenBatch(t *testing.T) {
 				expectedCode: http.StatusBadRequest,
 			},
 		},
+		{
+			name: "Response 409 - StatusConflict",
+			body: `[
+						{
+							"correlation_id": "12345",
+							"original_url": "https://practicum.yandex.ru/1"
+						}
+					]`,
+			fields: fields{
+				config: &TestCfg,
+				storage: dedupStorage{NewTestStorageWithRecords(models.Record{
+					ShortURL:    "abc",
+					OriginalURL: "https://practicum.yandex.ru/1",
+				})},
+			},
+			want: want{
+				expectedCode: http.StatusConflict,
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -284,3 +1452,864 @@ func Test_PostAPIShortenBatch(t *testing.T) {
 		})
 	}
 }
+
+func Test_Webhooks(t *testing.T) {
+	received := make(chan models.WebhookEvent, 10)
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !webhook.Verify("0123456789abcdef", r.Header.Get(webhook.SignatureHeader), body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var event models.WebhookEvent
+		_ = json.Unmarshal(body, &event)
+		received <- event
+	}))
+	defer endpoint.Close()
+
+	cfg := TestCfg
+	cfg.AllowPrivateHosts = true
+	storage, err := cachestorage.NewCacheStor(0, models.DedupScopeNone)
+	require.NoError(t, err)
+	s := Server{
+		config:   &cfg,
+		storage:  storage,
+		webhooks: webhook.NewDispatcher(storage, webhook.Options{AllowPrivate: true}),
+	}
+	defer s.webhooks.Close()
+	session, err := createNewCookie(storage)
+	require.NoError(t, err)
+	cookie := &http.Cookie{Name: "shortener_session", Value: session}
+	otherSession, err := createNewCookie(storage)
+	require.NoError(t, err)
+	other := &http.Cookie{Name: "shortener_session", Value: otherSession}
+
+	tests := []struct {
+		name         string
+		body         string
+		expectedCode int
+	}{
+		{name: "Response 422 - unknown event", body: `{ "url": "` + endpoint.URL + `", "events": ["link.renamed"] }`,
+			expectedCode: http.StatusUnprocessableEntity},
+		{name: "Response 422 - thresholds missing", body: `{ "url": "` + endpoint.URL + `", "events": ["link.click_threshold"] }`,
+			expectedCode: http.StatusUnprocessableEntity},
+		{name: "Response 422 - short secret", body: `{ "url": "` + endpoint.URL + `", "events": ["link.created"], "secret": "short" }`,
+			expectedCode: http.StatusUnprocessableEntity},
+		{name: "Response 201", body: `{ "url": "` + endpoint.URL + `", "secret": "0123456789abcdef",
+			"events": ["link.created", "link.click_threshold"], "click_thresholds": [1] }`,
+			expectedCode: http.StatusCreated},
+	}
+
+	var hook models.Webhook
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/user/webhooks", strings.NewReader(tt.body))
+			req = withSession(req, cookie.Value)
+			w := httptest.NewRecorder()
+
+			s.CreateWebhook(w, req)
+			require.Equal(t, tt.expectedCode, w.Code)
+			if tt.expectedCode == http.StatusCreated {
+				require.NoError(t, json.NewDecoder(w.Body).Decode(&hook))
+				assert.Equal(t, "0123456789abcdef", hook.Secret)
+			}
+		})
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(`{ "url": "https://practicum.yandex.ru/" }`))
+	req = withSession(req, cookie.Value)
+	w := httptest.NewRecorder()
+	s.PostAPIShortenLink(w, req)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	var created models.ResponseShortenLink
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&created))
+
+	select {
+	case event := <-received:
+		assert.Equal(t, models.EventLinkCreated, event.Type)
+		assert.Equal(t, created.Result, event.Link.ShortURL)
+	case <-time.After(3 * time.Second):
+		t.Fatal("created event wasn't delivered")
+	}
+
+	req = httptest.NewRequest(http.MethodGet, created.Result[strings.LastIndex(created.Result, "/"):], nil)
+	w = httptest.NewRecorder()
+	s.GetContent(w, req)
+	require.Equal(t, http.StatusTemporaryRedirect, w.Code)
+
+	select {
+	case event := <-received:
+		assert.Equal(t, models.EventLinkClickThreshold, event.Type)
+		assert.Equal(t, 1, event.Clicks)
+	case <-time.After(3 * time.Second):
+		t.Fatal("click threshold event wasn't delivered")
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/user/webhooks/"+hook.ID+"/deliveries", nil)
+	req = withSession(req, cookie.Value)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("id", hook.ID)
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+
+	var deliveries []models.WebhookDelivery
+	require.Eventually(t, func() bool {
+		w = httptest.NewRecorder()
+		s.GetWebhookDeliveries(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&deliveries))
+		return len(deliveries) == 2
+	}, 3*time.Second, 10*time.Millisecond)
+	assert.True(t, deliveries[0].Success)
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/api/user/webhooks", nil)
+	req = withSession(req, cookie.Value)
+	s.GetUserWebhooks(w, req)
+
+	var hooks []models.Webhook
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&hooks))
+	require.Len(t, hooks, 1)
+	assert.Empty(t, hooks[0].Secret)
+
+	// other users neither see the webhook nor trigger it
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/api/user/webhooks", nil)
+	req = withSession(req, other.Value)
+	s.GetUserWebhooks(w, req)
+	assert.JSONEq(t, `[]`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/api/user/webhooks/"+hook.ID+"/deliveries?dead=true", nil)
+	req = withSession(req, other.Value)
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	s.GetWebhookDeliveries(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodDelete, "/api/user/webhooks/"+hook.ID, nil)
+	req = withSession(req, other.Value)
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	s.DeleteWebhook(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	req = httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(`{ "url": "https://practicum.yandex.ru/other" }`))
+	req = withSession(req, other.Value)
+	w = httptest.NewRecorder()
+	s.PostAPIShortenLink(w, req)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	select {
+	case event := <-received:
+		t.Fatalf("%s event of another user was delivered", event.Type)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func Test_WebhookEventOwners(t *testing.T) {
+	storage, err := cachestorage.NewCacheStor(0, models.DedupScopeNone)
+	require.NoError(t, err)
+
+	blocklist := filepath.Join(t.TempDir(), "blocklist.txt")
+	require.NoError(t, os.WriteFile(blocklist, []byte("bad.com\n"), 0666))
+	domains, err := domainlist.NewEngine(blocklist, "")
+	require.NoError(t, err)
+
+	s := Server{
+		config:   &TestCfg,
+		storage:  storage,
+		domains:  domains,
+		webhooks: webhook.NewDispatcher(storage, webhook.Options{AllowPrivate: true}),
+	}
+	defer s.webhooks.Close()
+
+	// every user gets an endpoint and a link of their own
+	sessions := make([]string, 2)
+	received := make([]chan models.WebhookEvent, 2)
+	for i := range sessions {
+		events := make(chan models.WebhookEvent, 10)
+		endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var event models.WebhookEvent
+			_ = json.NewDecoder(r.Body).Decode(&event)
+			events <- event
+		}))
+		defer endpoint.Close()
+
+		session, err := createNewCookie(storage)
+		require.NoError(t, err)
+		require.NoError(t, storage.CreateWebhook(context.Background(), session, models.Webhook{
+			ID:     fmt.Sprintf("hook%d", i),
+			URL:    endpoint.URL,
+			Secret: "0123456789abcdef",
+			Events: models.WebhookEvents{models.EventLinkUpdated, models.EventLinkDeleted},
+		}))
+		require.NoError(t, storage.Add(models.Record{
+			ShortURL:    fmt.Sprintf("owned%05d", i),
+			OriginalURL: "https://bad.com/" + strconv.Itoa(i),
+			Tags:        models.Tags{"go"},
+		}, session))
+
+		sessions[i], received[i] = session, events
+	}
+	require.NoError(t, storage.Add(models.Record{ShortURL: "anonymous0", OriginalURL: "https://bad.com/"}, ""))
+
+	expect := func(i int, eventType string, check func(models.WebhookEvent)) {
+		t.Helper()
+		select {
+		case event := <-received[i]:
+			assert.Equal(t, eventType, event.Type)
+			assert.Equal(t, s.shortURL(fmt.Sprintf("owned%05d", i)), event.Link.ShortURL)
+			if check != nil {
+				check(event)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("%s event of user %d wasn't delivered", eventType, i)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPut, "/api/user/tags/go", strings.NewReader(`{ "name": "golang" }`))
+	req = withSession(req, sessions[0])
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("name", "go")
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	w := httptest.NewRecorder()
+	s.RenameUserTag(w, req)
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	expect(0, models.EventLinkUpdated, func(event models.WebhookEvent) {
+		assert.Equal(t, models.Tags{"golang"}, event.Link.Tags)
+	})
+
+	// the blocklist deletes links of both users in one batch
+	s.rescanBlockedURLs(context.Background())
+	for i := range sessions {
+		expect(i, models.EventLinkDeleted, nil)
+	}
+
+	for i := range received {
+		select {
+		case event := <-received[i]:
+			t.Fatalf("unexpected %s event for user %d", event.Type, i)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func Test_GRPC(t *testing.T) {
+	storage := NewTestStorage()
+	s := Server{
+		config:          &TestCfg,
+		storage:         storage,
+		DeletedURLsChan: make(chan models.DeletedURLMessage, 1),
+	}
+
+	listener := bufconn.Listen(1 << 20)
+	srv := NewGRPCServer(&s)
+	go func() {
+		_ = srv.Serve(listener)
+	}()
+	defer srv.Stop()
+
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	client := pb.NewShortenerClient(conn)
+
+	var header metadata.MD
+	shortened, err := client.Shorten(context.Background(), &pb.ShortenRequest{
+		Url:     "https://practicum.yandex.ru/grpc",
+		Options: &pb.LinkOptions{Tags: []string{"docs"}, Title: "gRPC"},
+	}, grpc.Header(&header))
+	require.NoError(t, err)
+	require.Len(t, header.Get(TokenMetadata), 1)
+	token := header.Get(TokenMetadata)[0]
+	id := shortened.ShortUrl[strings.LastIndex(shortened.ShortUrl, "/")+1:]
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), TokenMetadata, token)
+	header = nil
+	_, err = client.Shorten(ctx, &pb.ShortenRequest{Url: "https://practicum.yandex.ru/again"}, grpc.Header(&header))
+	require.NoError(t, err)
+	assert.Empty(t, header.Get(TokenMetadata), "a valid token isn't replaced")
+
+	_, err = client.Shorten(ctx, &pb.ShortenRequest{Url: "ftp://practicum.yandex.ru"})
+	st := status.Convert(err)
+	assert.Equal(t, codes.InvalidArgument, st.Code())
+	require.Len(t, st.Details(), 1)
+	assert.Equal(t, validation.CodeSchemeNotAllowed, st.Details()[0].(*errdetails.ErrorInfo).Reason)
+
+	batch, err := client.ShortenBatch(ctx, &pb.ShortenBatchRequest{Items: []*pb.BatchItem{
+		{CorrelationId: "1", OriginalUrl: "https://practicum.yandex.ru/1"},
+		{CorrelationId: "2", OriginalUrl: "https://practicum.yandex.ru/2"},
+	}})
+	require.NoError(t, err)
+	require.Len(t, batch.Results, 2)
+	assert.Equal(t, "2", batch.Results[1].CorrelationId)
+
+	_, err = client.ShortenBatch(ctx, &pb.ShortenBatchRequest{Items: []*pb.BatchItem{
+		{CorrelationId: "bad", OriginalUrl: "javascript:alert(1)"},
+	}})
+	st = status.Convert(err)
+	assert.Equal(t, codes.InvalidArgument, st.Code())
+	require.Len(t, st.Details(), 1)
+	assert.Equal(t, "bad", st.Details()[0].(*errdetails.ErrorInfo).Metadata["correlation_id"])
+
+	got, err := client.Get(ctx, &pb.GetRequest{Id: id})
+	require.NoError(t, err)
+	assert.Equal(t, "https://practicum.yandex.ru/grpc", got.Link.OriginalUrl)
+	assert.Equal(t, []string{"docs"}, got.Link.Tags)
+	assert.Equal(t, "gRPC", got.Link.Title)
+
+	protected, err := client.Shorten(ctx, &pb.ShortenRequest{
+		Url:     "https://practicum.yandex.ru/secret",
+		Options: &pb.LinkOptions{Password: "secret"},
+	})
+	require.NoError(t, err)
+	got, err = client.Get(ctx, &pb.GetRequest{Id: protected.ShortUrl[strings.LastIndex(protected.ShortUrl, "/")+1:]})
+	require.NoError(t, err)
+	assert.True(t, got.Link.Protected)
+	assert.Empty(t, got.Link.OriginalUrl)
+
+	_, err = client.Get(ctx, &pb.GetRequest{Id: "unknown"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	listed, err := client.ListUserURLs(ctx, &pb.ListUserURLsRequest{Limit: 2})
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), listed.Total)
+	assert.Len(t, listed.Urls, 2)
+	assert.NotEmpty(t, listed.NextCursor)
+
+	_, err = client.ListUserURLs(ctx, &pb.ListUserURLsRequest{Sort: "title"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	invalid := metadata.AppendToOutgoingContext(context.Background(), TokenMetadata, "invalid")
+	_, err = client.ListUserURLs(invalid, &pb.ListUserURLsRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	_, err = client.DeleteUserURLs(ctx, &pb.DeleteUserURLsRequest{Ids: []string{id}})
+	require.NoError(t, err)
+	select {
+	case msg := <-s.DeletedURLsChan:
+		assert.Equal(t, token, msg.UserCookie)
+		assert.Equal(t, []string{id}, msg.ShortURLs)
+	case <-time.After(time.Second):
+		t.Fatal("deletion isn't queued")
+	}
+
+	_, err = client.Ping(ctx, &pb.PingRequest{})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+type dedupStorage struct {
+	*TestStorage
+}
+
+func (s dedupStorage) Add(rec models.Record, cookie string) error {
+	if _, err := s.GetByOriginURL(rec.OriginalURL, cookie); err == nil {
+		return models.ErrConflict
+	}
+	return s.TestStorage.Add(rec, cookie)
+}
+
+func (s dedupStorage) AddBatch(_ context.Context, records []models.Record, _ string) error {
+	for _, rec := range records {
+		if _, err := s.GetByOriginURL(rec.OriginalURL, ""); err == nil {
+			return models.ErrConflict
+		}
+	}
+	for _, rec := range records {
+		s.links[rec.ShortURL] = rec
+	}
+	return nil
+}
+
+func (s dedupStorage) GetByOriginURL(originalURL, _ string) (string, error) {
+	for key, rec := range s.links {
+		if rec.OriginalURL == originalURL {
+			return key, nil
+		}
+	}
+	return "", models.ErrNotFound
+}
+
+// foreignStorage keeps links of another user, the conflicts of the global
+// dedup scope have no link of the caller.
+type foreignStorage struct {
+	dedupStorage
+}
+
+func (s foreignStorage) GetByOriginURL(_, _ string) (string, error) {
+	return "", models.ErrNotFound
+}
+
+func Test_ForeignConflict(t *testing.T) {
+	s := Server{
+		config: &TestCfg,
+		storage: foreignStorage{dedupStorage{NewTestStorageWithRecords(models.Record{
+			ShortURL:    "foreign123",
+			OriginalURL: "https://practicum.yandex.ru/",
+		})}},
+	}
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		target  string
+		body    string
+	}{
+		{name: "text", handler: s.PostShortenLink, target: "/", body: "https://practicum.yandex.ru/"},
+		{name: "json", handler: s.PostAPIShortenLink, target: "/api/shorten", body: `{"url": "https://practicum.yandex.ru/"}`},
+		{name: "v2", handler: s.PostAPIShortenLinkV2, target: "/api/v2/shorten", body: `{"url": "https://practicum.yandex.ru/"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tt.target, strings.NewReader(tt.body))
+			req = withSession(req, "test")
+			w := httptest.NewRecorder()
+
+			tt.handler(w, req)
+			result := w.Result()
+			defer result.Body.Close()
+
+			assert.Equal(t, http.StatusConflict, result.StatusCode)
+			resultBody, err := io.ReadAll(result.Body)
+			require.NoError(t, err)
+			assert.Contains(t, string(resultBody), foreignConflictMessage)
+			assert.NotContains(t, string(resultBody), "foreign123")
+		})
+	}
+}
+
+// Test_StorageModeDedup checks that memory and file storages keep taking
+// repeated urls by default and dedup them like the database once a scope
+// is configured.
+func Test_StorageModeDedup(t *testing.T) {
+	tests := []struct {
+		name         string
+		file         bool
+		scope        string
+		expectedCode int
+	}{
+		{name: "memory, default scope", scope: "", expectedCode: http.StatusCreated},
+		{name: "memory, global scope", scope: models.DedupScopeGlobal, expectedCode: http.StatusConflict},
+		{name: "memory, user scope", scope: models.DedupScopeUser, expectedCode: http.StatusConflict},
+		{name: "memory, no scope", scope: models.DedupScopeNone, expectedCode: http.StatusCreated},
+		{name: "file, default scope", file: true, scope: "", expectedCode: http.StatusCreated},
+		{name: "file, global scope", file: true, scope: models.DedupScopeGlobal, expectedCode: http.StatusConflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var filename string
+			mode := initstorage.MemoryMode
+			if tt.file {
+				filename = filepath.Join(t.TempDir(), "storage.json")
+				mode = initstorage.FileMode
+			}
+			storage, err := initstorage.NewStorage(filename, "", tt.scope)
+			require.NoError(t, err)
+			require.Equal(t, mode, storage.GetMode())
+			s := Server{config: &TestCfg, storage: storage}
+			session, err := createNewCookie(storage)
+			require.NoError(t, err)
+			otherSession, err := createNewCookie(storage)
+			require.NoError(t, err)
+
+			post := func(session string) (int, models.ResponseShortenLink) {
+				req := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(`{ "url": "https://practicum.yandex.ru/" }`))
+				req = withSession(req, session)
+				w := httptest.NewRecorder()
+				s.PostAPIShortenLink(w, req)
+
+				var resp models.ResponseShortenLink
+				_ = json.Unmarshal(w.Body.Bytes(), &resp)
+				return w.Code, resp
+			}
+
+			code, first := post(session)
+			require.Equal(t, http.StatusCreated, code)
+			code, again := post(session)
+			assert.Equal(t, tt.expectedCode, code)
+			if tt.expectedCode == http.StatusConflict {
+				assert.Equal(t, first.Result, again.Result)
+			} else {
+				assert.NotEqual(t, first.Result, again.Result)
+			}
+
+			// another user only gets a conflict without the link in the
+			// global scope
+			code, _ = post(otherSession)
+			if tt.scope == models.DedupScopeGlobal {
+				assert.Equal(t, http.StatusConflict, code)
+			} else {
+				assert.Equal(t, http.StatusCreated, code)
+			}
+		})
+	}
+}
+
+func Test_NormalizedDedup(t *testing.T) {
+	cfg := TestCfg
+	cfg.NormalizeSortQuery = true
+	storage, err := cachestorage.NewCacheStor(0, models.DedupScopeUser)
+	require.NoError(t, err)
+	s := Server{config: &cfg, storage: storage}
+	session, err := createNewCookie(storage)
+	require.NoError(t, err)
+
+	post := func(url string) (int, string) {
+		req := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(`{ "url": "`+url+`" }`))
+		req = withSession(req, session)
+		w := httptest.NewRecorder()
+		s.PostAPIShortenLink(w, req)
+
+		var resp models.ResponseShortenLink
+		_ = json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp.Result
+	}
+
+	code, first := post("https://practicum.yandex.ru/learn?b=2&flag&a=1")
+	require.Equal(t, http.StatusCreated, code)
+
+	for _, form := range []string{
+		"HTTPS://Practicum.Yandex.RU:443/learn?a=1&b=2&flag",
+		"https://practicum.yandex.ru./learn?flag&a=1&b=2",
+	} {
+		code, result := post(form)
+		assert.Equal(t, http.StatusConflict, code, form)
+		assert.Equal(t, first, result, form)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("https://practicum.yandex.ru/learn?a=1&flag&b=2"))
+	req = withSession(req, session)
+	w := httptest.NewRecorder()
+	s.PostShortenLink(w, req)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Equal(t, first, w.Body.String())
+
+	// a key with an empty value is another destination
+	code, result := post("https://practicum.yandex.ru/learn?a=1&b=2&flag=")
+	assert.Equal(t, http.StatusCreated, code)
+	assert.NotEqual(t, first, result)
+}
+
+func Test_GRPCGet(t *testing.T) {
+	future := time.Now().Add(time.Hour)
+	targeted := models.Record{
+		ShortURL:    "targeted12",
+		OriginalURL: "https://practicum.yandex.ru/",
+		UserID:      1,
+		Rules:       models.RedirectRules{{Language: "ru", URL: "https://practicum.yandex.ru/ru"}},
+		Variants:    models.Variants{{URL: "https://practicum.yandex.ru/a", Weight: 1}},
+	}
+	upcoming := models.Record{ShortURL: "upcoming12", OriginalURL: "https://practicum.yandex.ru/launch", ActiveFrom: &future}
+
+	memory, err := cachestorage.NewCacheStor(initstorage.MemoryMode, models.DedupScopeNone)
+	require.NoError(t, err)
+	owner, err := createNewCookie(memory)
+	require.NoError(t, err)
+	_, err = createNewCookie(memory)
+	require.NoError(t, err)
+	require.NoError(t, memory.Add(targeted, owner))
+	require.NoError(t, memory.Add(upcoming, owner))
+
+	storages := map[string]repository{
+		"database": &usersStorage{TestStorage: NewTestStorageWithRecords(targeted, upcoming), users: 2},
+		"memory":   memory,
+	}
+
+	for name, storage := range storages {
+		t.Run(name, func(t *testing.T) {
+			s := Server{config: &TestCfg, storage: storage}
+
+			listener := bufconn.Listen(1 << 20)
+			srv := NewGRPCServer(&s)
+			go func() {
+				_ = srv.Serve(listener)
+			}()
+			defer srv.Stop()
+
+			conn, err := grpc.DialContext(context.Background(), "bufnet",
+				grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+					return listener.DialContext(ctx)
+				}),
+				grpc.WithTransportCredentials(insecure.NewCredentials()))
+			require.NoError(t, err)
+			defer conn.Close()
+			client := pb.NewShortenerClient(conn)
+
+			asUser := func(userID int) context.Context {
+				token, err := BuildJWTString(userID)
+				require.NoError(t, err)
+				return metadata.AppendToOutgoingContext(context.Background(), TokenMetadata, token)
+			}
+
+			got, err := client.Get(asUser(1), &pb.GetRequest{Id: "targeted12"})
+			require.NoError(t, err)
+			assert.Len(t, got.Link.Rules, 1)
+			assert.Len(t, got.Link.Variants, 1)
+
+			got, err = client.Get(asUser(2), &pb.GetRequest{Id: "targeted12"})
+			require.NoError(t, err)
+			assert.Equal(t, "https://practicum.yandex.ru/", got.Link.OriginalUrl)
+			assert.Empty(t, got.Link.Rules)
+			assert.Empty(t, got.Link.Variants)
+
+			got, err = client.Get(context.Background(), &pb.GetRequest{Id: "upcoming12"})
+			require.NoError(t, err)
+			assert.Empty(t, got.Link.OriginalUrl)
+			assert.NotNil(t, got.Link.ActiveFrom)
+		})
+	}
+}
+
+func Test_APIV2(t *testing.T) {
+	s := Server{
+		config:          &TestCfg,
+		storage:         dedupStorage{NewTestStorage()},
+		DeletedURLsChan: make(chan models.DeletedURLMessage, 1),
+	}
+	cookie := &http.Cookie{Name: "shortener_session", Value: "test"}
+
+	call := func(handler http.HandlerFunc, method, target, body string) (int, models.ResponseEnvelope, json.RawMessage) {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req = withSession(req, cookie.Value)
+		if strings.HasPrefix(target, "/api/v2/user/urls/") {
+			rctx := chi.NewRouteContext()
+			rctx.URLParams.Add("id", strings.TrimPrefix(target, "/api/v2/user/urls/"))
+			req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+
+		result := w.Result()
+		defer result.Body.Close()
+		assert.Equal(t, "application/json", result.Header.Get("Content-Type"))
+
+		var raw struct {
+			Data json.RawMessage `json:"data"`
+		}
+		var envelope models.ResponseEnvelope
+		data, err := io.ReadAll(result.Body)
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(data, &envelope))
+		require.NoError(t, json.Unmarshal(data, &raw))
+		return result.StatusCode, envelope, raw.Data
+	}
+
+	status, envelope, data := call(s.PostAPIShortenLinkV2, http.MethodPost, "/api/v2/shorten",
+		`{"url": "https://practicum.yandex.ru/v2"}`)
+	require.Equal(t, http.StatusCreated, status)
+	assert.Nil(t, envelope.Error)
+	require.NotNil(t, envelope.Meta.Created)
+	assert.True(t, *envelope.Meta.Created)
+	var link models.ResponseUserURL
+	require.NoError(t, json.Unmarshal(data, &link))
+	assert.Equal(t, "https://practicum.yandex.ru/v2", link.OriginalURL)
+
+	status, envelope, data = call(s.PostAPIShortenLinkV2, http.MethodPost, "/api/v2/shorten",
+		`{"url": "https://practicum.yandex.ru/v2"}`)
+	assert.Equal(t, http.StatusOK, status, "repeated creation isn't a conflict")
+	require.NotNil(t, envelope.Meta.Created)
+	assert.False(t, *envelope.Meta.Created)
+	var existing models.ResponseUserURL
+	require.NoError(t, json.Unmarshal(data, &existing))
+	assert.Equal(t, link.ShortURL, existing.ShortURL)
+
+	status, envelope, data = call(s.PostAPIShortenLinkV2, http.MethodPost, "/api/v2/shorten", `{"url": "ftp://x"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+	require.NotNil(t, envelope.Error)
+	assert.Equal(t, "null", string(data))
+
+	status, envelope, _ = call(s.PostAPIShortenLinkV2, http.MethodPost, "/api/v2/shorten", `{`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	require.NotNil(t, envelope.Error)
+	assert.Equal(t, validation.CodeInvalidJSON, envelope.Error.Code)
+
+	status, envelope, _ = call(s.PostAPIShortenBatchV2, http.MethodPost, "/api/v2/shorten/batch",
+		`[{"correlation_id": "1", "original_url": "https://practicum.yandex.ru/batch"}]`)
+	assert.Equal(t, http.StatusCreated, status)
+	assert.Nil(t, envelope.Error)
+
+	status, envelope, data = call(s.PostAPIShortenBatchV2, http.MethodPost, "/api/v2/shorten/batch",
+		`[{"correlation_id": "1", "original_url": "https://practicum.yandex.ru/other"},
+		{"correlation_id": "2", "original_url": "https://practicum.yandex.ru/batch"}]`)
+	assert.Equal(t, http.StatusConflict, status)
+	require.NotNil(t, envelope.Error)
+	assert.Equal(t, CodeConflict, envelope.Error.Code)
+	assert.Nil(t, envelope.Meta.Created)
+	assert.Equal(t, "null", string(data))
+
+	status, envelope, data = call(s.GetUserURLsV2, http.MethodGet, "/api/v2/user/urls?limit=1", "")
+	assert.Equal(t, http.StatusOK, status)
+	require.NotNil(t, envelope.Meta.Total)
+	assert.Equal(t, 2, *envelope.Meta.Total, "the conflicting batch isn't stored")
+	var links models.ResponseUserURLs
+	require.NoError(t, json.Unmarshal(data, &links))
+	assert.Len(t, links, 1)
+
+	id := link.ShortURL[strings.LastIndex(link.ShortURL, "/")+1:]
+	status, _, data = call(s.EditUserURLV2, http.MethodPatch, "/api/v2/user/urls/"+id, `{"title": "v2"}`)
+	assert.Equal(t, http.StatusOK, status)
+	require.NoError(t, json.Unmarshal(data, &link))
+	assert.Equal(t, "v2", link.Title)
+
+	status, envelope, _ = call(s.EditUserURLV2, http.MethodPatch, "/api/v2/user/urls/unknown", `{"title": "v2"}`)
+	assert.Equal(t, http.StatusNotFound, status)
+	require.NotNil(t, envelope.Error)
+	assert.Equal(t, CodeNotFound, envelope.Error.Code)
+
+	status, envelope, _ = call(s.EditUserURLV2, http.MethodPatch, "/api/v2/user/urls/"+id+"?domain=evil.com",
+		`{"title": "v2"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+	require.NotNil(t, envelope.Error)
+	assert.Equal(t, validation.CodeDomain, envelope.Error.Code)
+
+	status, envelope, _ = call(s.DeleteUserURLsV2, http.MethodDelete, "/api/v2/user/urls", `["`+id+`"]`)
+	assert.Equal(t, http.StatusAccepted, status)
+	assert.Nil(t, envelope.Error)
+	assert.Equal(t, []string{id}, (<-s.DeletedURLsChan).ShortURLs)
+
+	status, envelope, _ = call(s.PingV2, http.MethodGet, "/api/v2/ping", "")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	require.NotNil(t, envelope.Error)
+}
+
+// usersStorage hands out a new user to every new session, as the database does.
+type usersStorage struct {
+	*TestStorage
+	users int
+}
+
+func (s *usersStorage) GetMode() int {
+	return initstorage.DBMode
+}
+
+func (s *usersStorage) CreateUser(_ context.Context) (*models.User, error) {
+	s.users++
+	return &models.User{UserID: s.users}, nil
+}
+
+func Test_IdempotencyAnonymousClients(t *testing.T) {
+	s := Server{
+		config:      &TestCfg,
+		storage:     &usersStorage{TestStorage: NewTestStorage()},
+		idempotency: idempotency.New(time.Hour),
+	}
+	handler := s.CookieMiddleware(s.IdempotencyMiddleware(s.PostAPIShortenLink))
+
+	post := func(cookie *http.Cookie, body string) *http.Response {
+		req := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(body))
+		req.Header.Set(idempotency.Header, "1")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w.Result()
+	}
+
+	first := post(nil, `{"url": "https://practicum.yandex.ru"}`)
+	defer first.Body.Close()
+	require.Equal(t, http.StatusCreated, first.StatusCode)
+	require.Len(t, first.Cookies(), 1)
+	firstSession := first.Cookies()[0]
+	firstBody, err := io.ReadAll(first.Body)
+	require.NoError(t, err)
+
+	// the client didn't get the first response and retries without a cookie
+	retry := post(nil, `{"url": "https://practicum.yandex.ru"}`)
+	defer retry.Body.Close()
+	assert.Equal(t, http.StatusCreated, retry.StatusCode)
+	assert.Equal(t, "true", retry.Header.Get(idempotency.ReplayedHeader))
+	require.Len(t, retry.Cookies(), 1)
+	assert.Equal(t, firstSession.Value, retry.Cookies()[0].Value, "the retry takes the session of the link")
+	retryBody, err := io.ReadAll(retry.Body)
+	require.NoError(t, err)
+	assert.Equal(t, string(firstBody), string(retryBody))
+
+	withCookie := post(firstSession, `{"url": "https://practicum.yandex.ru"}`)
+	defer withCookie.Body.Close()
+	assert.Equal(t, "true", withCookie.Header.Get(idempotency.ReplayedHeader))
+	assert.Empty(t, withCookie.Cookies())
+
+	other := post(nil, `{"url": "https://practicum.yandex.ru/other"}`)
+	defer other.Body.Close()
+	assert.Equal(t, http.StatusCreated, other.StatusCode)
+	assert.Empty(t, other.Header.Get(idempotency.ReplayedHeader), "another client has its own keys")
+	require.Len(t, other.Cookies(), 1)
+	assert.NotEqual(t, firstSession.Value, other.Cookies()[0].Value)
+
+	assert.Len(t, s.storage.(*usersStorage).links, 2)
+}
+
+func Test_ServerClose(t *testing.T) {
+	release := make(chan struct{})
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer endpoint.Close()
+	defer close(release)
+
+	storage, err := cachestorage.NewCacheStor(0, models.DedupScopeNone)
+	require.NoError(t, err)
+	s := Server{
+		config:  &TestCfg,
+		storage: storage,
+		webhooks: webhook.NewDispatcher(storage, webhook.Options{
+			Workers:      1,
+			Timeout:      5 * time.Second,
+			AllowPrivate: true,
+		}),
+	}
+
+	timeout := closeTimeout
+	closeTimeout = 100 * time.Millisecond
+	defer func() { closeTimeout = timeout }()
+
+	require.True(t, s.webhooks.Send(models.Webhook{ID: "hook", URL: endpoint.URL}, models.WebhookEvent{ID: "event", Type: models.EventLinkCreated}))
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	s.Close()
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+// Test_SessionFromMiddleware checks that handlers use the session
+// CookieMiddleware settled on instead of the cookie the request came with.
+func Test_SessionFromMiddleware(t *testing.T) {
+	storage, err := cachestorage.NewCacheStor(0, models.DedupScopeNone)
+	require.NoError(t, err)
+	s := Server{config: &TestCfg, storage: storage}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(`{ "url": "https://practicum.yandex.ru/" }`))
+	req.AddCookie(&http.Cookie{Name: "shortener_session", Value: "forged"})
+	w := httptest.NewRecorder()
+	s.CookieMiddleware(s.PostAPIShortenLink)(w, req)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	var session string
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == "shortener_session" {
+			session = cookie.Value
+		}
+	}
+	require.NotEmpty(t, session)
+	assert.NotEqual(t, "forged", session)
+
+	records, _, err := storage.GetUserRecords(context.Background(), session, models.ListQuery{})
+	require.NoError(t, err)
+	assert.Len(t, records, 1)
+
+	// without the middleware the cookie alone is no session
+	req = httptest.NewRequest(http.MethodGet, "/api/user/urls", nil)
+	req.AddCookie(&http.Cookie{Name: "shortener_session", Value: session})
+	w = httptest.NewRecorder()
+	s.GetUserUrlsAPI(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
@@ -4,50 +4,94 @@ import (
 	"context"
 	"errors"
 	"github.com/DavidGQK/go-link-shortener/internal/config"
+	"github.com/DavidGQK/go-link-shortener/internal/logger"
 	"github.com/DavidGQK/go-link-shortener/internal/models"
+	"github.com/DavidGQK/go-link-shortener/internal/storage/cachestorage"
+	"net/http"
+	"os"
+	"sort"
+	"testing"
 )
 
+func TestMain(m *testing.M) {
+	if err := logger.Initialize("fatal"); err != nil {
+		panic(err)
+	}
+
+	os.Exit(m.Run())
+}
+
+// withSession puts the session on the request the way CookieMiddleware
+// does for the handlers it wraps.
+func withSession(r *http.Request, session string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), sessionContextKey{}, session))
+}
+
 var TestCfg = config.Config{
 	ServerURL:    "localhost:8080",
 	ShortURLBase: "http://localhost:8080/",
 }
 
 type TestStorage struct {
-	links map[string]string
+	links    map[string]models.Record
+	webhooks *cachestorage.CacheStor
 }
 
 func NewTestStorage() *TestStorage {
+	webhooks, _ := cachestorage.NewCacheStor(0, "")
 	return &TestStorage{
-		links: make(map[string]string),
+		links:    make(map[string]models.Record),
+		webhooks: webhooks,
 	}
 }
 
+func NewTestStorageWithRecords(records ...models.Record) *TestStorage {
+	storage := NewTestStorage()
+	for _, rec := range records {
+		storage.links[rec.ShortURL] = rec
+	}
+	return storage
+}
+
 func (s *TestStorage) Restore() error {
 	return nil
 }
 
-func (s *TestStorage) Add(key, value, _ string) error {
-	s.links[key] = value
+func (s *TestStorage) Add(rec models.Record, _ string) error {
+	s.links[rec.ShortURL] = rec
 	return nil
 }
 
-func (s *TestStorage) AddBatch(_ context.Context, _ []models.Record) error {
+func (s *TestStorage) AddBatch(_ context.Context, _ []models.Record, _ string) error {
 	return nil
 }
 
-func (s *TestStorage) Get(key string) (string, error) {
+func (s *TestStorage) Get(key string) (models.Record, error) {
 	value, found := s.links[key]
 	if !found {
-		return "", errors.New("key not found")
+		return value, errors.New("key not found")
+	}
+	if value.DeletedFlag {
+		return value, models.ErrDeleted
 	}
 	return value, nil
 }
 
+// GetUserRecord treats every link as the session's own, tests of other
+// users' links use the memory storage.
+func (s *TestStorage) GetUserRecord(_ context.Context, _, key string) (models.Record, error) {
+	rec, err := s.Get(key)
+	if err != nil && err != models.ErrDeleted {
+		return rec, models.ErrNotFound
+	}
+	return rec, err
+}
+
 func (s *TestStorage) GetMode() int {
 	return 0
 }
 
-func (s *TestStorage) GetByOriginURL(_ string) (string, error) {
+func (s *TestStorage) GetByOriginURL(_, _ string) (string, error) {
 	return "", nil
 }
 
@@ -55,8 +99,45 @@ func (s *TestStorage) HealthCheck() error {
 	return nil
 }
 
-func (s *TestStorage) GetUserRecords(_ context.Context, _ string) ([]models.Record, error) {
-	return nil, nil
+// GetUserRecords lists the links that aren't deleted by key and only
+// applies the limit, listing tests that filter use pagedStorage.
+func (s *TestStorage) GetUserRecords(_ context.Context, _ string, query models.ListQuery) ([]models.Record, int, error) {
+	records := make([]models.Record, 0, len(s.links))
+	for _, rec := range s.links {
+		if !rec.DeletedFlag {
+			records = append(records, rec)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].ShortURL < records[j].ShortURL })
+
+	total := len(records)
+	if query.Limit > 0 && len(records) > query.Limit {
+		records = records[:query.Limit]
+	}
+	return records, total, nil
+}
+
+type listPage struct {
+	records []models.Record
+	total   int
+}
+
+// pagedStorage serves the given pages in turn and keeps the queries it got.
+type pagedStorage struct {
+	*TestStorage
+	pages   []listPage
+	queries []models.ListQuery
+}
+
+func (s *pagedStorage) GetUserRecords(_ context.Context, _ string, query models.ListQuery) ([]models.Record, int, error) {
+	s.queries = append(s.queries, query)
+	if len(s.pages) == 0 {
+		return nil, 0, nil
+	}
+
+	page := s.pages[0]
+	s.pages = s.pages[1:]
+	return page.records, page.total, nil
 }
 
 func (s *TestStorage) FindUserByID(_ context.Context, _ int) (*models.User, error) {
@@ -64,7 +145,7 @@ func (s *TestStorage) FindUserByID(_ context.Context, _ int) (*models.User, erro
 }
 
 func (s *TestStorage) CreateUser(_ context.Context) (*models.User, error) {
-	return nil, nil
+	return &models.User{UserID: 1}, nil
 }
 
 func (s *TestStorage) UpdateUser(_ context.Context, _ int, _ string) error {
@@ -74,3 +155,117 @@ func (s *TestStorage) UpdateUser(_ context.Context, _ int, _ string) error {
 func (s *TestStorage) DeleteUserURLs(_ context.Context, _ models.DeletedURLMessage) error {
 	return nil
 }
+
+func (s *TestStorage) GetAllRecords(_ context.Context) ([]models.Record, error) {
+	return nil, nil
+}
+
+func (s *TestStorage) DeleteBatchRecords(_ context.Context, _ []models.Record) error {
+	return nil
+}
+
+func (s *TestStorage) RegisterClick(_ context.Context, key string) (int, error) {
+	rec, found := s.links[key]
+	if !found {
+		return 0, errors.New("key not found")
+	}
+	if rec.DeletedFlag {
+		return 0, models.ErrDeleted
+	}
+	rec.Clicks++
+	rec.DeletedFlag = rec.MaxClicks > 0 && rec.Clicks >= rec.MaxClicks
+	s.links[key] = rec
+	return rec.Clicks, nil
+}
+
+func (s *TestStorage) UpdateRecord(_ context.Context, rec models.Record, _ string) error {
+	stored, found := s.links[rec.ShortURL]
+	if !found || stored.DeletedFlag {
+		return models.ErrNotFound
+	}
+	s.links[rec.ShortURL] = rec
+	return nil
+}
+
+func (s *TestStorage) RegisterVariantClick(_ context.Context, key string, variant int) error {
+	rec, found := s.links[key]
+	if !found || variant >= len(rec.Variants) {
+		return errors.New("variant not found")
+	}
+	rec.Variants[variant].Clicks++
+	return nil
+}
+
+func (s *TestStorage) GetUserLabels(_ context.Context, _, kind string) ([]models.LabelCount, error) {
+	counts := make(map[string]int)
+	for _, rec := range s.links {
+		if kind == models.LabelFolder {
+			if rec.Folder != "" {
+				counts[rec.Folder]++
+			}
+			continue
+		}
+		for _, tag := range rec.Tags {
+			counts[tag]++
+		}
+	}
+
+	labels := make([]models.LabelCount, 0, len(counts))
+	for name, count := range counts {
+		labels = append(labels, models.LabelCount{Name: name, Count: count})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+	return labels, nil
+}
+
+func (s *TestStorage) RenameUserLabel(_ context.Context, _, _, _, _ string) error {
+	return nil
+}
+
+func (s *TestStorage) DeleteUserLabel(_ context.Context, _, _, _ string) error {
+	return nil
+}
+
+func (s *TestStorage) UpdateMetadata(_ context.Context, key string, meta models.LinkMetadata) error {
+	rec, found := s.links[key]
+	if !found {
+		return models.ErrNotFound
+	}
+	if rec.Title == "" {
+		rec.Title = meta.Title
+	}
+	if rec.Description == "" {
+		rec.Description = meta.Description
+	}
+	rec.ImageURL, rec.FaviconURL = meta.ImageURL, meta.FaviconURL
+	s.links[key] = rec
+	return nil
+}
+
+func (s *TestStorage) CreateWebhook(ctx context.Context, cookie string, hook models.Webhook) error {
+	return s.webhooks.CreateWebhook(ctx, cookie, hook)
+}
+
+func (s *TestStorage) GetUserWebhooks(ctx context.Context, cookie string) ([]models.Webhook, error) {
+	return s.webhooks.GetUserWebhooks(ctx, cookie)
+}
+
+func (s *TestStorage) DeleteWebhook(ctx context.Context, cookie, id string) error {
+	return s.webhooks.DeleteWebhook(ctx, cookie, id)
+}
+
+func (s *TestStorage) GetLinkWebhooks(ctx context.Context, key string) ([]models.Webhook, error) {
+	return s.webhooks.GetLinkWebhooks(ctx, key)
+}
+
+func (s *TestStorage) AddWebhookDelivery(ctx context.Context, delivery models.WebhookDelivery) error {
+	return s.webhooks.AddWebhookDelivery(ctx, delivery)
+}
+
+func (s *TestStorage) AddWebhookDeadLetter(ctx context.Context, delivery models.WebhookDelivery) error {
+	return s.webhooks.AddWebhookDeadLetter(ctx, delivery)
+}
+
+func (s *TestStorage) GetWebhookDeliveries(ctx context.Context, cookie string, query models.DeliveryQuery) ([]models.WebhookDelivery, error) {
+	return s.webhooks.GetWebhookDeliveries(ctx, cookie, query)
+}
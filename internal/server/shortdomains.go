@@ -0,0 +1,134 @@
+package server
+
+import (
+	"fmt"
+	"github.com/DavidGQK/go-link-shortener/internal/validation"
+	"github.com/go-chi/chi/v5"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// parseShortDomains maps the hosts of additional short link domains to
+// their base urls. The default domain of ShortURLBase is left out, links
+// on it are stored under their bare id.
+func parseShortDomains(list, shortURLBase string) map[string]string {
+	domains := make(map[string]string)
+	defaultHost := baseHost(shortURLBase)
+
+	for _, base := range strings.Split(list, ",") {
+		base = strings.TrimSuffix(strings.TrimSpace(base), "/")
+		host := baseHost(base)
+		if host == "" || host == defaultHost {
+			continue
+		}
+		domains[host] = base
+	}
+
+	return domains
+}
+
+func baseHost(base string) string {
+	u, err := url.Parse(base)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// linkKey is the storage key of a short link: the bare id on the default
+// domain and domain/id on the others, so the same id can live on each.
+func linkKey(domain, id string) string {
+	if domain == "" {
+		return id
+	}
+	return domain + "/" + id
+}
+
+func splitLinkKey(key string) (string, string) {
+	if i := strings.LastIndex(key, "/"); i >= 0 {
+		return key[:i], key[i+1:]
+	}
+	return "", key
+}
+
+func (s *Server) shortURL(key string) string {
+	domain, id := splitLinkKey(key)
+	if base, found := s.shortDomains[domain]; found {
+		return fmt.Sprintf("%s/%s", base, id)
+	}
+	return fmt.Sprintf("%s/%s", s.config.ShortURLBase, id)
+}
+
+// linkDomain checks the domain picked for a new link.
+func (s *Server) linkDomain(domain string) (string, error) {
+	domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+	if domain == "" || domain == baseHost(s.config.ShortURLBase) {
+		return "", nil
+	}
+
+	if _, found := s.shortDomains[domain]; !found {
+		return "", &validation.Error{
+			Code:    validation.CodeDomain,
+			Message: fmt.Sprintf("domain %q is not configured", domain),
+		}
+	}
+
+	return domain, nil
+}
+
+// editedLinkKey is the key of the link an edit request names. The ?domain=
+// parameter is checked as for a new link, so the key matches the stored one.
+func (s *Server) editedLinkKey(r *http.Request) (string, error) {
+	domain, err := s.linkDomain(r.URL.Query().Get("domain"))
+	if err != nil {
+		return "", err
+	}
+	return linkKey(domain, chi.URLParam(r, "id")), nil
+}
+
+// deletedLinkKeys are the keys of the links a delete request names. Bare
+// ids are taken on the domain given, checked as for a new link, and full
+// short urls on the domain of their host.
+func (s *Server) deletedLinkKeys(domain string, ids []string) ([]string, error) {
+	domain, err := s.linkDomain(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if !strings.Contains(id, "://") {
+			keys = append(keys, linkKey(domain, id))
+			continue
+		}
+
+		u, err := url.Parse(id)
+		if err != nil {
+			return nil, &validation.Error{Code: validation.CodeInvalidURL, Message: fmt.Sprintf("short url %q can't be parsed", id)}
+		}
+		urlDomain, err := s.linkDomain(u.Hostname())
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, linkKey(urlDomain, strings.TrimPrefix(u.Path, "/")))
+	}
+
+	return keys, nil
+}
+
+// requestDomain tells which short link domain a request came to.
+// Unknown hosts are served as the default domain.
+func (s *Server) requestDomain(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+
+	if _, found := s.shortDomains[host]; found {
+		return host
+	}
+	return ""
+}
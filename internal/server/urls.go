@@ -0,0 +1,95 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/DavidGQK/go-link-shortener/internal/models"
+	"github.com/DavidGQK/go-link-shortener/internal/urlnorm"
+	"github.com/DavidGQK/go-link-shortener/internal/validation"
+	"net/http"
+)
+
+func (s *Server) normalizeURL(rawURL string) (string, error) {
+	return urlnorm.Normalize(rawURL, urlnorm.Options{
+		SortQuery:     s.config.NormalizeSortQuery,
+		StripFragment: s.config.NormalizeStripFragment,
+	})
+}
+
+func (s *Server) validationPolicy() validation.Policy {
+	bases := []string{s.config.ShortURLBase}
+	for _, base := range s.shortDomains {
+		bases = append(bases, base)
+	}
+
+	return validation.NewPolicy(s.config.AllowedSchemes, s.config.MaxURLLength,
+		s.config.AllowPrivateHosts, bases...)
+}
+
+func (s *Server) prepareURL(rawURL string) (string, error) {
+	longURLStr, err := s.normalizeURL(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	if err := s.validationPolicy().Validate(longURLStr); err != nil {
+		return "", err
+	}
+
+	if err := s.checkDomain(longURLStr); err != nil {
+		return "", err
+	}
+
+	return longURLStr, nil
+}
+
+// utmURL adds the UTM parameters to a prepared url and validates the
+// result again, the parameters can push it over the length limit.
+func (s *Server) utmURL(longURLStr string, utm *models.UTMParams) (string, error) {
+	if utm == nil {
+		return longURLStr, nil
+	}
+
+	longURLStr = withUTM(longURLStr, utm)
+	if err := s.validationPolicy().Validate(longURLStr); err != nil {
+		return "", err
+	}
+
+	return longURLStr, nil
+}
+
+func writeURLError(w http.ResponseWriter, err error, correlationID string) {
+	var validationErr *validation.Error
+	if !errors.As(err, &validationErr) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	writeError(w, http.StatusUnprocessableEntity, validationErr.Code, validationErr.Message, correlationID)
+}
+
+// WriteValidationError writes a request validation error in the v1 format.
+// Like the v1 handlers it answers bodies that can't be decoded with a plain
+// 400 and invalid values with the json error of writeURLError.
+func WriteValidationError(w http.ResponseWriter, status int, code, message string) {
+	if status == http.StatusBadRequest {
+		http.Error(w, message, status)
+		return
+	}
+
+	writeError(w, status, code, message, "")
+}
+
+func writeError(w http.ResponseWriter, status int, code, message, correlationID string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	encoder := json.NewEncoder(w)
+	_ = encoder.Encode(models.ResponseError{
+		Error: models.ErrorDetails{
+			Code:          code,
+			Message:       message,
+			CorrelationID: correlationID,
+		},
+	})
+}
@@ -0,0 +1,351 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/DavidGQK/go-link-shortener/internal/logger"
+	"github.com/DavidGQK/go-link-shortener/internal/models"
+	"github.com/DavidGQK/go-link-shortener/internal/storage/initstorage"
+	"github.com/DavidGQK/go-link-shortener/internal/validation"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	CodeUnauthorized     = "unauthorized"
+	CodeNotFound         = "not_found"
+	CodeGone             = "gone"
+	CodeConflict         = "conflict"
+	CodeInternal         = "internal"
+	CodeUnavailable      = "unavailable"
+	CodeMethodNotAllowed = "method_not_allowed"
+)
+
+// v2Prefix marks the routes answering with models.ResponseEnvelope.
+const v2Prefix = "/api/v2/"
+
+func isV2(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, v2Prefix)
+}
+
+func writeEnvelope(w http.ResponseWriter, status int, data interface{}, meta models.ResponseMeta) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(models.ResponseEnvelope{Data: data, Meta: meta}); err != nil {
+		logger.Log.Error(err)
+	}
+}
+
+// WriteEnvelopeError writes an error in the /api/v2 format.
+func WriteEnvelopeError(w http.ResponseWriter, status int, code, message string) {
+	writeEnvelopeError(w, status, models.ErrorDetails{Code: code, Message: message})
+}
+
+func writeEnvelopeError(w http.ResponseWriter, status int, details models.ErrorDetails) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(models.ResponseEnvelope{Error: &details}); err != nil {
+		logger.Log.Error(err)
+	}
+}
+
+func writeEnvelopeURLError(w http.ResponseWriter, err error, correlationID string) {
+	var validationErr *validation.Error
+	if !errors.As(err, &validationErr) {
+		writeEnvelopeError(w, http.StatusBadRequest, models.ErrorDetails{
+			Code:          validation.CodeInvalidRequest,
+			Message:       "Invalid request",
+			CorrelationID: correlationID,
+		})
+		return
+	}
+
+	writeEnvelopeError(w, http.StatusUnprocessableEntity, models.ErrorDetails{
+		Code:          validationErr.Code,
+		Message:       validationErr.Message,
+		CorrelationID: correlationID,
+	})
+}
+
+func writeEnvelopeJSONError(w http.ResponseWriter) {
+	WriteEnvelopeError(w, http.StatusBadRequest, validation.CodeInvalidJSON, "Request body isn't valid JSON")
+}
+
+func writeEnvelopeInternalError(w http.ResponseWriter, err error) {
+	logger.Log.Error(err)
+	WriteEnvelopeError(w, http.StatusInternalServerError, CodeInternal, "Internal Backend Error")
+}
+
+func sessionCookie(w http.ResponseWriter, r *http.Request) (string, bool) {
+	session := requestSession(r)
+	if session == "" {
+		WriteEnvelopeError(w, http.StatusUnauthorized, CodeUnauthorized, "Invalid session")
+		return "", false
+	}
+	return session, true
+}
+
+func created(value bool) models.ResponseMeta {
+	return models.ResponseMeta{Created: &value}
+}
+
+// PostAPIShortenLinkV2 creates a link, or returns the link the user
+// already has for the url with 200 instead of a conflict.
+func (s *Server) PostAPIShortenLinkV2(w http.ResponseWriter, r *http.Request) {
+	var body models.RequestShortenLink
+
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&body); err != nil {
+		writeEnvelopeJSONError(w)
+		return
+	}
+
+	cookie, ok := sessionCookie(w, r)
+	if !ok {
+		return
+	}
+
+	longURLStr := strings.Replace(body.URL, " ", "", -1)
+	if longURLStr == "" {
+		WriteEnvelopeError(w, http.StatusUnprocessableEntity, validation.CodeInvalidURL, "URL is empty")
+		return
+	}
+
+	longURLStr, err := s.prepareURL(longURLStr)
+	if err != nil {
+		writeEnvelopeURLError(w, err, "")
+		return
+	}
+
+	id := makeRandStringBytes(shortenedURLLength)
+	rec, err := s.newRecord(id, longURLStr, body.LinkOptions)
+	if err != nil {
+		writeEnvelopeURLError(w, err, "")
+		return
+	}
+
+	err = s.storage.Add(rec, cookie)
+	if err == models.ErrConflict {
+		key, err := s.storage.GetByOriginURL(rec.OriginalURL, cookie)
+		if err == models.ErrNotFound {
+			WriteEnvelopeError(w, http.StatusConflict, CodeConflict, foreignConflictMessage)
+			return
+		}
+		if err != nil {
+			writeEnvelopeInternalError(w, err)
+			return
+		}
+
+		existing, err := s.storage.Get(key)
+		if err != nil {
+			existing = models.Record{ShortURL: key, OriginalURL: rec.OriginalURL}
+		}
+		writeEnvelope(w, http.StatusOK, s.userURLResponse(existing), created(false))
+		return
+	}
+	if err != nil {
+		writeEnvelopeInternalError(w, err)
+		return
+	}
+
+	s.fetchMetadata(rec)
+	s.emitEvent(models.EventLinkCreated, rec)
+	writeEnvelope(w, http.StatusCreated, s.userURLResponse(rec), created(true))
+}
+
+func (s *Server) PostAPIShortenBatchV2(w http.ResponseWriter, r *http.Request) {
+	var body models.RequestBatchLinks
+	var records []models.Record
+	response := models.ResponseBatchLinks{}
+
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&body); err != nil {
+		writeEnvelopeJSONError(w)
+		return
+	}
+
+	cookie, ok := sessionCookie(w, r)
+	if !ok {
+		return
+	}
+
+	for _, el := range body {
+		longURLStr, err := s.prepareURL(el.OriginalURL)
+		if err != nil {
+			writeEnvelopeURLError(w, err, el.CorrelationID)
+			return
+		}
+
+		id := makeRandStringBytes(shortenedURLLength)
+		rec, err := s.newRecord(id, longURLStr, el.LinkOptions)
+		if err != nil {
+			writeEnvelopeURLError(w, err, el.CorrelationID)
+			return
+		}
+		rec.UUID = el.CorrelationID
+
+		records = append(records, rec)
+		response = append(response, models.ResponseLinks{
+			CorrelationID: rec.UUID,
+			ShortURL:      s.shortURL(rec.ShortURL),
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := s.storage.AddBatch(ctx, records, cookie); err != nil {
+		if err == models.ErrConflict {
+			WriteEnvelopeError(w, http.StatusConflict, CodeConflict, "One of the urls is already shortened")
+			return
+		}
+		writeEnvelopeInternalError(w, err)
+		return
+	}
+	s.fetchMetadata(records...)
+	s.emitEvent(models.EventLinkCreated, records...)
+
+	writeEnvelope(w, http.StatusCreated, response, created(true))
+}
+
+// GetUserURLsV2 answers an empty list with 200, the total count and the
+// next cursor go to meta.
+func (s *Server) GetUserURLsV2(w http.ResponseWriter, r *http.Request) {
+	cookie, ok := sessionCookie(w, r)
+	if !ok {
+		return
+	}
+
+	query, err := parseListQuery(r)
+	if err != nil {
+		WriteEnvelopeError(w, http.StatusBadRequest, validation.CodeInvalidRequest, "Invalid list query")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	records, total, next, err := s.userRecordsPage(ctx, cookie, query)
+	if err != nil {
+		writeEnvelopeInternalError(w, err)
+		return
+	}
+
+	response := models.ResponseUserURLs{}
+	for _, rec := range records {
+		response = append(response, s.userURLResponse(rec))
+	}
+
+	writeEnvelope(w, http.StatusOK, response, models.ResponseMeta{Total: &total, NextCursor: next})
+}
+
+func (s *Server) DeleteUserURLsV2(w http.ResponseWriter, r *http.Request) {
+	var urls models.RequestDeletedUserURLS
+
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&urls); err != nil {
+		writeEnvelopeJSONError(w)
+		return
+	}
+
+	cookie, ok := sessionCookie(w, r)
+	if !ok {
+		return
+	}
+
+	keys, err := s.deletedLinkKeys(r.URL.Query().Get("domain"), urls)
+	if err != nil {
+		writeEnvelopeURLError(w, err, "")
+		return
+	}
+
+	s.DeletedURLsChan <- models.DeletedURLMessage{
+		ShortURLs:  keys,
+		UserCookie: cookie,
+	}
+
+	writeEnvelope(w, http.StatusAccepted, nil, models.ResponseMeta{})
+}
+
+func (s *Server) EditUserURLV2(w http.ResponseWriter, r *http.Request) {
+	var body models.RequestEditLink
+
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&body); err != nil {
+		writeEnvelopeJSONError(w)
+		return
+	}
+
+	cookie, ok := sessionCookie(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := s.editedLinkKey(r)
+	if err != nil {
+		writeEnvelopeURLError(w, err, "")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// links of other users are not found before anything about them is checked
+	rec, err := s.storage.GetUserRecord(ctx, cookie, id)
+	if err != nil {
+		switch err {
+		case models.ErrDeleted:
+			WriteEnvelopeError(w, http.StatusGone, CodeGone, "URL was deleted")
+		case models.ErrNotFound:
+			WriteEnvelopeError(w, http.StatusNotFound, CodeNotFound, "URL not found")
+		default:
+			writeEnvelopeInternalError(w, err)
+		}
+		return
+	}
+
+	if err := s.applyEdit(&rec, body); err != nil {
+		writeEnvelopeURLError(w, err, "")
+		return
+	}
+
+	err = s.storage.UpdateRecord(ctx, rec, cookie)
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			WriteEnvelopeError(w, http.StatusNotFound, CodeNotFound, "URL not found")
+		case models.ErrConflict:
+			WriteEnvelopeError(w, http.StatusConflict, CodeConflict, "URL already exists")
+		default:
+			writeEnvelopeInternalError(w, err)
+		}
+		return
+	}
+
+	if body.URL != nil {
+		s.fetchMetadata(rec)
+	}
+	s.emitEvent(models.EventLinkUpdated, rec)
+
+	writeEnvelope(w, http.StatusOK, s.userURLResponse(rec), models.ResponseMeta{})
+}
+
+func (s *Server) PingV2(w http.ResponseWriter, _ *http.Request) {
+	if s.storage.GetMode() != initstorage.DBMode {
+		WriteEnvelopeError(w, http.StatusServiceUnavailable, CodeUnavailable, "Database isn't used")
+		return
+	}
+
+	if err := s.storage.HealthCheck(); err != nil {
+		logger.Log.Error(err)
+		WriteEnvelopeError(w, http.StatusServiceUnavailable, CodeUnavailable, "Database is unavailable")
+		return
+	}
+
+	writeEnvelope(w, http.StatusOK, nil, models.ResponseMeta{})
+}
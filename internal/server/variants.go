@@ -0,0 +1,97 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/DavidGQK/go-link-shortener/internal/logger"
+	"github.com/DavidGQK/go-link-shortener/internal/models"
+	"github.com/DavidGQK/go-link-shortener/internal/targeting"
+	"github.com/DavidGQK/go-link-shortener/internal/validation"
+	"go.uber.org/zap"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	maxVariants         = 10
+	variantCookiePrefix = "shortener_variant_"
+	variantCookieMaxAge = 30 * 24 * 60 * 60
+)
+
+func (s *Server) prepareVariants(variants models.Variants) (models.Variants, error) {
+	if len(variants) > maxVariants {
+		return nil, &validation.Error{
+			Code:    validation.CodeVariants,
+			Message: fmt.Sprintf("a link can't have more than %d variants", maxVariants),
+		}
+	}
+
+	prepared := make(models.Variants, 0, len(variants))
+	for i, v := range variants {
+		if v.Weight <= 0 {
+			return nil, &validation.Error{
+				Code:    validation.CodeVariants,
+				Message: fmt.Sprintf("variant %d must have a positive weight", i+1),
+			}
+		}
+
+		longURLStr, err := s.prepareURL(v.URL)
+		if err != nil {
+			return nil, err
+		}
+
+		prepared = append(prepared, models.Variant{URL: longURLStr, Weight: v.Weight})
+	}
+
+	if len(prepared) == 0 {
+		return nil, nil
+	}
+	return prepared, nil
+}
+
+// keepVariantClicks carries click counters over to variants whose position
+// and destination didn't change during an edit.
+func keepVariantClicks(prev, next models.Variants) {
+	for i := range next {
+		if i < len(prev) && prev[i].URL == next[i].URL {
+			next[i].Clicks = prev[i].Clicks
+		}
+	}
+}
+
+func (s *Server) chooseVariant(w http.ResponseWriter, r *http.Request, rec models.Record) string {
+	_, id := splitLinkKey(rec.ShortURL)
+	cookieName := variantCookiePrefix + id
+
+	variant := -1
+	if cookie, err := r.Cookie(cookieName); err == nil {
+		if i, err := strconv.Atoi(cookie.Value); err == nil && i >= 0 && i < len(rec.Variants) {
+			variant = i
+		}
+	}
+	if variant < 0 {
+		variant = targeting.ChooseVariant(rec.Variants, clientIP(r)+"|"+r.UserAgent())
+	}
+	if variant < 0 {
+		return rec.OriginalURL
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     cookieName,
+		Value:    strconv.Itoa(variant),
+		Path:     "/" + id,
+		MaxAge:   variantCookieMaxAge,
+		HttpOnly: true,
+	})
+
+	if r.Method != http.MethodHead {
+		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		defer cancel()
+		if err := s.storage.RegisterVariantClick(ctx, rec.ShortURL, variant); err != nil {
+			logger.Log.Error("register variant click error", zap.Error(err))
+		}
+	}
+
+	return rec.Variants[variant].URL
+}
@@ -0,0 +1,338 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/DavidGQK/go-link-shortener/internal/logger"
+	"github.com/DavidGQK/go-link-shortener/internal/models"
+	"github.com/DavidGQK/go-link-shortener/internal/validation"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	maxWebhooks         = 10
+	maxClickThresholds  = 20
+	minWebhookSecret    = 16
+	defaultDeliveryPage = 50
+	maxDeliveryPage     = 1000
+)
+
+var webhookEvents = models.WebhookEvents{
+	models.EventLinkCreated,
+	models.EventLinkUpdated,
+	models.EventLinkDeleted,
+	models.EventLinkClickThreshold,
+}
+
+func (s *Server) prepareWebhook(body models.RequestWebhook) (models.Webhook, error) {
+	hook := models.Webhook{
+		ID:        uuid.NewString(),
+		URL:       body.URL,
+		Secret:    body.Secret,
+		CreatedAt: time.Now(),
+	}
+
+	if err := s.validationPolicy().Validate(hook.URL); err != nil {
+		return hook, err
+	}
+
+	if len(body.Events) == 0 {
+		return hook, webhookError("at least one event is required")
+	}
+	for _, event := range body.Events {
+		if !webhookEvents.Has(event) {
+			return hook, webhookError(fmt.Sprintf("unknown event %q", event))
+		}
+		if !hook.Events.Has(event) {
+			hook.Events = append(hook.Events, event)
+		}
+	}
+
+	if len(body.ClickThresholds) > maxClickThresholds {
+		return hook, webhookError(fmt.Sprintf("a webhook can't have more than %d click thresholds", maxClickThresholds))
+	}
+	for _, threshold := range body.ClickThresholds {
+		if threshold <= 0 {
+			return hook, webhookError("click thresholds must be positive")
+		}
+		if !hook.ClickThresholds.Has(threshold) {
+			hook.ClickThresholds = append(hook.ClickThresholds, threshold)
+		}
+	}
+	sort.Ints(hook.ClickThresholds)
+	if hook.Events.Has(models.EventLinkClickThreshold) && len(hook.ClickThresholds) == 0 {
+		return hook, webhookError("click thresholds are required for " + models.EventLinkClickThreshold)
+	}
+
+	if hook.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return hook, err
+		}
+		hook.Secret = hex.EncodeToString(secret)
+	} else if len(hook.Secret) < minWebhookSecret {
+		return hook, webhookError(fmt.Sprintf("secret must be at least %d bytes long", minWebhookSecret))
+	}
+
+	return hook, nil
+}
+
+func webhookError(message string) error {
+	return &validation.Error{Code: validation.CodeWebhook, Message: message}
+}
+
+func (s *Server) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var body models.RequestWebhook
+
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&body); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	userCookie := requestSession(r)
+	if userCookie == "" {
+		http.Error(w, "Invalid cookie", http.StatusUnauthorized)
+		return
+	}
+
+	hook, err := s.prepareWebhook(body)
+	if err != nil {
+		writeURLError(w, err, "")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	hooks, err := s.storage.GetUserWebhooks(ctx, userCookie)
+	if err != nil {
+		logger.Log.Error(err)
+		http.Error(w, "Internal Backend Error", http.StatusInternalServerError)
+		return
+	}
+	if len(hooks) >= maxWebhooks {
+		writeURLError(w, webhookError(fmt.Sprintf("a user can't have more than %d webhooks", maxWebhooks)), "")
+		return
+	}
+
+	if err := s.storage.CreateWebhook(ctx, userCookie, hook); err != nil {
+		logger.Log.Error(err)
+		http.Error(w, "Internal Backend Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(hook); err != nil {
+		logger.Log.Error(err)
+	}
+}
+
+func (s *Server) GetUserWebhooks(w http.ResponseWriter, r *http.Request) {
+	userCookie := requestSession(r)
+	if userCookie == "" {
+		http.Error(w, "Invalid cookie", http.StatusUnauthorized)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	hooks, err := s.storage.GetUserWebhooks(ctx, userCookie)
+	if err != nil {
+		logger.Log.Error(err)
+		http.Error(w, "Internal Backend Error", http.StatusInternalServerError)
+		return
+	}
+
+	// secrets are only shown once, when a webhook is created
+	for i := range hooks {
+		hooks[i].Secret = ""
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(hooks); err != nil {
+		logger.Log.Error(err)
+	}
+}
+
+func (s *Server) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	userCookie := requestSession(r)
+	if userCookie == "" {
+		http.Error(w, "Invalid cookie", http.StatusUnauthorized)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := s.storage.DeleteWebhook(ctx, userCookie, chi.URLParam(r, "id"))
+	if err != nil {
+		if err == models.ErrNotFound {
+			http.Error(w, "Webhook not found", http.StatusNotFound)
+			return
+		}
+		logger.Log.Error(err)
+		http.Error(w, "Internal Backend Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetWebhookDeliveries lists the newest delivery attempts of a webhook,
+// or its dead letters with ?dead=true.
+func (s *Server) GetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	userCookie := requestSession(r)
+	if userCookie == "" {
+		http.Error(w, "Invalid cookie", http.StatusUnauthorized)
+		return
+	}
+
+	query := models.DeliveryQuery{
+		WebhookID: chi.URLParam(r, "id"),
+		Limit:     defaultDeliveryPage,
+	}
+	var err error
+	if dead := r.URL.Query().Get("dead"); dead != "" {
+		if query.DeadLetters, err = strconv.ParseBool(dead); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+	}
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		query.Limit, err = strconv.Atoi(limit)
+		if err != nil || query.Limit <= 0 || query.Limit > maxDeliveryPage {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	deliveries, err := s.storage.GetWebhookDeliveries(ctx, userCookie, query)
+	if err != nil {
+		if err == models.ErrNotFound {
+			http.Error(w, "Webhook not found", http.StatusNotFound)
+			return
+		}
+		logger.Log.Error(err)
+		http.Error(w, "Internal Backend Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(deliveries); err != nil {
+		logger.Log.Error(err)
+	}
+}
+
+// emitEvent sends an event for every record to the webhooks of the
+// record's owner.
+func (s *Server) emitEvent(eventType string, records ...models.Record) {
+	if s.webhooks == nil {
+		return
+	}
+
+	for _, owned := range byOwner(records) {
+		s.emitOwned(eventType, owned)
+	}
+}
+
+// emitClick queues the click count the storage returned for a registered
+// click, the dispatcher checks it against the thresholds of the owner's
+// webhooks off the redirect path.
+func (s *Server) emitClick(rec models.Record, clicks int) {
+	if s.webhooks == nil {
+		return
+	}
+
+	s.webhooks.Click(rec.ShortURL, clicks, s.userURLResponse(rec))
+}
+
+// emitOwned sends the events of records that belong to the same user.
+func (s *Server) emitOwned(eventType string, records []models.Record) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	hooks, err := s.storage.GetLinkWebhooks(ctx, records[0].ShortURL)
+	if err != nil {
+		logger.Log.Errorw("webhooks lookup error", "short_url", records[0].ShortURL, "error", err)
+		return
+	}
+
+	for _, hook := range hooks {
+		if !hook.Events.Has(eventType) {
+			continue
+		}
+
+		for _, rec := range records {
+			s.webhooks.Send(hook, models.WebhookEvent{
+				ID:        uuid.NewString(),
+				Type:      eventType,
+				CreatedAt: time.Now(),
+				Link:      s.userURLResponse(rec),
+			})
+		}
+	}
+}
+
+// byOwner groups records by their owner in the order the owners first
+// appear.
+func byOwner(records []models.Record) [][]models.Record {
+	var groups [][]models.Record
+	index := make(map[int]int)
+	for _, rec := range records {
+		i, ok := index[rec.UserID]
+		if !ok {
+			i = len(groups)
+			index[rec.UserID] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], rec)
+	}
+	return groups
+}
+
+// liveRecords returns the records of keys that aren't deleted yet.
+func (s *Server) liveRecords(keys []string) []models.Record {
+	var records []models.Record
+	for _, key := range keys {
+		if rec, err := s.storage.Get(key); err == nil && !rec.DeletedFlag {
+			records = append(records, rec)
+		}
+	}
+	return records
+}
+
+// emitDeleted sends events for the records that the delete worker has
+// actually deleted, links of other users are left untouched by it.
+func (s *Server) emitDeleted(records []models.Record) {
+	var deleted []models.Record
+	for _, rec := range records {
+		if _, err := s.storage.Get(rec.ShortURL); err == models.ErrDeleted {
+			rec.DeletedFlag = true
+			deleted = append(deleted, rec)
+		}
+	}
+
+	s.emitEvent(models.EventLinkDeleted, deleted...)
+}
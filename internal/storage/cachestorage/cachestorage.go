@@ -4,48 +4,297 @@ import (
 	"context"
 	"errors"
 	"github.com/DavidGQK/go-link-shortener/internal/models"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
+// maxDeliveryLog bounds the in-memory webhook delivery and dead letter logs.
+const maxDeliveryLog = 1000
+
 type CacheStor struct {
-	links map[string]string
-	mode  int
+	mu          sync.RWMutex
+	records     map[string]models.Record
+	origins     map[originKey]string
+	mode        int
+	dedupScope  string
+	users       map[int]string
+	sessions    map[string]int
+	lastUserID  int
+	webhooks    []userWebhook
+	deliveries  []models.WebhookDelivery
+	deadLetters []models.WebhookDelivery
+}
+
+// originKey names the first link to an original url. Links are deduped
+// per user in the user scope, the user is left out otherwise.
+type originKey struct {
+	userID int
+	url    string
 }
 
-func NewCacheStor(mode int) (*CacheStor, error) {
+// userWebhook is a webhook with the user who registered it.
+type userWebhook struct {
+	models.Webhook
+	userID int
+}
+
+func NewCacheStor(mode int, dedupScope string) (*CacheStor, error) {
 	newCacheStor := &CacheStor{
-		mode:  mode,
-		links: make(map[string]string),
+		mode:       mode,
+		dedupScope: dedupScope,
+		records:    make(map[string]models.Record),
+		origins:    make(map[originKey]string),
+		users:      make(map[int]string),
+		sessions:   make(map[string]int),
 	}
 
 	return newCacheStor, nil
 }
 
-func (s *CacheStor) Add(key, value, _ string) error {
-	s.links[key] = value
-	return nil
+func (s *CacheStor) Add(rec models.Record, cookie string) error {
+	rec.UserID = s.UserID(cookie)
+	if rec.CreatedAt.IsZero() {
+		rec.CreatedAt = time.Now()
+	}
+	if rec.UpdatedAt.IsZero() {
+		rec.UpdatedAt = rec.CreatedAt
+	}
+	return s.Insert(rec)
 }
 
-func (s *CacheStor) AddBatch(_ context.Context, records []models.Record) error {
+func (s *CacheStor) AddBatch(_ context.Context, records []models.Record, cookie string) error {
+	userID := s.UserID(cookie)
+	batch := make([]models.Record, 0, len(records))
+	for _, rec := range records {
+		rec.UserID = userID
+		if rec.CreatedAt.IsZero() {
+			rec.CreatedAt = time.Now()
+		}
+		if rec.UpdatedAt.IsZero() {
+			rec.UpdatedAt = rec.CreatedAt
+		}
+		batch = append(batch, rec)
+	}
+	return s.Insert(batch...)
+}
+
+// Insert adds new records, all of them or none with models.ErrConflict when
+// an original url is already shortened in the dedup scope. Memory and file
+// modes dedup like the database, so only the none scope takes repeated urls.
+func (s *CacheStor) Insert(records ...models.Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.dedupScope != models.DedupScopeNone {
+		batch := make(map[originKey]bool, len(records))
+		for _, rec := range records {
+			key := s.originKey(rec.UserID, rec.OriginalURL)
+			if _, found := s.origins[key]; found || batch[key] {
+				return models.ErrConflict
+			}
+			batch[key] = true
+		}
+	}
+
 	for _, rec := range records {
-		s.links[rec.ShortURL] = rec.OriginalURL
+		s.setRecord(rec)
 	}
 	return nil
 }
 
-func (s *CacheStor) Get(key string) (string, error) {
-	value, found := s.links[key]
+func (s *CacheStor) SetRecord(rec models.Record) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.setRecord(rec)
+}
+
+func (s *CacheStor) setRecord(rec models.Record) {
+	if prev, found := s.records[rec.ShortURL]; found {
+		if key := s.originKey(prev.UserID, prev.OriginalURL); s.origins[key] == prev.ShortURL {
+			delete(s.origins, key)
+		}
+	}
+	s.records[rec.ShortURL] = rec
+	if _, found := s.users[rec.UserID]; !found && rec.UserID > 0 {
+		s.users[rec.UserID] = ""
+	}
+	if rec.UserID > s.lastUserID {
+		s.lastUserID = rec.UserID
+	}
+	if key := s.originKey(rec.UserID, rec.OriginalURL); s.origins[key] == "" {
+		s.origins[key] = rec.ShortURL
+	}
+}
+
+func (s *CacheStor) originKey(userID int, url string) originKey {
+	if s.dedupScope != models.DedupScopeUser {
+		userID = 0
+	}
+	return originKey{userID: userID, url: url}
+}
+
+func (s *CacheStor) Get(key string) (models.Record, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rec, found := s.records[key]
 	if !found {
-		return "", errors.New("key not found")
+		return rec, errors.New("key not found")
 	}
-	return value, nil
+	if rec.DeletedFlag {
+		return rec, models.ErrDeleted
+	}
+	return rec, nil
+}
+
+// GetUserRecord returns a link of the session's user, links of other users
+// are models.ErrNotFound.
+func (s *CacheStor) GetUserRecord(_ context.Context, cookie, key string) (models.Record, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rec, found := s.records[key]
+	if !found || !s.owns(rec, cookie) {
+		return models.Record{}, models.ErrNotFound
+	}
+	if rec.DeletedFlag {
+		return rec, models.ErrDeleted
+	}
+	return rec, nil
+}
+
+// RegisterClick counts a click and returns the new click count.
+func (s *CacheStor) RegisterClick(_ context.Context, key string) (int, error) {
+	rec, err := s.IncrementClicks(key)
+	if err != nil {
+		return 0, err
+	}
+	return rec.Clicks, nil
+}
+
+func (s *CacheStor) IncrementClicks(key string) (models.Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec, found := s.records[key]
+	if !found {
+		return rec, errors.New("key not found")
+	}
+	if rec.DeletedFlag || rec.MaxClicks > 0 && rec.Clicks >= rec.MaxClicks {
+		return rec, models.ErrDeleted
+	}
+
+	rec.Clicks++
+	if rec.MaxClicks > 0 && rec.Clicks >= rec.MaxClicks {
+		rec.DeletedFlag = true
+	}
+	s.records[key] = rec
+	return rec, nil
+}
+
+func (s *CacheStor) RegisterVariantClick(_ context.Context, key string, variant int) error {
+	_, err := s.IncrementVariantClicks(key, variant)
+	return err
+}
+
+func (s *CacheStor) IncrementVariantClicks(key string, variant int) (models.Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec, found := s.records[key]
+	if !found || variant < 0 || variant >= len(rec.Variants) {
+		return rec, errors.New("variant not found")
+	}
+
+	variants := make(models.Variants, len(rec.Variants))
+	copy(variants, rec.Variants)
+	variants[variant].Clicks++
+	rec.Variants = variants
+
+	s.records[key] = rec
+	return rec, nil
+}
+
+func (s *CacheStor) UpdateRecord(_ context.Context, rec models.Record, cookie string) error {
+	_, err := s.ReplaceRecord(rec, cookie)
+	return err
+}
+
+// ReplaceRecord saves an edited record of the session's user, keeping what
+// edits don't change.
+func (s *CacheStor) ReplaceRecord(rec models.Record, cookie string) (models.Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, found := s.records[rec.ShortURL]
+	if !found || stored.DeletedFlag || !s.owns(stored, cookie) {
+		return rec, models.ErrNotFound
+	}
+
+	if rec.OriginalURL != stored.OriginalURL && s.dedupScope != models.DedupScopeNone {
+		if _, found := s.origins[s.originKey(stored.UserID, rec.OriginalURL)]; found {
+			return rec, models.ErrConflict
+		}
+	}
+
+	rec.UUID = stored.UUID
+	rec.UserID = stored.UserID
+	rec.Clicks = stored.Clicks
+	rec.CreatedAt = stored.CreatedAt
+	rec.UpdatedAt = time.Now()
+	s.setRecord(rec)
+	return rec, nil
+}
+
+func (s *CacheStor) UpdateMetadata(_ context.Context, key string, meta models.LinkMetadata) error {
+	_, err := s.FillMetadata(key, meta)
+	return err
+}
+
+// FillMetadata keeps the title and description chosen by the user
+// and only fills them in when they are empty.
+func (s *CacheStor) FillMetadata(key string, meta models.LinkMetadata) (models.Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec, found := s.records[key]
+	if !found {
+		return rec, models.ErrNotFound
+	}
+
+	if rec.Title == "" {
+		rec.Title = meta.Title
+	}
+	if rec.Description == "" {
+		rec.Description = meta.Description
+	}
+	rec.ImageURL = meta.ImageURL
+	rec.FaviconURL = meta.FaviconURL
+
+	s.records[key] = rec
+	return rec, nil
 }
 
 func (s *CacheStor) GetMode() int {
 	return s.mode
 }
 
-func (s *CacheStor) GetByOriginURL(_ string) (string, error) {
-	return "", errors.New("not database mode")
+// GetByOriginURL returns the link of the session's user to the original
+// url. In the global scope the url may be shortened by another user, their
+// link isn't handed out and it's models.ErrNotFound.
+func (s *CacheStor) GetByOriginURL(originURL, cookie string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	userID := s.sessions[cookie]
+	key, found := s.origins[s.originKey(userID, originURL)]
+	if !found || s.records[key].UserID != userID {
+		return "", models.ErrNotFound
+	}
+	return key, nil
 }
 
 func (s *CacheStor) HealthCheck() error {
@@ -60,22 +309,463 @@ func (s *CacheStor) CloseStorage() error {
 	return nil
 }
 
-func (s *CacheStor) GetUserRecords(_ context.Context, _ string) ([]models.Record, error) {
-	return nil, errors.New("not database mode")
+func (s *CacheStor) GetUserRecords(_ context.Context, cookie string, query models.ListQuery) ([]models.Record, int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	records := make([]models.Record, 0)
+	for _, rec := range s.records {
+		if s.owns(rec, cookie) {
+			records = append(records, rec)
+		}
+	}
+
+	page, total := ListRecords(records, query)
+	return page, total, nil
+}
+
+// ListRecords applies a list query to records in memory.
+func ListRecords(records []models.Record, query models.ListQuery) ([]models.Record, int) {
+	search := strings.ToLower(query.Search)
+
+	matched := make([]models.Record, 0, len(records))
+	for _, rec := range records {
+		if rec.DeletedFlag && !query.IncludeDeleted {
+			continue
+		}
+		if query.Folder != nil && rec.Folder != *query.Folder {
+			continue
+		}
+		if !hasTags(rec.Tags, query.Tags) {
+			continue
+		}
+		if search != "" && !matchesSearch(rec, search) {
+			continue
+		}
+		matched = append(matched, rec)
+	}
+
+	less := func(a, b models.Record) bool {
+		switch query.Sort {
+		case models.SortClicks:
+			if a.Clicks != b.Clicks {
+				return a.Clicks < b.Clicks
+			}
+		case models.SortAlias:
+		default:
+			if !a.CreatedAt.Equal(b.CreatedAt) {
+				return a.CreatedAt.Before(b.CreatedAt)
+			}
+		}
+		return a.ShortURL < b.ShortURL
+	}
+	if query.Desc {
+		asc := less
+		less = func(a, b models.Record) bool { return asc(b, a) }
+	}
+
+	sort.Slice(matched, func(i, j int) bool { return less(matched[i], matched[j]) })
+	total := len(matched)
+
+	if query.After != nil {
+		after := models.Record{
+			ShortURL:  query.After.ShortURL,
+			Clicks:    query.After.Clicks,
+			CreatedAt: query.After.CreatedAt,
+		}
+		start := sort.Search(len(matched), func(i int) bool { return less(after, matched[i]) })
+		matched = matched[start:]
+	}
+
+	if query.Limit > 0 && len(matched) > query.Limit {
+		matched = matched[:query.Limit]
+	}
+
+	return matched, total
+}
+
+func hasTags(recTags models.Tags, tags []string) bool {
+	for _, tag := range tags {
+		found := false
+		for _, recTag := range recTags {
+			if recTag == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func matchesSearch(rec models.Record, search string) bool {
+	if strings.Contains(strings.ToLower(rec.OriginalURL), search) ||
+		strings.Contains(strings.ToLower(rec.Title), search) {
+		return true
+	}
+
+	for _, tag := range rec.Tags {
+		if strings.Contains(strings.ToLower(tag), search) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *CacheStor) GetUserLabels(_ context.Context, cookie, kind string) ([]models.LabelCount, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	counts := make(map[string]int)
+	for _, rec := range s.records {
+		if rec.DeletedFlag || !s.owns(rec, cookie) {
+			continue
+		}
+
+		if kind == models.LabelFolder {
+			if rec.Folder != "" {
+				counts[rec.Folder]++
+			}
+			continue
+		}
+		for _, tag := range rec.Tags {
+			counts[tag]++
+		}
+	}
+
+	labels := make([]models.LabelCount, 0, len(counts))
+	for name, count := range counts {
+		labels = append(labels, models.LabelCount{Name: name, Count: count})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+
+	return labels, nil
+}
+
+func (s *CacheStor) RenameUserLabel(_ context.Context, cookie, kind, name, newName string) error {
+	_, err := s.Relabel(cookie, kind, name, newName)
+	return err
+}
+
+func (s *CacheStor) DeleteUserLabel(_ context.Context, cookie, kind, name string) error {
+	_, err := s.Relabel(cookie, kind, name, "")
+	return err
+}
+
+// Relabel renames a tag or folder on every record of the session's user
+// carrying it, an empty new name removes it. The changed records are
+// returned.
+func (s *CacheStor) Relabel(cookie, kind, name, newName string) ([]models.Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var changed []models.Record
+	for key, rec := range s.records {
+		if !s.owns(rec, cookie) {
+			continue
+		}
+
+		if kind == models.LabelFolder {
+			if rec.Folder != name {
+				continue
+			}
+			rec.Folder = newName
+		} else {
+			tags, found := renameTag(rec.Tags, name, newName)
+			if !found {
+				continue
+			}
+			rec.Tags = tags
+		}
+		rec.UpdatedAt = time.Now()
+
+		s.records[key] = rec
+		changed = append(changed, rec)
+	}
+
+	if len(changed) == 0 {
+		return nil, models.ErrNotFound
+	}
+	return changed, nil
+}
+
+func renameTag(tags models.Tags, name, newName string) (models.Tags, bool) {
+	found := false
+	renamed := make(models.Tags, 0, len(tags))
+	for _, tag := range tags {
+		if tag == name {
+			found = true
+			continue
+		}
+		if tag != newName {
+			renamed = append(renamed, tag)
+		}
+	}
+	if !found {
+		return tags, false
+	}
+
+	if newName != "" {
+		renamed = append(renamed, newName)
+		sort.Strings(renamed)
+	}
+	if len(renamed) == 0 {
+		renamed = nil
+	}
+	return renamed, true
+}
+
+func (s *CacheStor) GetAllRecords(_ context.Context) ([]models.Record, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	records := make([]models.Record, 0, len(s.records))
+	for _, rec := range s.records {
+		if !rec.DeletedFlag {
+			records = append(records, rec)
+		}
+	}
+
+	return records, nil
+}
+
+// Records returns every record, deleted ones included.
+func (s *CacheStor) Records() []models.Record {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	records := make([]models.Record, 0, len(s.records))
+	for _, rec := range s.records {
+		records = append(records, rec)
+	}
+	return records
+}
+
+func (s *CacheStor) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.records)
+}
+
+func (s *CacheStor) DeleteBatchRecords(_ context.Context, records []models.Record) error {
+	s.MarkDeleted(records)
+	return nil
+}
+
+func (s *CacheStor) MarkDeleted(records []models.Record) []models.Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var deleted []models.Record
+	for _, rec := range records {
+		stored, found := s.records[rec.ShortURL]
+		if !found || stored.DeletedFlag {
+			continue
+		}
+
+		stored.DeletedFlag = true
+		s.records[rec.ShortURL] = stored
+		deleted = append(deleted, stored)
+	}
+
+	return deleted
 }
 
-func (s *CacheStor) FindUserByID(_ context.Context, _ int) (*models.User, error) {
-	return nil, errors.New("not database mode")
+func (s *CacheStor) FindUserByID(_ context.Context, userID int) (*models.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	cookie, found := s.users[userID]
+	if !found {
+		return nil, models.ErrNotFound
+	}
+	return &models.User{UserID: userID, Cookie: cookie}, nil
 }
 
 func (s *CacheStor) CreateUser(_ context.Context) (*models.User, error) {
-	return nil, errors.New("not database mode")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastUserID++
+	s.users[s.lastUserID] = ""
+	return &models.User{UserID: s.lastUserID}, nil
 }
 
-func (s *CacheStor) UpdateUser(_ context.Context, _ int, _ string) error {
-	return errors.New("not database mode")
+// UpdateUser binds a session to a user. Users restored from the file
+// come back without their sessions, they are bound again on first use.
+func (s *CacheStor) UpdateUser(_ context.Context, userID int, cookie string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, found := s.users[userID]; !found {
+		return models.ErrNotFound
+	}
+	delete(s.sessions, s.users[userID])
+	s.users[userID] = cookie
+	s.sessions[cookie] = userID
+	return nil
 }
 
-func (s *CacheStor) DeleteUserURLs(_ context.Context, _ models.DeletedURLMessage) error {
-	return errors.New("not database mode")
+// UserID returns the user of a session, 0 for unknown sessions.
+func (s *CacheStor) UserID(cookie string) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.sessions[cookie]
+}
+
+// owns tells whether a record belongs to the user of a session. Records
+// saved before links had owners belong to nobody. Callers hold mu.
+func (s *CacheStor) owns(rec models.Record, cookie string) bool {
+	userID, found := s.sessions[cookie]
+	return found && rec.UserID == userID
+}
+
+func (s *CacheStor) DeleteUserURLs(_ context.Context, message models.DeletedURLMessage) error {
+	s.MarkUserDeleted(message)
+	return nil
+}
+
+// MarkUserDeleted marks the links of a delete message that belong to its
+// session as deleted. The deleted records are returned.
+func (s *CacheStor) MarkUserDeleted(message models.DeletedURLMessage) []models.Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var deleted []models.Record
+	for _, key := range message.ShortURLs {
+		rec, found := s.records[key]
+		if !found || rec.DeletedFlag || !s.owns(rec, message.UserCookie) {
+			continue
+		}
+
+		rec.DeletedFlag = true
+		s.records[key] = rec
+		deleted = append(deleted, rec)
+	}
+
+	return deleted
+}
+
+func (s *CacheStor) CreateWebhook(_ context.Context, cookie string, hook models.Webhook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	userID, found := s.sessions[cookie]
+	if !found {
+		return models.ErrNotFound
+	}
+
+	s.webhooks = append(s.webhooks, userWebhook{Webhook: hook, userID: userID})
+	return nil
+}
+
+func (s *CacheStor) GetUserWebhooks(_ context.Context, cookie string) ([]models.Webhook, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	userID, found := s.sessions[cookie]
+	if !found {
+		return []models.Webhook{}, nil
+	}
+	return s.userWebhooks(userID), nil
+}
+
+// GetLinkWebhooks returns the webhooks of the link owner.
+func (s *CacheStor) GetLinkWebhooks(_ context.Context, key string) ([]models.Webhook, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rec, found := s.records[key]
+	if !found || rec.UserID == 0 {
+		return []models.Webhook{}, nil
+	}
+	return s.userWebhooks(rec.UserID), nil
+}
+
+func (s *CacheStor) userWebhooks(userID int) []models.Webhook {
+	hooks := []models.Webhook{}
+	for _, hook := range s.webhooks {
+		if hook.userID == userID {
+			hooks = append(hooks, hook.Webhook)
+		}
+	}
+	return hooks
+}
+
+// ownsWebhook tells whether a webhook belongs to the user of a session.
+// Callers hold mu.
+func (s *CacheStor) ownsWebhook(hook userWebhook, cookie string) bool {
+	userID, found := s.sessions[cookie]
+	return found && hook.userID == userID
+}
+
+func (s *CacheStor) DeleteWebhook(_ context.Context, cookie, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, hook := range s.webhooks {
+		if hook.ID == id && s.ownsWebhook(hook, cookie) {
+			s.webhooks = append(s.webhooks[:i], s.webhooks[i+1:]...)
+			return nil
+		}
+	}
+	return models.ErrNotFound
+}
+
+func (s *CacheStor) AddWebhookDelivery(_ context.Context, delivery models.WebhookDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deliveries = appendLog(s.deliveries, delivery)
+	return nil
+}
+
+func (s *CacheStor) AddWebhookDeadLetter(_ context.Context, delivery models.WebhookDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deadLetters = appendLog(s.deadLetters, delivery)
+	return nil
+}
+
+func appendLog(log []models.WebhookDelivery, delivery models.WebhookDelivery) []models.WebhookDelivery {
+	if len(log) >= maxDeliveryLog {
+		log = log[1:]
+	}
+	return append(log, delivery)
+}
+
+// GetWebhookDeliveries returns the newest deliveries of a webhook first.
+func (s *CacheStor) GetWebhookDeliveries(_ context.Context, cookie string, query models.DeliveryQuery) ([]models.WebhookDelivery, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	found := false
+	for _, hook := range s.webhooks {
+		found = found || hook.ID == query.WebhookID && s.ownsWebhook(hook, cookie)
+	}
+	if !found {
+		return nil, models.ErrNotFound
+	}
+
+	log := s.deliveries
+	if query.DeadLetters {
+		log = s.deadLetters
+	}
+
+	deliveries := []models.WebhookDelivery{}
+	for i := len(log) - 1; i >= 0; i-- {
+		if query.Limit > 0 && len(deliveries) == query.Limit {
+			break
+		}
+		if log[i].WebhookID == query.WebhookID {
+			deliveries = append(deliveries, log[i])
+		}
+	}
+
+	return deliveries, nil
 }
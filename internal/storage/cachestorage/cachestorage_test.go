@@ -0,0 +1,179 @@
+package cachestorage
+
+import (
+	"context"
+	"github.com/DavidGQK/go-link-shortener/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+)
+
+func Test_Dedup(t *testing.T) {
+	ctx := context.Background()
+
+	for _, scope := range []string{models.DedupScopeGlobal, models.DedupScopeUser} {
+		t.Run(scope, func(t *testing.T) {
+			s, err := NewCacheStor(0, scope)
+			require.NoError(t, err)
+
+			require.NoError(t, s.Add(models.Record{ShortURL: "first", OriginalURL: "https://practicum.yandex.ru/"}, ""))
+			assert.ErrorIs(t, s.Add(models.Record{ShortURL: "second", OriginalURL: "https://practicum.yandex.ru/"}, ""), models.ErrConflict)
+
+			key, err := s.GetByOriginURL("https://practicum.yandex.ru/", "")
+			require.NoError(t, err)
+			assert.Equal(t, "first", key)
+			_, err = s.GetByOriginURL("https://practicum.yandex.ru/other", "")
+			assert.ErrorIs(t, err, models.ErrNotFound)
+
+			err = s.AddBatch(ctx, []models.Record{
+				{ShortURL: "third", OriginalURL: "https://practicum.yandex.ru/third"},
+				{ShortURL: "fourth", OriginalURL: "https://practicum.yandex.ru/"},
+			}, "")
+			assert.ErrorIs(t, err, models.ErrConflict)
+			_, err = s.Get("third")
+			assert.Error(t, err, "the batch isn't saved")
+
+			err = s.AddBatch(ctx, []models.Record{
+				{ShortURL: "third", OriginalURL: "https://practicum.yandex.ru/third"},
+				{ShortURL: "fourth", OriginalURL: "https://practicum.yandex.ru/third"},
+			}, "")
+			assert.ErrorIs(t, err, models.ErrConflict)
+		})
+	}
+
+	t.Run(models.DedupScopeNone, func(t *testing.T) {
+		s, err := NewCacheStor(0, models.DedupScopeNone)
+		require.NoError(t, err)
+
+		require.NoError(t, s.Add(models.Record{ShortURL: "first", OriginalURL: "https://practicum.yandex.ru/"}, ""))
+		require.NoError(t, s.Add(models.Record{ShortURL: "second", OriginalURL: "https://practicum.yandex.ru/"}, ""))
+		require.NoError(t, s.AddBatch(ctx, []models.Record{
+			{ShortURL: "third", OriginalURL: "https://practicum.yandex.ru/"},
+		}, ""))
+
+		records, err := s.GetAllRecords(ctx)
+		require.NoError(t, err)
+		assert.Len(t, records, 3)
+	})
+}
+
+// Test_DedupUsers covers the scopes in memory mode with several users.
+func Test_DedupUsers(t *testing.T) {
+	const url = "https://practicum.yandex.ru/"
+
+	for _, tt := range []struct {
+		scope         string
+		otherConflict bool
+	}{
+		{scope: models.DedupScopeGlobal, otherConflict: true},
+		{scope: models.DedupScopeUser, otherConflict: false},
+	} {
+		t.Run(tt.scope, func(t *testing.T) {
+			s, err := NewCacheStor(0, tt.scope)
+			require.NoError(t, err)
+			newSession(t, s, "owner")
+			newSession(t, s, "other")
+
+			require.NoError(t, s.Add(models.Record{ShortURL: "first", OriginalURL: url}, "owner"))
+			assert.ErrorIs(t, s.Add(models.Record{ShortURL: "again", OriginalURL: url}, "owner"), models.ErrConflict)
+			key, err := s.GetByOriginURL(url, "owner")
+			require.NoError(t, err)
+			assert.Equal(t, "first", key)
+
+			err = s.Add(models.Record{ShortURL: "second", OriginalURL: url}, "other")
+			if tt.otherConflict {
+				assert.ErrorIs(t, err, models.ErrConflict)
+				_, err = s.GetByOriginURL(url, "other")
+				assert.ErrorIs(t, err, models.ErrNotFound, "the link of another user isn't handed out")
+				return
+			}
+			require.NoError(t, err)
+			key, err = s.GetByOriginURL(url, "other")
+			require.NoError(t, err)
+			assert.Equal(t, "second", key)
+			assert.ErrorIs(t, s.Add(models.Record{ShortURL: "third", OriginalURL: url}, "other"), models.ErrConflict)
+		})
+	}
+}
+
+// newSession creates a user the way the cookie middleware does.
+func newSession(t *testing.T, s *CacheStor, cookie string) {
+	ctx := context.Background()
+	user, err := s.CreateUser(ctx)
+	require.NoError(t, err)
+	require.NoError(t, s.UpdateUser(ctx, user.UserID, cookie))
+}
+
+func Test_UserRecords(t *testing.T) {
+	ctx := context.Background()
+
+	s, err := NewCacheStor(0, models.DedupScopeGlobal)
+	require.NoError(t, err)
+	newSession(t, s, "first")
+	newSession(t, s, "second")
+
+	require.NoError(t, s.Add(models.Record{ShortURL: "a", OriginalURL: "https://practicum.yandex.ru/a", Tags: models.Tags{"docs"}, Folder: "work"}, "first"))
+	require.NoError(t, s.AddBatch(ctx, []models.Record{
+		{ShortURL: "b", OriginalURL: "https://practicum.yandex.ru/b", Tags: models.Tags{"docs", "go"}},
+	}, "first"))
+	require.NoError(t, s.Add(models.Record{ShortURL: "c", OriginalURL: "https://practicum.yandex.ru/c", Tags: models.Tags{"docs"}}, "second"))
+
+	records, total, err := s.GetUserRecords(ctx, "first", models.ListQuery{Tags: []string{"docs"}})
+	require.NoError(t, err)
+	assert.Equal(t, 2, total)
+	assert.Equal(t, "a", records[0].ShortURL)
+	assert.Equal(t, "b", records[1].ShortURL)
+
+	_, total, err = s.GetUserRecords(ctx, "unknown", models.ListQuery{})
+	require.NoError(t, err)
+	assert.Zero(t, total)
+
+	labels, err := s.GetUserLabels(ctx, "second", models.LabelTag)
+	require.NoError(t, err)
+	assert.Equal(t, []models.LabelCount{{Name: "docs", Count: 1}}, labels)
+
+	require.NoError(t, s.RenameUserLabel(ctx, "first", models.LabelTag, "docs", "go"))
+	rec, err := s.Get("b")
+	require.NoError(t, err)
+	assert.Equal(t, models.Tags{"go"}, rec.Tags)
+	rec, err = s.Get("c")
+	require.NoError(t, err)
+	assert.Equal(t, models.Tags{"docs"}, rec.Tags, "other users keep their tags")
+
+	assert.ErrorIs(t, s.DeleteUserLabel(ctx, "second", models.LabelFolder, "work"), models.ErrNotFound)
+	require.NoError(t, s.DeleteUserLabel(ctx, "first", models.LabelFolder, "work"))
+
+	rec.OriginalURL = "https://practicum.yandex.ru/edited"
+	assert.ErrorIs(t, s.UpdateRecord(ctx, rec, "first"), models.ErrNotFound, "only the owner edits a link")
+	require.NoError(t, s.UpdateRecord(ctx, rec, "second"))
+	rec.ShortURL, rec.OriginalURL = "a", "https://practicum.yandex.ru/edited"
+	assert.ErrorIs(t, s.UpdateRecord(ctx, rec, "first"), models.ErrConflict)
+}
+
+func Test_RegisterClickCounts(t *testing.T) {
+	s, err := NewCacheStor(0, models.DedupScopeGlobal)
+	require.NoError(t, err)
+	require.NoError(t, s.Add(models.Record{ShortURL: "first", OriginalURL: "https://practicum.yandex.ru/", MaxClicks: 40}, ""))
+
+	counts := make(chan int, 50)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if clicks, err := s.RegisterClick(context.Background(), "first"); err == nil {
+				counts <- clicks
+			}
+		}()
+	}
+	wg.Wait()
+	close(counts)
+
+	seen := make(map[int]bool)
+	for clicks := range counts {
+		assert.False(t, seen[clicks], "click %d was counted twice", clicks)
+		seen[clicks] = true
+	}
+	assert.Len(t, seen, 40, "every click up to the limit gets its own count")
+}
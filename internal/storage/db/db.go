@@ -12,18 +12,134 @@ import (
 	"github.com/jackc/pgx/v5/pgconn"
 	_ "github.com/jackc/pgx/v5/stdlib"
 	"go.uber.org/zap"
+	"strconv"
 	"strings"
 	"time"
 )
 
+const recordColumns = `uuid, short_url, origin_url, COALESCE(user_id, 0), is_deleted, redirect_status,
+	clicks, created_at, password_hash, max_clicks, active_from, active_until, rules, variants, query_policy,
+	forward_path, domain, folder, updated_at, title, description, image_url, favicon_url,
+	COALESCE((SELECT json_agg(tags.name ORDER BY tags.name) FROM url_tags
+		JOIN tags ON tags.id = url_tags.tag_id WHERE url_tags.short_url = urls.short_url), '[]')`
+
+const insertRecordQuery = `INSERT INTO urls(uuid, short_url, origin_url, user_id, redirect_status, created_at,
+	password_hash, max_clicks, active_from, active_until, rules, variants, query_policy, forward_path, domain,
+	folder, updated_at, title, description, image_url, favicon_url)
+	VALUES($1, $2, $3, NULLIF($4, 0), $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19,
+	$20, $21)`
+
+var urlsMigrations = []string{
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS redirect_status INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS clicks INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now()`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS password_hash VARCHAR NOT NULL DEFAULT ''`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS max_clicks INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS active_from TIMESTAMPTZ`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS active_until TIMESTAMPTZ`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS rules JSONB`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS variants JSONB`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS query_policy VARCHAR NOT NULL DEFAULT ''`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS forward_path BOOLEAN NOT NULL DEFAULT false`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS domain VARCHAR NOT NULL DEFAULT ''`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS folder VARCHAR NOT NULL DEFAULT ''`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now()`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS title VARCHAR NOT NULL DEFAULT ''`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS description VARCHAR NOT NULL DEFAULT ''`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS image_url VARCHAR NOT NULL DEFAULT ''`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS favicon_url VARCHAR NOT NULL DEFAULT ''`,
+}
+
+var tagsScheme = []string{
+	`CREATE TABLE IF NOT EXISTS tags(
+		"id" SERIAL PRIMARY KEY,
+		"user_id" INTEGER NOT NULL DEFAULT 0,
+		"name" VARCHAR NOT NULL)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS tag_name_idx on tags(user_id, name)`,
+	`CREATE TABLE IF NOT EXISTS url_tags(
+		"short_url" VARCHAR NOT NULL,
+		"tag_id" INTEGER NOT NULL REFERENCES tags(id) ON DELETE CASCADE,
+		PRIMARY KEY (short_url, tag_id))`,
+}
+
+var webhooksScheme = []string{
+	`CREATE TABLE IF NOT EXISTS webhooks(
+		"id" VARCHAR PRIMARY KEY,
+		"user_id" INTEGER NOT NULL DEFAULT 0,
+		"url" VARCHAR NOT NULL,
+		"secret" VARCHAR NOT NULL,
+		"events" JSONB NOT NULL,
+		"click_thresholds" JSONB,
+		"created_at" TIMESTAMPTZ NOT NULL DEFAULT now())`,
+	`CREATE INDEX IF NOT EXISTS webhook_user_idx on webhooks(user_id)`,
+	`CREATE TABLE IF NOT EXISTS webhook_deliveries(
+		"id" VARCHAR PRIMARY KEY,
+		"webhook_id" VARCHAR NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+		"event_id" VARCHAR NOT NULL,
+		"event_type" VARCHAR NOT NULL,
+		"attempt" INTEGER NOT NULL,
+		"status_code" INTEGER NOT NULL DEFAULT 0,
+		"error" VARCHAR NOT NULL DEFAULT '',
+		"success" BOOLEAN NOT NULL,
+		"created_at" TIMESTAMPTZ NOT NULL DEFAULT now())`,
+	`CREATE INDEX IF NOT EXISTS webhook_delivery_idx on webhook_deliveries(webhook_id, created_at)`,
+	`CREATE TABLE IF NOT EXISTS webhook_dead_letters(
+		"id" VARCHAR PRIMARY KEY,
+		"webhook_id" VARCHAR NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+		"event_id" VARCHAR NOT NULL,
+		"event_type" VARCHAR NOT NULL,
+		"attempt" INTEGER NOT NULL,
+		"status_code" INTEGER NOT NULL DEFAULT 0,
+		"error" VARCHAR NOT NULL DEFAULT '',
+		"payload" JSONB NOT NULL,
+		"created_at" TIMESTAMPTZ NOT NULL DEFAULT now())`,
+	`CREATE INDEX IF NOT EXISTS webhook_dead_letter_idx on webhook_dead_letters(webhook_id, created_at)`,
+}
+
 type Database struct {
 	dbConnData string
 	DB         *sql.DB
 	mode       int
-	links      map[string]string
+	dedupScope string
+	// checkOrigins is set when the unique index of the dedup scope can't be
+	// built, inserts look the original urls up instead.
+	checkOrigins bool
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func scanRecord(row rowScanner) (models.Record, error) {
+	var rec models.Record
+	err := row.Scan(&rec.UUID, &rec.ShortURL, &rec.OriginalURL, &rec.UserID, &rec.DeletedFlag,
+		&rec.RedirectStatus, &rec.Clicks, &rec.CreatedAt, &rec.PasswordHash, &rec.MaxClicks,
+		&rec.ActiveFrom, &rec.ActiveUntil, &rec.Rules, &rec.Variants, &rec.QueryPolicy,
+		&rec.ForwardPath, &rec.Domain, &rec.Folder, &rec.UpdatedAt, &rec.Title, &rec.Description,
+		&rec.ImageURL, &rec.FaviconURL, &rec.Tags)
+	return rec, err
 }
 
-func NewDB(dbConnData string, mode int) (*Database, error) {
+func recordArgs(rec *models.Record) []any {
+	if rec.CreatedAt.IsZero() {
+		rec.CreatedAt = time.Now()
+	}
+	if rec.UpdatedAt.IsZero() {
+		rec.UpdatedAt = rec.CreatedAt
+	}
+
+	return []any{rec.UUID, rec.ShortURL, rec.OriginalURL, rec.UserID, rec.RedirectStatus, rec.CreatedAt,
+		rec.PasswordHash, rec.MaxClicks, rec.ActiveFrom, rec.ActiveUntil, rec.Rules, rec.Variants, rec.QueryPolicy,
+		rec.ForwardPath, rec.Domain, rec.Folder, rec.UpdatedAt, rec.Title, rec.Description,
+		rec.ImageURL, rec.FaviconURL}
+}
+
+func NewDB(dbConnData string, mode int, dedupScope string) (*Database, error) {
 	db, err := sql.Open("pgx", dbConnData)
 	if err != nil {
 		return nil, err
@@ -33,7 +149,7 @@ func NewDB(dbConnData string, mode int) (*Database, error) {
 		dbConnData: dbConnData,
 		DB:         db,
 		mode:       mode,
-		links:      make(map[string]string),
+		dedupScope: dedupScope,
 	}
 
 	return newDB, nil
@@ -49,12 +165,9 @@ func (db *Database) Restore() error {
 	return nil
 }
 
-func (db *Database) Add(key, value, cookie string) error {
-	id := uuid.NewString()
-	rec := models.Record{
-		UUID:        id,
-		ShortURL:    key,
-		OriginalURL: value,
+func (db *Database) Add(rec models.Record, cookie string) error {
+	if rec.UUID == "" {
+		rec.UUID = uuid.NewString()
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -65,6 +178,10 @@ func (db *Database) Add(key, value, cookie string) error {
 		return err
 	}
 
+	if err := db.checkOriginURLs(ctx, user.UserID, rec); err != nil {
+		return err
+	}
+
 	err = db.SaveRecord(ctx, &rec, user.UserID)
 	if err != nil {
 		var pgErr *pgconn.PgError
@@ -76,48 +193,104 @@ func (db *Database) Add(key, value, cookie string) error {
 		return err
 	}
 
-	db.links[key] = value
 	return nil
 }
 
-func (db *Database) AddBatch(ctx context.Context, records []models.Record) error {
+func (db *Database) AddBatch(ctx context.Context, records []models.Record, cookie string) error {
+	if cookie != "" {
+		user, err := db.FindUserByCookie(ctx, cookie)
+		if err != nil {
+			return err
+		}
+
+		for i := range records {
+			records[i].UserID = user.UserID
+		}
+	}
+
+	if len(records) > 0 {
+		if err := db.checkOriginURLs(ctx, records[0].UserID, records...); err != nil {
+			return err
+		}
+	}
+
 	err := db.SaveRecordsBatch(ctx, records)
 	if err != nil {
-		logger.Log.Error("error while writing data batch to db", zap.Error(err))
-	}
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgerrcode.IsIntegrityConstraintViolation(pgErr.Code) {
+			return models.ErrConflict
+		}
 
-	for _, rec := range records {
-		db.links[rec.ShortURL] = rec.OriginalURL
+		logger.Log.Error("error while writing data batch to db", zap.Error(err))
+		return err
 	}
 
 	return nil
 }
 
-func (db *Database) Get(key string) (string, error) {
+func (db *Database) Get(key string) (models.Record, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
 
 	rec, err := db.FindRecord(ctx, key)
 	if err != nil {
-		return "", fmt.Errorf("URL with the key \"%s\" is missing", key)
+		return rec, fmt.Errorf("URL with the key \"%s\" is missing", key)
 	}
 
 	if rec.DeletedFlag {
-		return "", models.ErrDeleted
+		return rec, models.ErrDeleted
 	}
 
-	return rec.OriginalURL, nil
+	return rec, nil
+}
+
+// GetUserRecord returns a link of the session's user, links of other users
+// are models.ErrNotFound.
+func (db *Database) GetUserRecord(ctx context.Context, cookie, key string) (models.Record, error) {
+	user, err := db.FindUserByCookie(ctx, cookie)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Record{}, models.ErrNotFound
+	}
+	if err != nil {
+		return models.Record{}, err
+	}
+
+	row := db.DB.QueryRowContext(ctx,
+		`SELECT `+recordColumns+` FROM urls WHERE short_url=$1 AND user_id=$2 LIMIT 1`, key, user.UserID)
+	rec, err := scanRecord(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return rec, models.ErrNotFound
+	}
+	if err != nil {
+		return rec, err
+	}
+
+	if rec.DeletedFlag {
+		return rec, models.ErrDeleted
+	}
+	return rec, nil
 }
 
 func (db *Database) GetMode() int {
 	return db.mode
 }
 
-func (db *Database) GetByOriginURL(originURL string) (string, error) {
+// GetByOriginURL returns the link of the user to the original url. In the
+// global scope the url may be shortened by another user, their link isn't
+// handed out and it's models.ErrNotFound.
+func (db *Database) GetByOriginURL(originURL, cookie string) (string, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
 
-	rec, err := db.FindRecordByOriginURL(ctx, originURL)
+	user, err := db.FindUserByCookie(ctx, cookie)
+	if err != nil {
+		return "", err
+	}
+
+	rec, err := db.FindUserRecordByOriginURL(ctx, originURL, user.UserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", models.ErrNotFound
+	}
 	if err != nil {
 		return "", err
 	}
@@ -138,28 +311,24 @@ func (db *Database) HealthCheck() error {
 
 func (db *Database) FindRecord(ctx context.Context, value string) (models.Record, error) {
 	row := db.DB.QueryRowContext(ctx,
-		`SELECT uuid, short_url, origin_url, is_deleted FROM urls WHERE short_url=$1 LIMIT 1`, value)
+		`SELECT `+recordColumns+` FROM urls WHERE short_url=$1 LIMIT 1`, value)
 
-	var rec models.Record
-	err := row.Scan(&rec.UUID, &rec.ShortURL, &rec.OriginalURL, &rec.DeletedFlag)
-	if err != nil {
-		return rec, err
-	}
-
-	return rec, err
+	return scanRecord(row)
 }
 
 func (db *Database) FindRecordByOriginURL(ctx context.Context, value string) (models.Record, error) {
 	row := db.DB.QueryRowContext(ctx,
-		`SELECT uuid, short_url, origin_url, is_deleted FROM urls WHERE origin_url=$1 LIMIT 1`, value)
+		`SELECT `+recordColumns+` FROM urls WHERE origin_url=$1 LIMIT 1`, value)
 
-	var rec models.Record
-	err := row.Scan(&rec.UUID, &rec.ShortURL, &rec.OriginalURL, &rec.DeletedFlag)
-	if err != nil {
-		return rec, err
-	}
+	return scanRecord(row)
+}
 
-	return rec, err
+func (db *Database) FindUserRecordByOriginURL(ctx context.Context, value string, userID int) (models.Record, error) {
+	row := db.DB.QueryRowContext(ctx,
+		`SELECT `+recordColumns+` FROM urls WHERE origin_url=$1 AND user_id=$2 LIMIT 1`,
+		value, userID)
+
+	return scanRecord(row)
 }
 
 func (db *Database) Close() error {
@@ -167,10 +336,71 @@ func (db *Database) Close() error {
 }
 
 func (db *Database) SaveRecord(ctx context.Context, rec *models.Record, userID int) error {
-	_, err := db.DB.ExecContext(ctx,
-		`INSERT INTO urls(uuid, short_url, origin_url, user_id) VALUES($1, $2, $3, $4)`,
-		rec.UUID, rec.ShortURL, rec.OriginalURL, userID)
-	return err
+	rec.UserID = userID
+	if len(rec.Tags) == 0 {
+		_, err := db.DB.ExecContext(ctx, insertRecordQuery, recordArgs(rec)...)
+		return err
+	}
+
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, insertRecordQuery, recordArgs(rec)...); err != nil {
+		return err
+	}
+
+	if err := saveTags(ctx, tx, rec.ShortURL, rec.UserID, rec.Tags); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// saveTags replaces the tags of a record, creating the user's tags on the way.
+func saveTags(ctx context.Context, ex execer, shortURL string, userID int, tags []string) error {
+	_, err := ex.ExecContext(ctx, `DELETE FROM url_tags WHERE short_url=$1`, shortURL)
+	if err != nil {
+		return err
+	}
+
+	for _, tag := range tags {
+		var tagID int
+		err := ex.QueryRowContext(ctx,
+			`INSERT INTO tags(user_id, name) VALUES($1, $2)
+				ON CONFLICT (user_id, name) DO UPDATE SET name=EXCLUDED.name RETURNING id`,
+			userID, tag).Scan(&tagID)
+		if err != nil {
+			return err
+		}
+
+		_, err = ex.ExecContext(ctx,
+			`INSERT INTO url_tags(short_url, tag_id) VALUES($1, $2) ON CONFLICT DO NOTHING`, shortURL, tagID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RegisterClick counts a click and returns the new click count.
+func (db *Database) RegisterClick(ctx context.Context, key string) (int, error) {
+	var clicks int
+	err := db.DB.QueryRowContext(ctx,
+		`UPDATE urls SET clicks = clicks + 1, is_deleted = (max_clicks > 0 AND clicks + 1 >= max_clicks)
+			WHERE short_url=$1 AND is_deleted=false AND (max_clicks = 0 OR clicks < max_clicks)
+			RETURNING clicks`, key).Scan(&clicks)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, models.ErrDeleted
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return clicks, nil
 }
 
 func (db *Database) CreateDBScheme() error {
@@ -202,34 +432,183 @@ func (db *Database) CreateDBScheme() error {
 		return err
 	}
 
-	_, err = db.DB.ExecContext(ctx,
-		`CREATE UNIQUE INDEX IF NOT EXISTS origin_url_idx on urls(origin_url)`)
+	for _, migration := range urlsMigrations {
+		if _, err := db.DB.ExecContext(ctx, migration); err != nil {
+			return err
+		}
+	}
+
+	for _, query := range tagsScheme {
+		if _, err := db.DB.ExecContext(ctx, query); err != nil {
+			return err
+		}
+	}
+
+	for _, query := range webhooksScheme {
+		if _, err := db.DB.ExecContext(ctx, query); err != nil {
+			return err
+		}
+	}
+
+	return db.createOriginURLIndexes(ctx)
+}
+
+func (db *Database) createOriginURLIndexes(ctx context.Context) error {
+	var queries []string
+
+	switch db.dedupScope {
+	case models.DedupScopeUser:
+		queries = []string{
+			`DROP INDEX IF EXISTS origin_url_idx`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS user_origin_url_idx on urls(user_id, origin_url)`,
+		}
+	case models.DedupScopeNone:
+		queries = []string{
+			`DROP INDEX IF EXISTS origin_url_idx`,
+			`DROP INDEX IF EXISTS user_origin_url_idx`,
+		}
+	default:
+		queries = []string{
+			`DROP INDEX IF EXISTS user_origin_url_idx`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS origin_url_idx on urls(origin_url)`,
+		}
+	}
+
+	for _, query := range queries {
+		_, err := db.DB.ExecContext(ctx, query)
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+			// links saved under a wider scope repeat original urls
+			logger.Log.Warnw("original urls have duplicates, deduplication looks them up until they're deleted",
+				"scope", db.dedupScope, zap.Error(err))
+			db.checkOrigins = true
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkOriginURLs is the dedup check of inserts without the unique index.
+func (db *Database) checkOriginURLs(ctx context.Context, userID int, records ...models.Record) error {
+	if !db.checkOrigins {
+		return nil
+	}
+
+	query := `SELECT EXISTS(SELECT 1 FROM urls WHERE origin_url=$1 AND ($2 = 0 OR user_id=$2))`
+	if db.dedupScope != models.DedupScopeUser {
+		userID = 0
+	}
+
+	for _, rec := range records {
+		var found bool
+		if err := db.DB.QueryRowContext(ctx, query, rec.OriginalURL, userID).Scan(&found); err != nil {
+			return err
+		}
+		if found {
+			return models.ErrConflict
+		}
+	}
+
+	return nil
+}
+
+func (db *Database) RegisterVariantClick(ctx context.Context, key string, variant int) error {
+	res, err := db.DB.ExecContext(ctx,
+		`UPDATE urls SET variants = jsonb_set(variants, ARRAY[$2::text, 'clicks'],
+			to_jsonb(COALESCE((variants->($3::int)->>'clicks')::int, 0) + 1))
+			WHERE short_url=$1 AND jsonb_array_length(variants) > $3::int`,
+		key, strconv.Itoa(variant), variant)
 	if err != nil {
 		return err
 	}
 
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return models.ErrNotFound
+	}
+
 	return nil
 }
 
-func (db *Database) SaveRecordsBatch(ctx context.Context, records []models.Record) error {
-	tx, err := db.DB.Begin()
+func (db *Database) UpdateMetadata(ctx context.Context, key string, meta models.LinkMetadata) error {
+	res, err := db.DB.ExecContext(ctx,
+		`UPDATE urls SET title = CASE WHEN title = '' THEN $2 ELSE title END,
+			description = CASE WHEN description = '' THEN $3 ELSE description END,
+			image_url=$4, favicon_url=$5
+			WHERE short_url=$1`,
+		key, meta.Title, meta.Description, meta.ImageURL, meta.FaviconURL)
+	if err != nil {
+		return err
+	}
+
+	return checkUpdated(res)
+}
+
+func (db *Database) UpdateRecord(ctx context.Context, rec models.Record, cookie string) error {
+	user, err := db.FindUserByCookie(ctx, cookie)
+	if err != nil {
+		return models.ErrNotFound
+	}
+
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx,
+		`UPDATE urls SET origin_url=$3, redirect_status=$4, password_hash=$5, max_clicks=$6,
+			active_from=$7, active_until=$8, rules=$9, variants=$10, query_policy=$11,
+			forward_path=$12, folder=$13, title=$14, description=$15, updated_at=now()
+			WHERE short_url=$1 AND user_id=$2 AND is_deleted=false`,
+		rec.ShortURL, user.UserID, rec.OriginalURL, rec.RedirectStatus, rec.PasswordHash, rec.MaxClicks,
+		rec.ActiveFrom, rec.ActiveUntil, rec.Rules, rec.Variants, rec.QueryPolicy,
+		rec.ForwardPath, rec.Folder, rec.Title, rec.Description)
 	if err != nil {
-		rb := tx.Rollback()
-		if rb != nil {
-			return rb
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgerrcode.IsIntegrityConstraintViolation(pgErr.Code) {
+			return models.ErrConflict
 		}
 		return err
 	}
 
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return models.ErrNotFound
+	}
+
+	if err := saveTags(ctx, tx, rec.ShortURL, user.UserID, rec.Tags); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *Database) SaveRecordsBatch(ctx context.Context, records []models.Record) error {
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
 	for _, rec := range records {
-		_, err := tx.ExecContext(ctx,
-			`INSERT INTO urls(uuid, short_url, origin_url) VALUES($1, $2, $3)`,
-			rec.UUID, rec.ShortURL, rec.OriginalURL)
+		_, err := tx.ExecContext(ctx, insertRecordQuery, recordArgs(&rec)...)
+		if err == nil && len(rec.Tags) > 0 {
+			err = saveTags(ctx, tx, rec.ShortURL, rec.UserID, rec.Tags)
+		}
 
 		if err != nil {
-			rb := tx.Rollback()
-			if rb != nil {
-				return rb
+			if rb := tx.Rollback(); rb != nil {
+				logger.Log.Error("batch rollback error", zap.Error(rb))
 			}
 			return err
 		}
@@ -242,9 +621,85 @@ func (db *Database) CloseStorage() error {
 	return db.DB.Close()
 }
 
-func (db *Database) FindRecordsByUserID(ctx context.Context, userID int) (records []models.Record, err error) {
-	rows, err := db.DB.QueryContext(ctx,
-		"SELECT uuid, short_url, origin_url, is_deleted FROM urls WHERE user_id=$1", userID)
+const urlHasTag = `EXISTS (SELECT 1 FROM url_tags JOIN tags ON tags.id = url_tags.tag_id
+	WHERE url_tags.short_url = urls.short_url AND tags.name `
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func (db *Database) FindRecordsByUserID(ctx context.Context, userID int, query models.ListQuery) ([]models.Record, int, error) {
+	args := []any{userID}
+	arg := func(value any) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	where := []string{"user_id=$1"}
+	if !query.IncludeDeleted {
+		where = append(where, "is_deleted=false")
+	}
+	if query.Folder != nil {
+		where = append(where, "folder="+arg(*query.Folder))
+	}
+	for _, tag := range query.Tags {
+		where = append(where, urlHasTag+"= "+arg(tag)+")")
+	}
+	if query.Search != "" {
+		pattern := arg("%" + likeEscaper.Replace(query.Search) + "%")
+		where = append(where, "(origin_url ILIKE "+pattern+" OR title ILIKE "+pattern+
+			" OR "+urlHasTag+"ILIKE "+pattern+"))")
+	}
+
+	var total int
+	err := db.DB.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM urls WHERE "+strings.Join(where, " AND "), args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	column := "created_at"
+	switch query.Sort {
+	case models.SortClicks:
+		column = "clicks"
+	case models.SortAlias:
+		column = ""
+	}
+
+	order, cmp := "ASC", ">"
+	if query.Desc {
+		order, cmp = "DESC", "<"
+	}
+
+	if after := query.After; after != nil {
+		switch query.Sort {
+		case models.SortClicks:
+			where = append(where, "(clicks, short_url) "+cmp+" ("+arg(after.Clicks)+", "+arg(after.ShortURL)+")")
+		case models.SortAlias:
+			where = append(where, "short_url "+cmp+" "+arg(after.ShortURL))
+		default:
+			where = append(where, "(created_at, short_url) "+cmp+" ("+arg(after.CreatedAt)+", "+arg(after.ShortURL)+")")
+		}
+	}
+
+	orderBy := "short_url " + order
+	if column != "" {
+		orderBy = column + " " + order + ", " + orderBy
+	}
+
+	sqlQuery := "SELECT " + recordColumns + " FROM urls WHERE " + strings.Join(where, " AND ") + " ORDER BY " + orderBy
+	if query.Limit > 0 {
+		sqlQuery += " LIMIT " + arg(query.Limit)
+	}
+
+	records, err := db.queryRecords(ctx, sqlQuery, args...)
+	return records, total, err
+}
+
+func (db *Database) GetAllRecords(ctx context.Context) ([]models.Record, error) {
+	return db.queryRecords(ctx, "SELECT "+recordColumns+" FROM urls WHERE is_deleted=false")
+}
+
+func (db *Database) queryRecords(ctx context.Context, query string, args ...any) (records []models.Record, err error) {
+	rows, err := db.DB.QueryContext(ctx, query, args...)
 	if err != nil {
 		return
 	}
@@ -252,7 +707,7 @@ func (db *Database) FindRecordsByUserID(ctx context.Context, userID int) (record
 
 	for rows.Next() {
 		var rec models.Record
-		err = rows.Scan(&rec.UUID, &rec.ShortURL, &rec.OriginalURL, &rec.DeletedFlag)
+		rec, err = scanRecord(rows)
 		if err != nil {
 			return
 		}
@@ -280,18 +735,13 @@ func (db *Database) FindUserByCookie(ctx context.Context, cookie string) (*model
 	return &user, nil
 }
 
-func (db *Database) GetUserRecords(ctx context.Context, cookie string) ([]models.Record, error) {
+func (db *Database) GetUserRecords(ctx context.Context, cookie string, query models.ListQuery) ([]models.Record, int, error) {
 	user, err := db.FindUserByCookie(ctx, cookie)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	records, err := db.FindRecordsByUserID(ctx, user.UserID)
-	if err != nil {
-		return nil, err
-	}
-
-	return records, nil
+	return db.FindRecordsByUserID(ctx, user.UserID, query)
 }
 
 func (db *Database) FindUserByID(ctx context.Context, userID int) (*models.User, error) {
@@ -329,33 +779,11 @@ func (db *Database) UpdateUser(ctx context.Context, id int, cookie string) error
 	return err
 }
 
-func (db *Database) FindRecordsBatchByShortURL(ctx context.Context, urls []string) (records []models.Record, err error) {
+func (db *Database) FindRecordsBatchByShortURL(ctx context.Context, urls []string) ([]models.Record, error) {
 	params := "{" + strings.Join(urls, ",") + "}"
 
-	rows, err := db.DB.QueryContext(ctx,
-		"SELECT uuid, short_url, origin_url, user_id, is_deleted FROM urls WHERE short_url = ANY($1::text[]);",
-		params,
-	)
-	if err != nil {
-		return
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var rec models.Record
-		err = rows.Scan(&rec.UUID, &rec.ShortURL, &rec.OriginalURL, &rec.UserID, &rec.DeletedFlag)
-		if err != nil {
-			return
-		}
-
-		records = append(records, rec)
-	}
-	err = rows.Err()
-	if err != nil {
-		return
-	}
-
-	return
+	return db.queryRecords(ctx,
+		"SELECT "+recordColumns+" FROM urls WHERE short_url = ANY($1::text[]);", params)
 }
 
 func (db *Database) DeleteBatchRecords(ctx context.Context, records []models.Record) error {
@@ -398,3 +826,262 @@ func (db *Database) DeleteUserURLs(ctx context.Context, message models.DeletedUR
 
 	return db.DeleteBatchRecords(ctx, deletedRecords)
 }
+
+func (db *Database) GetUserLabels(ctx context.Context, cookie, kind string) ([]models.LabelCount, error) {
+	user, err := db.FindUserByCookie(ctx, cookie)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `SELECT tags.name, COUNT(urls.short_url) FROM tags
+		JOIN url_tags ON url_tags.tag_id = tags.id
+		JOIN urls ON urls.short_url = url_tags.short_url AND urls.is_deleted = false
+		WHERE tags.user_id=$1 GROUP BY tags.name ORDER BY tags.name`
+	if kind == models.LabelFolder {
+		query = `SELECT folder, COUNT(*) FROM urls
+			WHERE user_id=$1 AND folder <> '' AND is_deleted=false GROUP BY folder ORDER BY folder`
+	}
+
+	rows, err := db.DB.QueryContext(ctx, query, user.UserID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	labels := []models.LabelCount{}
+	for rows.Next() {
+		var label models.LabelCount
+		if err := rows.Scan(&label.Name, &label.Count); err != nil {
+			return nil, err
+		}
+		labels = append(labels, label)
+	}
+
+	return labels, rows.Err()
+}
+
+func (db *Database) RenameUserLabel(ctx context.Context, cookie, kind, name, newName string) error {
+	user, err := db.FindUserByCookie(ctx, cookie)
+	if err != nil {
+		return err
+	}
+
+	if kind == models.LabelFolder {
+		return db.updateFolder(ctx, user.UserID, name, newName)
+	}
+
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var tagID int
+	err = tx.QueryRowContext(ctx, `SELECT id FROM tags WHERE user_id=$1 AND name=$2`, user.UserID, name).Scan(&tagID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	var newTagID int
+	err = tx.QueryRowContext(ctx,
+		`INSERT INTO tags(user_id, name) VALUES($1, $2)
+			ON CONFLICT (user_id, name) DO UPDATE SET name=EXCLUDED.name RETURNING id`,
+		user.UserID, newName).Scan(&newTagID)
+	if err != nil {
+		return err
+	}
+
+	if newTagID != tagID {
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO url_tags(short_url, tag_id) SELECT short_url, $2 FROM url_tags WHERE tag_id=$1
+				ON CONFLICT DO NOTHING`, tagID, newTagID)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, `DELETE FROM tags WHERE id=$1`, tagID); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (db *Database) DeleteUserLabel(ctx context.Context, cookie, kind, name string) error {
+	user, err := db.FindUserByCookie(ctx, cookie)
+	if err != nil {
+		return err
+	}
+
+	if kind == models.LabelFolder {
+		return db.updateFolder(ctx, user.UserID, name, "")
+	}
+
+	res, err := db.DB.ExecContext(ctx, `DELETE FROM tags WHERE user_id=$1 AND name=$2`, user.UserID, name)
+	if err != nil {
+		return err
+	}
+
+	return checkUpdated(res)
+}
+
+func (db *Database) updateFolder(ctx context.Context, userID int, name, newName string) error {
+	res, err := db.DB.ExecContext(ctx,
+		`UPDATE urls SET folder=$3, updated_at=now() WHERE user_id=$1 AND folder=$2`, userID, name, newName)
+	if err != nil {
+		return err
+	}
+
+	return checkUpdated(res)
+}
+
+func checkUpdated(res sql.Result) error {
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return models.ErrNotFound
+	}
+
+	return nil
+}
+
+func (db *Database) CreateWebhook(ctx context.Context, cookie string, hook models.Webhook) error {
+	user, err := db.FindUserByCookie(ctx, cookie)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.DB.ExecContext(ctx,
+		`INSERT INTO webhooks(id, user_id, url, secret, events, click_thresholds, created_at)
+			VALUES($1, $2, $3, $4, $5, $6, $7)`,
+		hook.ID, user.UserID, hook.URL, hook.Secret, hook.Events, hook.ClickThresholds, hook.CreatedAt)
+	return err
+}
+
+func (db *Database) GetUserWebhooks(ctx context.Context, cookie string) ([]models.Webhook, error) {
+	user, err := db.FindUserByCookie(ctx, cookie)
+	if err != nil {
+		return nil, err
+	}
+
+	return db.queryWebhooks(ctx,
+		`SELECT id, url, secret, events, click_thresholds, created_at FROM webhooks
+			WHERE user_id=$1 ORDER BY created_at`, user.UserID)
+}
+
+// GetLinkWebhooks returns the webhooks of the link owner.
+func (db *Database) GetLinkWebhooks(ctx context.Context, key string) ([]models.Webhook, error) {
+	return db.queryWebhooks(ctx,
+		`SELECT webhooks.id, webhooks.url, webhooks.secret, webhooks.events, webhooks.click_thresholds,
+			webhooks.created_at FROM webhooks JOIN urls ON urls.user_id = webhooks.user_id
+			WHERE urls.short_url=$1 ORDER BY webhooks.created_at`, key)
+}
+
+func (db *Database) queryWebhooks(ctx context.Context, query string, args ...any) ([]models.Webhook, error) {
+	rows, err := db.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hooks := []models.Webhook{}
+	for rows.Next() {
+		var hook models.Webhook
+		err := rows.Scan(&hook.ID, &hook.URL, &hook.Secret, &hook.Events, &hook.ClickThresholds, &hook.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, hook)
+	}
+
+	return hooks, rows.Err()
+}
+
+func (db *Database) DeleteWebhook(ctx context.Context, cookie, id string) error {
+	user, err := db.FindUserByCookie(ctx, cookie)
+	if err != nil {
+		return err
+	}
+
+	res, err := db.DB.ExecContext(ctx, `DELETE FROM webhooks WHERE id=$1 AND user_id=$2`, id, user.UserID)
+	if err != nil {
+		return err
+	}
+
+	return checkUpdated(res)
+}
+
+func (db *Database) AddWebhookDelivery(ctx context.Context, delivery models.WebhookDelivery) error {
+	_, err := db.DB.ExecContext(ctx,
+		`INSERT INTO webhook_deliveries(id, webhook_id, event_id, event_type, attempt, status_code, error,
+			success, created_at) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		delivery.ID, delivery.WebhookID, delivery.EventID, delivery.EventType, delivery.Attempt,
+		delivery.StatusCode, delivery.Error, delivery.Success, delivery.CreatedAt)
+	return err
+}
+
+func (db *Database) AddWebhookDeadLetter(ctx context.Context, delivery models.WebhookDelivery) error {
+	_, err := db.DB.ExecContext(ctx,
+		`INSERT INTO webhook_dead_letters(id, webhook_id, event_id, event_type, attempt, status_code, error,
+			payload, created_at) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		delivery.ID, delivery.WebhookID, delivery.EventID, delivery.EventType, delivery.Attempt,
+		delivery.StatusCode, delivery.Error, string(delivery.Payload), delivery.CreatedAt)
+	return err
+}
+
+func (db *Database) GetWebhookDeliveries(ctx context.Context, cookie string, query models.DeliveryQuery) ([]models.WebhookDelivery, error) {
+	user, err := db.FindUserByCookie(ctx, cookie)
+	if err != nil {
+		return nil, err
+	}
+
+	var exists bool
+	err = db.DB.QueryRowContext(ctx,
+		`SELECT EXISTS(SELECT 1 FROM webhooks WHERE id=$1 AND user_id=$2)`, query.WebhookID, user.UserID).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, models.ErrNotFound
+	}
+
+	sqlQuery := `SELECT id, webhook_id, event_id, event_type, attempt, status_code, error, success, NULL::jsonb,
+		created_at FROM webhook_deliveries WHERE webhook_id=$1 ORDER BY created_at DESC`
+	if query.DeadLetters {
+		sqlQuery = `SELECT id, webhook_id, event_id, event_type, attempt, status_code, error, false, payload,
+			created_at FROM webhook_dead_letters WHERE webhook_id=$1 ORDER BY created_at DESC`
+	}
+
+	args := []any{query.WebhookID}
+	if query.Limit > 0 {
+		sqlQuery += ` LIMIT $2`
+		args = append(args, query.Limit)
+	}
+
+	rows, err := db.DB.QueryContext(ctx, sqlQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []models.WebhookDelivery{}
+	for rows.Next() {
+		var delivery models.WebhookDelivery
+		var payload []byte
+		err := rows.Scan(&delivery.ID, &delivery.WebhookID, &delivery.EventID, &delivery.EventType,
+			&delivery.Attempt, &delivery.StatusCode, &delivery.Error, &delivery.Success, &payload,
+			&delivery.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		delivery.Payload = payload
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, rows.Err()
+}
@@ -4,28 +4,104 @@ import (
 	"bufio"
 	"context"
 	"encoding/json"
-	"errors"
 	"github.com/DavidGQK/go-link-shortener/internal/logger"
 	"github.com/DavidGQK/go-link-shortener/internal/models"
+	"github.com/DavidGQK/go-link-shortener/internal/storage/cachestorage"
 	"github.com/google/uuid"
 	"go.uber.org/zap"
 	"os"
+	"sync"
+	"time"
+)
+
+// Updates append the whole record again, the file is rewritten with the
+// current records once it has compactRatio lines per record.
+const (
+	compactRatio    = 4
+	compactMinLines = 1000
 )
 
 type FStor struct {
-	dataWriter *DataWriter
-	filename   string
-	links      map[string]string
-	mode       int
+	*cachestorage.CacheStor
+	// updateMu keeps a change to the cache and its line in the file
+	// together, so the file has the changes in the order they were made.
+	updateMu        sync.Mutex
+	dataWriter      *DataWriter
+	filename        string
+	compactMinLines int
 }
 
 type DataWriter struct {
+	mu      sync.Mutex
 	file    *os.File
 	encoder *json.Encoder
+	lines   int
 }
 
 func (p *DataWriter) WriteData(rec *models.Record) error {
-	return p.encoder.Encode(rec)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.encoder.Encode(rec); err != nil {
+		return err
+	}
+	p.lines++
+	return nil
+}
+
+func (p *DataWriter) Lines() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.lines
+}
+
+// Rewrite replaces the file with the records. They are taken while writes
+// wait, so no write is lost between the snapshot and the new file.
+func (p *DataWriter) Rewrite(filename string, snapshot func() []models.Record) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	records := snapshot()
+	tmpName := filename + ".tmp"
+	tmp, err := os.OpenFile(tmpName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+	for i := range records {
+		if err = encoder.Encode(&records[i]); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, filename)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	p.file.Close()
+	p.file = file
+	p.encoder = json.NewEncoder(file)
+	p.lines = len(records)
+	return nil
 }
 
 func (p *DataWriter) Close() error {
@@ -39,7 +115,7 @@ func NewDataWriter(file *os.File) (*DataWriter, error) {
 	}, nil
 }
 
-func NewFStor(filename string, mode int) (*FStor, error) {
+func NewFStor(filename string, mode int, dedupScope string) (*FStor, error) {
 	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
 	if err != nil {
 		logger.Log.Error("open filestorage error", zap.Error(err))
@@ -52,19 +128,38 @@ func NewFStor(filename string, mode int) (*FStor, error) {
 		return nil, err
 	}
 
+	cache, err := cachestorage.NewCacheStor(mode, dedupScope)
+	if err != nil {
+		return nil, err
+	}
+
 	newFStor := &FStor{
-		dataWriter: dataWr,
-		filename:   filename,
-		mode:       mode,
-		links:      make(map[string]string),
+		CacheStor:       cache,
+		dataWriter:      dataWr,
+		filename:        filename,
+		compactMinLines: compactMinLines,
 	}
 
 	return newFStor, nil
 }
 
 func (s *FStor) Restore() error {
-	fileScanner := bufio.NewScanner(s.dataWriter.file)
+	file, err := os.Open(s.filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	lines := 0
+	defer func() {
+		s.dataWriter.mu.Lock()
+		s.dataWriter.lines += lines
+		s.dataWriter.mu.Unlock()
+	}()
+
+	fileScanner := bufio.NewScanner(file)
 	for fileScanner.Scan() {
+		lines++
 		var rec models.Record
 		line := fileScanner.Text()
 		err := json.Unmarshal([]byte(line), &rec)
@@ -73,18 +168,29 @@ func (s *FStor) Restore() error {
 			continue
 		}
 
-		s.links[rec.ShortURL] = rec.OriginalURL
+		s.SetRecord(rec)
 	}
 
-	return nil
+	return fileScanner.Err()
 }
 
-func (s *FStor) Add(key, value, _ string) error {
-	id := uuid.NewString()
-	rec := models.Record{
-		UUID:        id,
-		ShortURL:    key,
-		OriginalURL: value,
+func (s *FStor) Add(rec models.Record, cookie string) error {
+	rec.UserID = s.UserID(cookie)
+	if rec.UUID == "" {
+		rec.UUID = uuid.NewString()
+	}
+	if rec.CreatedAt.IsZero() {
+		rec.CreatedAt = time.Now()
+	}
+	if rec.UpdatedAt.IsZero() {
+		rec.UpdatedAt = rec.CreatedAt
+	}
+
+	s.updateMu.Lock()
+	defer s.updateMu.Unlock()
+
+	if err := s.Insert(rec); err != nil {
+		return err
 	}
 
 	err := s.dataWriter.WriteData(&rec)
@@ -93,63 +199,162 @@ func (s *FStor) Add(key, value, _ string) error {
 		return err
 	}
 
-	s.links[key] = value
 	return nil
 }
 
-func (s *FStor) AddBatch(_ context.Context, records []models.Record) error {
+func (s *FStor) AddBatch(_ context.Context, records []models.Record, cookie string) error {
+	userID := s.UserID(cookie)
+	batch := make([]models.Record, 0, len(records))
 	for _, rec := range records {
+		rec.UserID = userID
+		if rec.CreatedAt.IsZero() {
+			rec.CreatedAt = time.Now()
+		}
+		if rec.UpdatedAt.IsZero() {
+			rec.UpdatedAt = rec.CreatedAt
+		}
+		batch = append(batch, rec)
+	}
+
+	s.updateMu.Lock()
+	defer s.updateMu.Unlock()
+
+	if err := s.Insert(batch...); err != nil {
+		return err
+	}
+
+	for _, rec := range batch {
 		err := s.dataWriter.WriteData(&rec)
 		if err != nil {
 			logger.Log.Error("error while writing data in batch", zap.Error(err))
 		}
-
-		s.links[rec.ShortURL] = rec.OriginalURL
 	}
 
 	return nil
 }
 
-func (s *FStor) Get(key string) (string, error) {
-	value, found := s.links[key]
-	if !found {
-		return "", errors.New("key not found")
+func (s *FStor) RegisterClick(_ context.Context, key string) (int, error) {
+	s.updateMu.Lock()
+	defer s.updateMu.Unlock()
+
+	rec, err := s.IncrementClicks(key)
+	if err != nil {
+		return 0, err
 	}
-	return value, nil
+
+	return rec.Clicks, s.writeUpdate(&rec)
 }
 
-func (s *FStor) GetMode() int {
-	return s.mode
+func (s *FStor) RegisterVariantClick(_ context.Context, key string, variant int) error {
+	s.updateMu.Lock()
+	defer s.updateMu.Unlock()
+
+	rec, err := s.IncrementVariantClicks(key, variant)
+	if err != nil {
+		return err
+	}
+
+	return s.writeUpdate(&rec)
 }
 
-func (s *FStor) GetByOriginURL(_ string) (string, error) {
-	return "", errors.New("not database mode")
+func (s *FStor) UpdateRecord(_ context.Context, rec models.Record, cookie string) error {
+	s.updateMu.Lock()
+	defer s.updateMu.Unlock()
+
+	rec, err := s.ReplaceRecord(rec, cookie)
+	if err != nil {
+		return err
+	}
+
+	return s.writeUpdate(&rec)
 }
 
-func (s *FStor) HealthCheck() error {
-	return errors.New("not database mode")
+func (s *FStor) UpdateMetadata(_ context.Context, key string, meta models.LinkMetadata) error {
+	s.updateMu.Lock()
+	defer s.updateMu.Unlock()
+
+	rec, err := s.FillMetadata(key, meta)
+	if err != nil {
+		return err
+	}
+
+	return s.writeUpdate(&rec)
 }
 
-func (s *FStor) CloseStorage() error {
-	return s.dataWriter.Close()
+func (s *FStor) RenameUserLabel(_ context.Context, cookie, kind, name, newName string) error {
+	return s.relabel(cookie, kind, name, newName)
 }
 
-func (s *FStor) GetUserRecords(_ context.Context, _ string) ([]models.Record, error) {
-	return nil, errors.New("not database mode")
+func (s *FStor) DeleteUserLabel(_ context.Context, cookie, kind, name string) error {
+	return s.relabel(cookie, kind, name, "")
 }
 
-func (s *FStor) FindUserByID(_ context.Context, _ int) (*models.User, error) {
-	return nil, errors.New("not database mode")
+func (s *FStor) relabel(cookie, kind, name, newName string) error {
+	s.updateMu.Lock()
+	defer s.updateMu.Unlock()
+
+	records, err := s.Relabel(cookie, kind, name, newName)
+	if err != nil {
+		return err
+	}
+
+	for _, rec := range records {
+		if err := s.writeUpdate(&rec); err != nil {
+			logger.Log.Error("error while writing relabeled record", zap.Error(err))
+			return err
+		}
+	}
+
+	return nil
 }
 
-func (s *FStor) CreateUser(_ context.Context) (*models.User, error) {
-	return nil, errors.New("not database mode")
+func (s *FStor) DeleteBatchRecords(_ context.Context, records []models.Record) error {
+	s.updateMu.Lock()
+	defer s.updateMu.Unlock()
+
+	for _, rec := range s.MarkDeleted(records) {
+		if err := s.writeUpdate(&rec); err != nil {
+			logger.Log.Error("error while writing deleted record", zap.Error(err))
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *FStor) DeleteUserURLs(_ context.Context, message models.DeletedURLMessage) error {
+	s.updateMu.Lock()
+	defer s.updateMu.Unlock()
+
+	for _, rec := range s.MarkUserDeleted(message) {
+		if err := s.writeUpdate(&rec); err != nil {
+			logger.Log.Error("error while writing deleted record", zap.Error(err))
+			return err
+		}
+	}
+
+	return nil
 }
 
-func (s *FStor) UpdateUser(_ context.Context, _ int, _ string) error {
-	return errors.New("not database mode")
+func (s *FStor) CloseStorage() error {
+	return s.dataWriter.Close()
 }
 
-func (s *FStor) DeleteUserURLs(_ context.Context, _ models.DeletedURLMessage) error {
-	return errors.New("not database mode")
+// writeUpdate appends an updated record and compacts the file when updates
+// make up most of it. Callers hold updateMu, so no update is written in
+// between.
+func (s *FStor) writeUpdate(rec *models.Record) error {
+	if err := s.dataWriter.WriteData(rec); err != nil {
+		return err
+	}
+
+	lines := s.dataWriter.Lines()
+	if lines < s.compactMinLines || lines < compactRatio*s.Len() {
+		return nil
+	}
+
+	if err := s.dataWriter.Rewrite(s.filename, s.Records); err != nil {
+		logger.Log.Error("filestorage compaction error", zap.Error(err))
+	}
+	return nil
 }
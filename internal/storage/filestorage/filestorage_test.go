@@ -0,0 +1,140 @@
+package filestorage
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/DavidGQK/go-link-shortener/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func countLines(t *testing.T, filename string) int {
+	file, err := os.Open(filename)
+	require.NoError(t, err)
+	defer file.Close()
+
+	lines := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines++
+	}
+	require.NoError(t, scanner.Err())
+	return lines
+}
+
+func Test_RegisterClickCompaction(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "storage.json")
+
+	s, err := NewFStor(filename, 1, models.DedupScopeNone)
+	require.NoError(t, err)
+	s.compactMinLines = 10
+
+	require.NoError(t, s.Add(models.Record{ShortURL: "first", OriginalURL: "https://practicum.yandex.ru/"}, ""))
+	require.NoError(t, s.Add(models.Record{ShortURL: "second", OriginalURL: "https://practicum.yandex.ru/second"}, ""))
+
+	for i := 0; i < 100; i++ {
+		clicks, err := s.RegisterClick(ctx, "first")
+		require.NoError(t, err)
+		assert.Equal(t, i+1, clicks)
+	}
+	require.NoError(t, s.CloseStorage())
+
+	assert.Less(t, countLines(t, filename), 10)
+
+	restored, err := NewFStor(filename, 1, models.DedupScopeNone)
+	require.NoError(t, err)
+	defer restored.CloseStorage()
+	require.NoError(t, restored.Restore())
+
+	rec, err := restored.Get("first")
+	require.NoError(t, err)
+	assert.Equal(t, 100, rec.Clicks)
+	_, err = restored.Get("second")
+	assert.NoError(t, err)
+}
+
+func Test_RestoreUsers(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "storage.json")
+
+	s, err := NewFStor(filename, 1, models.DedupScopeGlobal)
+	require.NoError(t, err)
+	user, err := s.CreateUser(ctx)
+	require.NoError(t, err)
+	require.NoError(t, s.UpdateUser(ctx, user.UserID, "session"))
+
+	require.NoError(t, s.Add(models.Record{ShortURL: "first", OriginalURL: "https://practicum.yandex.ru/", Tags: models.Tags{"docs"}}, "session"))
+	require.NoError(t, s.RenameUserLabel(ctx, "session", models.LabelTag, "docs", "reference"))
+	rec, err := s.Get("first")
+	require.NoError(t, err)
+	rec.Title = "Practicum"
+	require.NoError(t, s.UpdateRecord(ctx, rec, "session"))
+	require.NoError(t, s.CloseStorage())
+
+	restored, err := NewFStor(filename, 1, models.DedupScopeGlobal)
+	require.NoError(t, err)
+	defer restored.CloseStorage()
+	require.NoError(t, restored.Restore())
+
+	found, err := restored.FindUserByID(ctx, user.UserID)
+	require.NoError(t, err)
+	assert.Empty(t, found.Cookie, "sessions aren't saved")
+	require.NoError(t, restored.UpdateUser(ctx, user.UserID, "session"))
+
+	records, total, err := restored.GetUserRecords(ctx, "session", models.ListQuery{})
+	require.NoError(t, err)
+	require.Equal(t, 1, total)
+	assert.Equal(t, models.Tags{"reference"}, records[0].Tags)
+	assert.Equal(t, "Practicum", records[0].Title)
+
+	next, err := restored.CreateUser(ctx)
+	require.NoError(t, err)
+	assert.Greater(t, next.UserID, user.UserID, "restored users keep their ids")
+}
+
+// Test_DeleteWhileClicked checks that a click racing a delete never writes
+// its line after the delete, which would bring the link back on restore.
+func Test_DeleteWhileClicked(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "storage.json")
+
+	s, err := NewFStor(filename, 1, models.DedupScopeNone)
+	require.NoError(t, err)
+
+	const links = 50
+	var wg sync.WaitGroup
+	for i := 0; i < links; i++ {
+		rec := models.Record{ShortURL: fmt.Sprintf("link%d", i), OriginalURL: "https://practicum.yandex.ru/"}
+		require.NoError(t, s.Add(rec, ""))
+
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				_, _ = s.RegisterClick(ctx, rec.ShortURL)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, s.DeleteBatchRecords(ctx, []models.Record{rec}))
+		}()
+	}
+	wg.Wait()
+	require.NoError(t, s.CloseStorage())
+
+	restored, err := NewFStor(filename, 1, models.DedupScopeNone)
+	require.NoError(t, err)
+	defer restored.CloseStorage()
+	require.NoError(t, restored.Restore())
+
+	for i := 0; i < links; i++ {
+		_, err = restored.Get(fmt.Sprintf("link%d", i))
+		assert.ErrorIs(t, err, models.ErrDeleted)
+	}
+}
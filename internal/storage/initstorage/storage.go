@@ -18,22 +18,38 @@ type Storage struct {
 	storage models.StorageInterface
 }
 
-func NewStorage(filename string, dbConnData string) (*Storage, error) {
+// DefaultDedupScope is the dedup scope of a storage mode when none is
+// configured. It keeps what the modes always did: the database has unique
+// original urls, memory and file storages take repeated urls.
+func DefaultDedupScope(mode int) string {
+	if mode == DBMode {
+		return models.DedupScopeGlobal
+	}
+	return models.DedupScopeNone
+}
+
+func NewStorage(filename, dbConnData, dedupScope string) (*Storage, error) {
 	mode := MemoryMode
 
 	if dbConnData != "" {
 		mode = DBMode
-		datab, err := db.NewDB(dbConnData, mode)
+	} else if filename != "" {
+		mode = FileMode
+	}
+	if dedupScope == "" {
+		dedupScope = DefaultDedupScope(mode)
+	}
+
+	if mode == DBMode {
+		datab, err := db.NewDB(dbConnData, mode, dedupScope)
 		if err != nil {
 			return nil, err
 		}
 
 		return &Storage{storage: datab}, nil
 
-	} else if filename != "" {
-		mode = FileMode
-
-		fStore, err := filestorage.NewFStor(filename, mode)
+	} else if mode == FileMode {
+		fStore, err := filestorage.NewFStor(filename, mode, dedupScope)
 		if err != nil {
 			return nil, err
 		}
@@ -41,7 +57,7 @@ func NewStorage(filename string, dbConnData string) (*Storage, error) {
 		return &Storage{storage: fStore}, nil
 	}
 
-	cacheStore, err := cachestorage.NewCacheStor(mode)
+	cacheStore, err := cachestorage.NewCacheStor(mode, dedupScope)
 	if err != nil {
 		return nil, err
 	}
@@ -52,32 +68,36 @@ func (s *Storage) Restore() error {
 	return s.storage.Restore()
 }
 
-func (s *Storage) Add(key, value, cookie string) error {
-	return s.storage.Add(key, value, cookie)
+func (s *Storage) Add(rec models.Record, cookie string) error {
+	return s.storage.Add(rec, cookie)
 }
 
-func (s *Storage) AddBatch(ctx context.Context, records []models.Record) error {
-	return s.storage.AddBatch(ctx, records)
+func (s *Storage) AddBatch(ctx context.Context, records []models.Record, cookie string) error {
+	return s.storage.AddBatch(ctx, records, cookie)
 }
 
-func (s *Storage) Get(key string) (string, error) {
+func (s *Storage) Get(key string) (models.Record, error) {
 	return s.storage.Get(key)
 }
 
+func (s *Storage) GetUserRecord(ctx context.Context, cookie, key string) (models.Record, error) {
+	return s.storage.GetUserRecord(ctx, cookie, key)
+}
+
 func (s *Storage) GetMode() int {
 	return s.storage.GetMode()
 }
 
-func (s *Storage) GetByOriginURL(originURL string) (string, error) {
-	return s.storage.GetByOriginURL(originURL)
+func (s *Storage) GetByOriginURL(originURL, cookie string) (string, error) {
+	return s.storage.GetByOriginURL(originURL, cookie)
 }
 
 func (s *Storage) HealthCheck() error {
 	return s.storage.HealthCheck()
 }
 
-func (s *Storage) GetUserRecords(ctx context.Context, cookie string) ([]models.Record, error) {
-	return s.storage.GetUserRecords(ctx, cookie)
+func (s *Storage) GetUserRecords(ctx context.Context, cookie string, query models.ListQuery) ([]models.Record, int, error) {
+	return s.storage.GetUserRecords(ctx, cookie, query)
 }
 
 func (s *Storage) FindUserByID(ctx context.Context, userID int) (*models.User, error) {
@@ -95,3 +115,67 @@ func (s *Storage) UpdateUser(ctx context.Context, id int, cookie string) error {
 func (s *Storage) DeleteUserURLs(ctx context.Context, message models.DeletedURLMessage) error {
 	return s.storage.DeleteUserURLs(ctx, message)
 }
+
+func (s *Storage) GetAllRecords(ctx context.Context) ([]models.Record, error) {
+	return s.storage.GetAllRecords(ctx)
+}
+
+func (s *Storage) DeleteBatchRecords(ctx context.Context, records []models.Record) error {
+	return s.storage.DeleteBatchRecords(ctx, records)
+}
+
+func (s *Storage) RegisterClick(ctx context.Context, key string) (int, error) {
+	return s.storage.RegisterClick(ctx, key)
+}
+
+func (s *Storage) UpdateRecord(ctx context.Context, rec models.Record, cookie string) error {
+	return s.storage.UpdateRecord(ctx, rec, cookie)
+}
+
+func (s *Storage) RegisterVariantClick(ctx context.Context, key string, variant int) error {
+	return s.storage.RegisterVariantClick(ctx, key, variant)
+}
+
+func (s *Storage) GetUserLabels(ctx context.Context, cookie, kind string) ([]models.LabelCount, error) {
+	return s.storage.GetUserLabels(ctx, cookie, kind)
+}
+
+func (s *Storage) RenameUserLabel(ctx context.Context, cookie, kind, name, newName string) error {
+	return s.storage.RenameUserLabel(ctx, cookie, kind, name, newName)
+}
+
+func (s *Storage) DeleteUserLabel(ctx context.Context, cookie, kind, name string) error {
+	return s.storage.DeleteUserLabel(ctx, cookie, kind, name)
+}
+
+func (s *Storage) UpdateMetadata(ctx context.Context, key string, meta models.LinkMetadata) error {
+	return s.storage.UpdateMetadata(ctx, key, meta)
+}
+
+func (s *Storage) CreateWebhook(ctx context.Context, cookie string, hook models.Webhook) error {
+	return s.storage.CreateWebhook(ctx, cookie, hook)
+}
+
+func (s *Storage) GetUserWebhooks(ctx context.Context, cookie string) ([]models.Webhook, error) {
+	return s.storage.GetUserWebhooks(ctx, cookie)
+}
+
+func (s *Storage) DeleteWebhook(ctx context.Context, cookie, id string) error {
+	return s.storage.DeleteWebhook(ctx, cookie, id)
+}
+
+func (s *Storage) GetLinkWebhooks(ctx context.Context, key string) ([]models.Webhook, error) {
+	return s.storage.GetLinkWebhooks(ctx, key)
+}
+
+func (s *Storage) AddWebhookDelivery(ctx context.Context, delivery models.WebhookDelivery) error {
+	return s.storage.AddWebhookDelivery(ctx, delivery)
+}
+
+func (s *Storage) AddWebhookDeadLetter(ctx context.Context, delivery models.WebhookDelivery) error {
+	return s.storage.AddWebhookDeadLetter(ctx, delivery)
+}
+
+func (s *Storage) GetWebhookDeliveries(ctx context.Context, cookie string, query models.DeliveryQuery) ([]models.WebhookDelivery, error) {
+	return s.storage.GetWebhookDeliveries(ctx, cookie, query)
+}
@@ -0,0 +1,172 @@
+package targeting
+
+import (
+	"github.com/DavidGQK/go-link-shortener/internal/models"
+	"hash/fnv"
+	"net/http"
+	"strings"
+)
+
+const (
+	OSIOS     = "ios"
+	OSAndroid = "android"
+	OSWindows = "windows"
+	OSMacOS   = "macos"
+	OSLinux   = "linux"
+)
+
+const (
+	FamilyBot     = "bot"
+	FamilyEdge    = "edge"
+	FamilyOpera   = "opera"
+	FamilyChrome  = "chrome"
+	FamilyFirefox = "firefox"
+	FamilySafari  = "safari"
+)
+
+type Client struct {
+	OS     string
+	Family string
+}
+
+func Detect(userAgent string) Client {
+	return Client{
+		OS:     detectOS(userAgent),
+		Family: detectFamily(userAgent),
+	}
+}
+
+func detectOS(ua string) string {
+	switch {
+	case strings.Contains(ua, "iPhone"), strings.Contains(ua, "iPad"), strings.Contains(ua, "iPod"):
+		return OSIOS
+	case strings.Contains(ua, "Android"):
+		return OSAndroid
+	case strings.Contains(ua, "Windows"):
+		return OSWindows
+	case strings.Contains(ua, "Macintosh"), strings.Contains(ua, "Mac OS X"):
+		return OSMacOS
+	case strings.Contains(ua, "Linux"):
+		return OSLinux
+	}
+	return ""
+}
+
+func detectFamily(ua string) string {
+	lowerUA := strings.ToLower(ua)
+
+	switch {
+	case strings.Contains(lowerUA, "bot"), strings.Contains(lowerUA, "crawler"),
+		strings.Contains(lowerUA, "spider"):
+		return FamilyBot
+	case strings.Contains(ua, "Edg"):
+		return FamilyEdge
+	case strings.Contains(ua, "OPR"), strings.Contains(ua, "Opera"):
+		return FamilyOpera
+	case strings.Contains(ua, "Chrome"), strings.Contains(ua, "CriOS"):
+		return FamilyChrome
+	case strings.Contains(ua, "Firefox"), strings.Contains(ua, "FxiOS"):
+		return FamilyFirefox
+	case strings.Contains(ua, "Safari"):
+		return FamilySafari
+	}
+	return ""
+}
+
+func acceptedLanguages(header string) []string {
+	var languages []string
+
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if tag == "" || tag == "*" || strings.ReplaceAll(strings.TrimSpace(params), " ", "") == "q=0" {
+			continue
+		}
+		languages = append(languages, strings.ToLower(tag))
+	}
+
+	return languages
+}
+
+func matchesLanguage(rule, header string) bool {
+	rule = strings.ToLower(rule)
+
+	for _, lang := range acceptedLanguages(header) {
+		if lang == rule || strings.HasPrefix(lang, rule+"-") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func Matches(rule models.RedirectRule, r *http.Request, client Client) bool {
+	if rule.OS != "" && !strings.EqualFold(rule.OS, client.OS) {
+		return false
+	}
+
+	if rule.UserAgent != "" && !strings.EqualFold(rule.UserAgent, client.Family) {
+		return false
+	}
+
+	if rule.Language != "" && !matchesLanguage(rule.Language, r.Header.Get("Accept-Language")) {
+		return false
+	}
+
+	if rule.QueryParam != "" {
+		values, found := r.URL.Query()[rule.QueryParam]
+		if !found {
+			return false
+		}
+		if rule.QueryValue != "" && (len(values) == 0 || values[0] != rule.QueryValue) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Match returns the destination of the first rule matching the request.
+func Match(rules models.RedirectRules, r *http.Request) (string, bool) {
+	if len(rules) == 0 {
+		return "", false
+	}
+
+	client := Detect(r.UserAgent())
+	for _, rule := range rules {
+		if Matches(rule, r, client) {
+			return rule.URL, true
+		}
+	}
+
+	return "", false
+}
+
+// ChooseVariant picks a variant index by weight. The same key always
+// lands on the same variant as long as the weights don't change.
+func ChooseVariant(variants models.Variants, key string) int {
+	total := 0
+	for _, v := range variants {
+		if v.Weight > 0 {
+			total += v.Weight
+		}
+	}
+	if total == 0 {
+		return -1
+	}
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	point := int(h.Sum32() % uint32(total))
+
+	for i, v := range variants {
+		if v.Weight <= 0 {
+			continue
+		}
+		if point < v.Weight {
+			return i
+		}
+		point -= v.Weight
+	}
+
+	return len(variants) - 1
+}
@@ -0,0 +1,90 @@
+package targeting
+
+import (
+	"fmt"
+	"github.com/DavidGQK/go-link-shortener/internal/models"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_Match(t *testing.T) {
+	rules := models.RedirectRules{
+		{OS: OSIOS, URL: "https://apps.apple.com/app/id1"},
+		{OS: OSAndroid, URL: "https://play.google.com/store/apps/details?id=app"},
+		{Language: "ru", URL: "https://example.com/ru/"},
+		{QueryParam: "beta", URL: "https://beta.example.com/"},
+	}
+
+	tests := []struct {
+		name     string
+		target   string
+		ua       string
+		language string
+		want     string
+	}{
+		{
+			name: "iOS",
+			ua:   "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 Safari/604.1",
+			want: "https://apps.apple.com/app/id1",
+		},
+		{
+			name: "Android",
+			ua:   "Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 Chrome/120.0 Mobile Safari/537.36",
+			want: "https://play.google.com/store/apps/details?id=app",
+		},
+		{
+			name:     "Accept-Language",
+			ua:       "Mozilla/5.0 (Windows NT 10.0; Win64; x64) Firefox/121.0",
+			language: "en-US;q=0.5, ru-RU",
+			want:     "https://example.com/ru/",
+		},
+		{
+			name:   "Query parameter",
+			target: "/abc?beta",
+			ua:     "Mozilla/5.0 (Windows NT 10.0; Win64; x64) Firefox/121.0",
+			want:   "https://beta.example.com/",
+		},
+		{
+			name: "No match",
+			ua:   "Mozilla/5.0 (Windows NT 10.0; Win64; x64) Firefox/121.0",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := tt.target
+			if target == "" {
+				target = "/abc"
+			}
+
+			req := httptest.NewRequest(http.MethodGet, target, nil)
+			req.Header.Set("User-Agent", tt.ua)
+			req.Header.Set("Accept-Language", tt.language)
+
+			destination, matched := Match(rules, req)
+			assert.Equal(t, tt.want, destination)
+			assert.Equal(t, tt.want != "", matched)
+		})
+	}
+}
+
+func Test_ChooseVariant(t *testing.T) {
+	variants := models.Variants{
+		{URL: "https://example.com/a", Weight: 70},
+		{URL: "https://example.com/b", Weight: 30},
+	}
+
+	counts := make([]int, len(variants))
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("visitor-%d", i)
+		variant := ChooseVariant(variants, key)
+		assert.Equal(t, variant, ChooseVariant(variants, key))
+		counts[variant]++
+	}
+
+	assert.InDelta(t, 700, counts[0], 60)
+	assert.InDelta(t, 300, counts[1], 60)
+	assert.Equal(t, -1, ChooseVariant(nil, "visitor"))
+}
@@ -0,0 +1,227 @@
+package tlsconfig
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/DavidGQK/go-link-shortener/internal/logger"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMinVersion     = "1.2"
+	DefaultReloadInterval = 10 * time.Second
+)
+
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+type Options struct {
+	CertFile     string
+	KeyFile      string
+	MinVersion   string
+	CipherSuites string
+}
+
+// New returns the server tls config, its certificate is served by the
+// reloader. Cipher suites only apply up to TLS 1.2, the TLS 1.3 suites
+// aren't configurable.
+func New(o Options) (*tls.Config, *Reloader, error) {
+	if o.CertFile == "" || o.KeyFile == "" {
+		return nil, nil, fmt.Errorf("both tls certificate and key files are required")
+	}
+
+	minVersion, err := ParseVersion(o.MinVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	suites, err := ParseCipherSuites(o.CipherSuites)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	reloader, err := NewReloader(o.CertFile, o.KeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &tls.Config{
+		MinVersion:     minVersion,
+		CipherSuites:   suites,
+		GetCertificate: reloader.GetCertificate,
+	}, reloader, nil
+}
+
+// ParseVersion parses versions like "1.2", an empty version is the default.
+func ParseVersion(version string) (uint16, error) {
+	if version == "" {
+		version = DefaultMinVersion
+	}
+
+	parsed, found := versions[strings.TrimPrefix(strings.ToLower(version), "tls")]
+	if !found {
+		return 0, fmt.Errorf("unknown tls version %q", version)
+	}
+	return parsed, nil
+}
+
+// ParseCipherSuites parses comma separated names of secure cipher suites as
+// in tls.CipherSuites. An empty list keeps the Go defaults.
+func ParseCipherSuites(names string) ([]uint16, error) {
+	if strings.TrimSpace(names) == "" {
+		return nil, nil
+	}
+
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	var suites []uint16
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		id, found := known[name]
+		if !found {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		suites = append(suites, id)
+	}
+	return suites, nil
+}
+
+// Reloader serves the certificate from the files and reloads it when they
+// change. Handshakes pick the current certificate, so established
+// connections are left alone.
+type Reloader struct {
+	certFile string
+	keyFile  string
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	modTimes [2]time.Time
+}
+
+func NewReloader(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the files again. A broken pair keeps the previous
+// certificate in use.
+func (r *Reloader) Reload() error {
+	modTimes, err := r.stat()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.modTimes = modTimes
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// Watch reloads the certificate on every signal and when the modification
+// time of the files changes, checked every interval.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration, signals <-chan os.Signal) {
+	if interval <= 0 {
+		interval = DefaultReloadInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+			r.reload("signal")
+		case <-ticker.C:
+			if r.changed() {
+				r.reload("file change")
+			}
+		}
+	}
+}
+
+func (r *Reloader) reload(reason string) {
+	if err := r.Reload(); err != nil {
+		logger.Log.Error("tls certificate reload error", zap.String("reason", reason), zap.Error(err))
+		return
+	}
+	logger.Log.Infow("tls certificate reloaded", "reason", reason)
+}
+
+func (r *Reloader) changed() bool {
+	modTimes, err := r.stat()
+	if err != nil {
+		return false
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return modTimes != r.modTimes
+}
+
+func (r *Reloader) stat() ([2]time.Time, error) {
+	var modTimes [2]time.Time
+	for i, name := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return modTimes, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+// RedirectHandler sends plain http requests to the same url on the https
+// server listening on httpsAddress.
+func RedirectHandler(httpsAddress string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddress)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+
+		// 308 keeps the method and body of api requests
+		status := http.StatusPermanentRedirect
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			status = http.StatusMovedPermanently
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), status)
+	})
+}
@@ -0,0 +1,224 @@
+package tlsconfig
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/DavidGQK/go-link-shortener/internal/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	if err := logger.Initialize("fatal"); err != nil {
+		panic(err)
+	}
+
+	os.Exit(m.Run())
+}
+
+func writeCert(t *testing.T, dir, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
+
+func commonName(t *testing.T, r *Reloader) string {
+	cert, err := r.GetCertificate(nil)
+	require.NoError(t, err)
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	return parsed.Subject.CommonName
+}
+
+func Test_ParseVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    uint16
+		wantErr bool
+	}{
+		{version: "", want: tls.VersionTLS12},
+		{version: "1.3", want: tls.VersionTLS13},
+		{version: "TLS1.1", want: tls.VersionTLS11},
+		{version: "2.0", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			got, err := ParseVersion(tt.version)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_ParseCipherSuites(t *testing.T) {
+	suites, err := ParseCipherSuites("")
+	require.NoError(t, err)
+	assert.Nil(t, suites)
+
+	suites, err = ParseCipherSuites("TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384")
+	require.NoError(t, err)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}, suites)
+
+	_, err = ParseCipherSuites("TLS_RSA_WITH_RC4_128_SHA")
+	assert.Error(t, err)
+	_, err = ParseCipherSuites("unknown")
+	assert.Error(t, err)
+}
+
+func Test_New(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCert(t, dir, "first.example")
+
+	_, _, err := New(Options{CertFile: certFile})
+	assert.Error(t, err)
+	_, _, err = New(Options{CertFile: certFile, KeyFile: keyFile, MinVersion: "0.9"})
+	assert.Error(t, err)
+	_, _, err = New(Options{CertFile: filepath.Join(dir, "missing.pem"), KeyFile: keyFile})
+	assert.Error(t, err)
+
+	config, _, err := New(Options{CertFile: certFile, KeyFile: keyFile, MinVersion: "1.3"})
+	require.NoError(t, err)
+	assert.EqualValues(t, tls.VersionTLS13, config.MinVersion)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	require.NoError(t, err)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})}
+	go srv.Serve(listener)
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := client.Get("https://" + listener.Addr().String())
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, "first.example", resp.TLS.PeerCertificates[0].Subject.CommonName)
+}
+
+func Test_Watch(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCert(t, dir, "first.example")
+
+	r, err := NewReloader(certFile, keyFile)
+	require.NoError(t, err)
+	assert.Equal(t, "first.example", commonName(t, r))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	go r.Watch(ctx, 10*time.Millisecond, signals)
+
+	writeCert(t, dir, "second.example")
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, later, later))
+	assert.Eventually(t, func() bool {
+		return commonName(t, r) == "second.example"
+	}, time.Second, 5*time.Millisecond)
+
+	// a broken pair keeps the previous certificate
+	require.NoError(t, os.WriteFile(keyFile, []byte("broken"), 0600))
+	assert.Error(t, r.Reload())
+	assert.Equal(t, "second.example", commonName(t, r))
+
+	writeCert(t, dir, "third.example")
+	signals <- syscall.SIGHUP
+	assert.Eventually(t, func() bool {
+		return commonName(t, r) == "third.example"
+	}, time.Second, 5*time.Millisecond)
+}
+
+func Test_RedirectHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		address  string
+		method   string
+		target   string
+		host     string
+		status   int
+		location string
+	}{
+		{
+			name:     "default port",
+			address:  ":443",
+			method:   http.MethodGet,
+			target:   "/abc?x=1",
+			host:     "short.example:80",
+			status:   http.StatusMovedPermanently,
+			location: "https://short.example/abc?x=1",
+		},
+		{
+			name:     "custom port",
+			address:  "localhost:8443",
+			method:   http.MethodGet,
+			target:   "/abc",
+			host:     "short.example",
+			status:   http.StatusMovedPermanently,
+			location: "https://short.example:8443/abc",
+		},
+		{
+			name:     "ipv6",
+			address:  ":443",
+			method:   http.MethodGet,
+			target:   "/",
+			host:     "[::1]:80",
+			status:   http.StatusMovedPermanently,
+			location: "https://[::1]/",
+		},
+		{
+			name:     "api request",
+			address:  ":443",
+			method:   http.MethodPost,
+			target:   "/api/shorten",
+			host:     "short.example",
+			status:   http.StatusPermanentRedirect,
+			location: "https://short.example/api/shorten",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.target, nil)
+			r.Host = tt.host
+			w := httptest.NewRecorder()
+
+			RedirectHandler(tt.address).ServeHTTP(w, r)
+			assert.Equal(t, tt.status, w.Code)
+			assert.Equal(t, tt.location, w.Header().Get("Location"))
+		})
+	}
+}
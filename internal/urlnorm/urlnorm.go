@@ -0,0 +1,137 @@
+package urlnorm
+
+import (
+	"errors"
+	"golang.org/x/net/idna"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+var ErrInvalidURL = errors.New(`invalid url`)
+
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+	"ftp":   "21",
+}
+
+type Options struct {
+	SortQuery     bool
+	StripFragment bool
+}
+
+// Normalize brings equivalent URLs to a single canonical form, so that
+// https://Example.com, https://example.com/ and https://example.com:443
+// are stored and looked up as the same link.
+func Normalize(rawURL string, opts Options) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return "", ErrInvalidURL
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	if u.Opaque != "" {
+		return u.String(), nil
+	}
+
+	if u.Host != "" {
+		host, err := normalizeHost(u.Hostname())
+		if err != nil {
+			return "", err
+		}
+
+		port := u.Port()
+		if port == defaultPorts[u.Scheme] {
+			port = ""
+		}
+
+		if port != "" {
+			u.Host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			u.Host = "[" + host + "]"
+		} else {
+			u.Host = host
+		}
+
+		if u.Path == "" {
+			u.Path = "/"
+		}
+	}
+
+	if opts.SortQuery && u.RawQuery != "" {
+		u.RawQuery = sortQuery(u.RawQuery)
+	}
+
+	if opts.StripFragment {
+		u.Fragment = ""
+		u.RawFragment = ""
+	}
+
+	return u.String(), nil
+}
+
+// sortQuery sorts query parameters by key and keeps the order of repeated
+// keys. Keys without a value stay without one, ?flag and ?flag= aren't
+// always the same to the destination. Queries that don't parse are left
+// as they are.
+func sortQuery(rawQuery string) string {
+	type param struct {
+		key, pair string
+	}
+
+	var params []param
+	for _, part := range strings.Split(rawQuery, "&") {
+		if part == "" {
+			continue
+		}
+		if strings.Contains(part, ";") {
+			return rawQuery
+		}
+
+		rawKey, rawValue, hasValue := strings.Cut(part, "=")
+		key, err := url.QueryUnescape(rawKey)
+		if err != nil {
+			return rawQuery
+		}
+
+		pair := url.QueryEscape(key)
+		if hasValue {
+			value, err := url.QueryUnescape(rawValue)
+			if err != nil {
+				return rawQuery
+			}
+			pair += "=" + url.QueryEscape(value)
+		}
+		params = append(params, param{key: key, pair: pair})
+	}
+
+	sort.SliceStable(params, func(i, j int) bool {
+		return params[i].key < params[j].key
+	})
+
+	pairs := make([]string, len(params))
+	for i, p := range params {
+		pairs[i] = p.pair
+	}
+	return strings.Join(pairs, "&")
+}
+
+func normalizeHost(host string) (string, error) {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "" {
+		return "", ErrInvalidURL
+	}
+
+	if net.ParseIP(host) != nil {
+		return host, nil
+	}
+
+	asciiHost, err := idna.Lookup.ToASCII(host)
+	if err != nil {
+		return "", ErrInvalidURL
+	}
+
+	return asciiHost, nil
+}
@@ -0,0 +1,85 @@
+package urlnorm
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func Test_Normalize(t *testing.T) {
+	tests := []struct {
+		name string
+		url  string
+		opts Options
+		want string
+	}{
+		{
+			name: "Lowercase scheme and host",
+			url:  "HTTPS://Example.COM/Path",
+			want: "https://example.com/Path",
+		},
+		{
+			name: "Add root path",
+			url:  "https://example.com",
+			want: "https://example.com/",
+		},
+		{
+			name: "Drop default port",
+			url:  "https://example.com:443/",
+			want: "https://example.com/",
+		},
+		{
+			name: "Keep custom port",
+			url:  "http://example.com:8080/",
+			want: "http://example.com:8080/",
+		},
+		{
+			name: "Convert IDN to punycode",
+			url:  "https://пример.рф/",
+			want: "https://xn--e1afmkfd.xn--p1ai/",
+		},
+		{
+			name: "Sort query parameters",
+			url:  "https://example.com/?b=2&a=1",
+			opts: Options{SortQuery: true},
+			want: "https://example.com/?a=1&b=2",
+		},
+		{
+			name: "Keep keys without values",
+			url:  "https://example.com/?flag&b=2&a=1&empty=",
+			opts: Options{SortQuery: true},
+			want: "https://example.com/?a=1&b=2&empty=&flag",
+		},
+		{
+			name: "Keep the order of repeated keys",
+			url:  "https://example.com/?b=2&a=3&a=1&a",
+			opts: Options{SortQuery: true},
+			want: "https://example.com/?a=3&a=1&a&b=2",
+		},
+		{
+			name: "Encode sorted parameters alike",
+			url:  "https://example.com/?q=a+b&p=%7e",
+			opts: Options{SortQuery: true},
+			want: "https://example.com/?p=~&q=a+b",
+		},
+		{
+			name: "Strip fragment",
+			url:  "https://example.com/page#section",
+			opts: Options{StripFragment: true},
+			want: "https://example.com/page",
+		},
+		{
+			name: "Keep fragment by default",
+			url:  "https://example.com/page#section",
+			want: "https://example.com/page#section",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Normalize(tt.url, tt.opts)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,224 @@
+package validation
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"unicode/utf8"
+)
+
+const (
+	DefaultMaxLength      = 2048
+	DefaultAllowedSchemes = "http,https"
+)
+
+const (
+	CodeTooLong          = "url_too_long"
+	CodeInvalidURL       = "invalid_url"
+	CodeSchemeNotAllowed = "scheme_not_allowed"
+	CodeHostRequired     = "host_required"
+	CodePrivateHost      = "private_host"
+	CodeSelfReferencing  = "self_referencing"
+	CodeDomainBlocked    = "domain_blocked"
+	CodeDomainNotAllowed = "domain_not_allowed"
+	CodeRedirectStatus   = "invalid_redirect_status"
+	CodeInvalidPassword  = "invalid_password"
+	CodeMaxClicks        = "invalid_max_clicks"
+	CodeSchedule         = "invalid_schedule"
+	CodeRules            = "invalid_rules"
+	CodeVariants         = "invalid_variants"
+	CodeQueryPolicy      = "invalid_query_policy"
+	CodeDomain           = "invalid_domain"
+	CodeTags             = "invalid_tags"
+	CodeFolder           = "invalid_folder"
+	CodeMetadata         = "invalid_metadata"
+	CodeWebhook          = "invalid_webhook"
+	CodeInvalidJSON      = "invalid_json"
+	CodeInvalidRequest   = "invalid_request"
+)
+
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+type Policy struct {
+	AllowedSchemes []string
+	MaxLength      int
+	AllowPrivate   bool
+	OwnHosts       []string
+}
+
+func NewPolicy(allowedSchemes string, maxLength int, allowPrivate bool, shortURLBases ...string) Policy {
+	policy := Policy{
+		MaxLength:    maxLength,
+		AllowPrivate: allowPrivate,
+	}
+
+	if strings.TrimSpace(allowedSchemes) == "" {
+		allowedSchemes = DefaultAllowedSchemes
+	}
+
+	for _, scheme := range strings.Split(allowedSchemes, ",") {
+		scheme = strings.ToLower(strings.TrimSpace(scheme))
+		if scheme != "" {
+			policy.AllowedSchemes = append(policy.AllowedSchemes, scheme)
+		}
+	}
+
+	for _, shortURLBase := range shortURLBases {
+		if base, err := url.Parse(shortURLBase); err == nil && base.Hostname() != "" {
+			policy.OwnHosts = append(policy.OwnHosts, strings.ToLower(base.Hostname()))
+		}
+	}
+
+	return policy
+}
+
+func (p Policy) Validate(rawURL string) error {
+	if p.MaxLength > 0 && utf8.RuneCountInString(rawURL) > p.MaxLength {
+		return &Error{
+			Code:    CodeTooLong,
+			Message: fmt.Sprintf("url is longer than %d characters", p.MaxLength),
+		}
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return &Error{Code: CodeInvalidURL, Message: "url can't be parsed"}
+	}
+
+	if !p.isSchemeAllowed(u.Scheme) {
+		return &Error{
+			Code:    CodeSchemeNotAllowed,
+			Message: fmt.Sprintf("scheme %q is not allowed", u.Scheme),
+		}
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if host == "" {
+		return &Error{Code: CodeHostRequired, Message: "url must contain a host"}
+	}
+
+	if !p.AllowPrivate && isPrivateHost(host) {
+		return &Error{
+			Code:    CodePrivateHost,
+			Message: fmt.Sprintf("host %q points to a private or loopback address", host),
+		}
+	}
+
+	for _, ownHost := range p.OwnHosts {
+		if host == ownHost {
+			return &Error{Code: CodeSelfReferencing, Message: "url points to the shortener itself"}
+		}
+	}
+
+	return nil
+}
+
+func (p Policy) isSchemeAllowed(scheme string) bool {
+	if scheme == "" {
+		return false
+	}
+
+	for _, allowed := range p.AllowedSchemes {
+		if scheme == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isPrivateHost(host string) bool {
+	host = strings.TrimSuffix(host, ".")
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ip = parseNumericIPv4(host)
+	}
+	if ip == nil {
+		return false
+	}
+
+	return IsPrivateIP(ip)
+}
+
+// parseNumericIPv4 reads the shorthand IPv4 forms that browsers and
+// inet_aton accept besides dotted decimal: one to four parts in decimal,
+// octal or hex, the last part filling the remaining bytes, as in
+// 2130706433, 0x7f.1 or 0177.0.0.1. Other hosts return nil.
+func parseNumericIPv4(host string) net.IP {
+	parts := strings.Split(host, ".")
+	if len(parts) > 4 {
+		return nil
+	}
+
+	values := make([]uint64, len(parts))
+	for i, part := range parts {
+		base := 10
+		switch {
+		case strings.HasPrefix(part, "0x") || strings.HasPrefix(part, "0X"):
+			base, part = 16, part[2:]
+		case len(part) > 1 && part[0] == '0':
+			base, part = 8, part[1:]
+		}
+
+		value, err := strconv.ParseUint(part, base, 32)
+		if err != nil {
+			return nil
+		}
+		values[i] = value
+	}
+
+	var addr uint64
+	for i, value := range values[:len(values)-1] {
+		if value > 0xff {
+			return nil
+		}
+		addr |= value << (24 - 8*i)
+	}
+	last := values[len(values)-1]
+	if last >= 1<<(32-8*(len(values)-1)) {
+		return nil
+	}
+	addr |= last
+
+	return net.IPv4(byte(addr>>24), byte(addr>>16), byte(addr>>8), byte(addr))
+}
+
+// IsPrivateIP reports whether ip belongs to a private, loopback,
+// link-local or unspecified range.
+func IsPrivateIP(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast()
+}
+
+var ErrForbiddenAddress = errors.New("address is not allowed")
+
+// DialGuard is a net.Dialer Control function that refuses connections to
+// private addresses. It runs after name resolution, so a public host name
+// can't be pointed at an internal service.
+func DialGuard(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || IsPrivateIP(ip) {
+		return ErrForbiddenAddress
+	}
+	return nil
+}
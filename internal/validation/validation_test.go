@@ -0,0 +1,117 @@
+package validation
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"strings"
+	"testing"
+)
+
+func Test_Validate(t *testing.T) {
+	policy := NewPolicy("https, HTTP ,mailto", 40, false, "https://go.acme.com/", "https://l.acme.io")
+
+	tests := []struct {
+		name   string
+		url    string
+		policy *Policy
+		code   string
+	}{
+		{name: "Public https url", url: "https://practicum.yandex.ru/"},
+		{name: "Public http url", url: "http://practicum.yandex.ru/"},
+		{name: "Too long", url: "https://practicum.yandex.ru/" + strings.Repeat("a", 20), code: CodeTooLong},
+		{name: "Can't be parsed", url: "https://practicum.yandex.ru/%zz", code: CodeInvalidURL},
+		{name: "Scheme missing", url: "practicum.yandex.ru", code: CodeSchemeNotAllowed},
+		{name: "Scheme not allowed", url: "ftp://practicum.yandex.ru/", code: CodeSchemeNotAllowed},
+		{name: "Host missing", url: "mailto:user@example.com", code: CodeHostRequired},
+		{name: "Localhost", url: "http://localhost:8080/", code: CodePrivateHost},
+		{name: "Localhost subdomain", url: "http://api.localhost/", code: CodePrivateHost},
+		{name: "Localhost with trailing dot", url: "http://localhost./", code: CodePrivateHost},
+		{name: "Loopback", url: "http://127.0.0.1/", code: CodePrivateHost},
+		{name: "Private network", url: "http://192.168.1.1/", code: CodePrivateHost},
+		{name: "Link-local", url: "http://169.254.169.254/", code: CodePrivateHost},
+		{name: "Unspecified", url: "http://0.0.0.0/", code: CodePrivateHost},
+		{name: "IPv6 loopback", url: "http://[::1]/", code: CodePrivateHost},
+		{name: "IPv4-mapped IPv6 loopback", url: "http://[::ffff:127.0.0.1]/", code: CodePrivateHost},
+		{name: "Decimal loopback", url: "http://2130706433/", code: CodePrivateHost},
+		{name: "Hex loopback", url: "http://0x7f.1/", code: CodePrivateHost},
+		{name: "Octal loopback", url: "http://0177.0.0.1/", code: CodePrivateHost},
+		{name: "Short private", url: "http://10.1/", code: CodePrivateHost},
+		{name: "Hex private", url: "http://0xc0a80101/", code: CodePrivateHost},
+		{name: "Decimal public", url: "http://134744072/"},
+		{name: "Own host", url: "https://go.acme.com/abc", code: CodeSelfReferencing},
+		{name: "Own branded host", url: "https://L.acme.io/abc", code: CodeSelfReferencing},
+		{
+			name:   "Private allowed",
+			url:    "http://0x7f.1/",
+			policy: &Policy{AllowedSchemes: []string{"http"}, AllowPrivate: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := policy
+			if tt.policy != nil {
+				p = *tt.policy
+			}
+
+			err := p.Validate(tt.url)
+			if tt.code == "" {
+				assert.NoError(t, err)
+				return
+			}
+
+			var validationErr *Error
+			require.True(t, errors.As(err, &validationErr), "want a validation error, got %v", err)
+			assert.Equal(t, tt.code, validationErr.Code)
+			assert.NotEmpty(t, validationErr.Message)
+		})
+	}
+}
+
+func Test_NewPolicy(t *testing.T) {
+	policy := NewPolicy(" ", DefaultMaxLength, false, "not a url", "https://go.acme.com")
+	assert.Equal(t, []string{"http", "https"}, policy.AllowedSchemes)
+	assert.Equal(t, []string{"go.acme.com"}, policy.OwnHosts)
+}
+
+func Test_parseNumericIPv4(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{host: "2130706433", want: "127.0.0.1"},
+		{host: "0x7f000001", want: "127.0.0.1"},
+		{host: "0x7f.1", want: "127.0.0.1"},
+		{host: "127.1", want: "127.0.0.1"},
+		{host: "127.0.1", want: "127.0.0.1"},
+		{host: "0177.0.0.01", want: "127.0.0.1"},
+		{host: "0", want: "0.0.0.0"},
+		{host: "4294967296"},
+		{host: "256.1.1.1"},
+		{host: "1.2.65536"},
+		{host: "1.2.3.4.5"},
+		{host: "0x"},
+		{host: "08.1"},
+		{host: "1..2"},
+		{host: "example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			ip := parseNumericIPv4(tt.host)
+			if tt.want == "" {
+				assert.Nil(t, ip)
+				return
+			}
+			assert.True(t, net.ParseIP(tt.want).Equal(ip), "got %v", ip)
+		})
+	}
+}
+
+func Test_DialGuard(t *testing.T) {
+	assert.ErrorIs(t, DialGuard("tcp", "127.0.0.1:80", nil), ErrForbiddenAddress)
+	assert.ErrorIs(t, DialGuard("tcp", "[fe80::1]:80", nil), ErrForbiddenAddress)
+	assert.NoError(t, DialGuard("tcp", "8.8.8.8:443", nil))
+}
@@ -0,0 +1,358 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/DavidGQK/go-link-shortener/internal/logger"
+	"github.com/DavidGQK/go-link-shortener/internal/models"
+	"github.com/DavidGQK/go-link-shortener/internal/validation"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultWorkers     = 4
+	DefaultQueueSize   = 100
+	DefaultMaxAttempts = 5
+	DefaultBackoff     = time.Second
+	DefaultMaxBackoff  = 5 * time.Minute
+	DefaultTimeout     = 5 * time.Second
+
+	SignatureHeader = "X-Webhook-Signature"
+	EventHeader     = "X-Webhook-Event"
+	DeliveryHeader  = "X-Webhook-Delivery"
+)
+
+// Store keeps the delivery log and the dead letters of failed events and
+// finds the webhooks of a link's owner for queued clicks.
+type Store interface {
+	AddWebhookDelivery(context.Context, models.WebhookDelivery) error
+	AddWebhookDeadLetter(context.Context, models.WebhookDelivery) error
+	GetLinkWebhooks(context.Context, string) ([]models.Webhook, error)
+}
+
+type Options struct {
+	Workers      int
+	QueueSize    int
+	MaxAttempts  int
+	Backoff      time.Duration
+	MaxBackoff   time.Duration
+	Timeout      time.Duration
+	AllowPrivate bool
+}
+
+type job struct {
+	hook    models.Webhook
+	event   models.WebhookEvent
+	payload []byte
+	attempt int
+	// click is set for clicks that still need the webhook lookup
+	click *click
+}
+
+type click struct {
+	key    string
+	clicks int
+	link   models.ResponseUserURL
+}
+
+// Dispatcher posts events to webhook endpoints in the background. Failed
+// deliveries are retried with exponential backoff, events that fail the
+// final attempt are stored as dead letters.
+type Dispatcher struct {
+	client *http.Client
+	store  Store
+	opts   Options
+	jobs   chan job
+	done   chan struct{}
+	wg     sync.WaitGroup
+	once   sync.Once
+}
+
+func NewDispatcher(store Store, opts Options) *Dispatcher {
+	if opts.Workers <= 0 {
+		opts.Workers = DefaultWorkers
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultQueueSize
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = DefaultMaxAttempts
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = DefaultBackoff
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = DefaultMaxBackoff
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+
+	dialer := &net.Dialer{Timeout: opts.Timeout}
+	if !opts.AllowPrivate {
+		dialer.Control = validation.DialGuard
+	}
+
+	d := &Dispatcher{
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext:           dialer.DialContext,
+				TLSHandshakeTimeout:   opts.Timeout,
+				ResponseHeaderTimeout: opts.Timeout,
+				MaxIdleConns:          10,
+				IdleConnTimeout:       30 * time.Second,
+			},
+			Timeout: opts.Timeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		store: store,
+		opts:  opts,
+		jobs:  make(chan job, opts.QueueSize),
+		done:  make(chan struct{}),
+	}
+
+	d.wg.Add(opts.Workers)
+	for i := 0; i < opts.Workers; i++ {
+		go d.work()
+	}
+
+	return d
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of "timestamp.body".
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a "t=<timestamp>,v1=<signature>" header against body.
+func Verify(secret, header string, body []byte) bool {
+	var timestamp int64
+	var signature string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "t":
+			timestamp, _ = strconv.ParseInt(value, 10, 64)
+		case "v1":
+			signature = value
+		}
+	}
+
+	expected := Sign(secret, timestamp, body)
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+// Send never blocks: when the queue is full the event goes straight to
+// the dead letters.
+func (d *Dispatcher) Send(hook models.Webhook, event models.WebhookEvent) bool {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		logger.Log.Error("webhook payload encoding error", zap.Error(err))
+		return false
+	}
+
+	j := job{hook: hook, event: event, payload: payload}
+	select {
+	case d.jobs <- j:
+		return true
+	default:
+		d.deadLetter(j, 0, "delivery queue is full")
+		return false
+	}
+}
+
+// Click queues the click count of a link. A worker looks up the webhooks
+// of the link's owner and sends a threshold event to the ones that
+// registered the count, so the redirect doesn't wait for the lookup. Like
+// Send it never blocks, a click that doesn't fit in the queue is dropped.
+func (d *Dispatcher) Click(key string, clicks int, link models.ResponseUserURL) bool {
+	j := job{click: &click{key: key, clicks: clicks, link: link}}
+	select {
+	case d.jobs <- j:
+		return true
+	default:
+		logger.Log.Warnw("webhook queue is full, click dropped", "short_url", key, "clicks", clicks)
+		return false
+	}
+}
+
+// Close stops the workers. Queued events and events still waiting for
+// a retry are stored as dead letters.
+func (d *Dispatcher) Close() {
+	d.once.Do(func() {
+		close(d.done)
+	})
+	d.wg.Wait()
+
+	for {
+		select {
+		case j := <-d.jobs:
+			if j.click == nil {
+				d.deadLetter(j, 0, "dispatcher stopped before delivery")
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (d *Dispatcher) work() {
+	defer d.wg.Done()
+
+	for {
+		select {
+		case <-d.done:
+			return
+		case j := <-d.jobs:
+			if j.click != nil {
+				d.resolve(*j.click)
+				continue
+			}
+			d.deliver(j)
+		}
+	}
+}
+
+// resolve sends a threshold event for a queued click to the webhooks of
+// the link's owner that registered its count.
+func (d *Dispatcher) resolve(c click) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	hooks, err := d.store.GetLinkWebhooks(ctx, c.key)
+	cancel()
+	if err != nil {
+		logger.Log.Errorw("webhooks lookup error", "short_url", c.key, "error", err)
+		return
+	}
+
+	for _, hook := range hooks {
+		if !hook.Events.Has(models.EventLinkClickThreshold) || !hook.ClickThresholds.Has(c.clicks) {
+			continue
+		}
+		d.Send(hook, models.WebhookEvent{
+			ID:        uuid.NewString(),
+			Type:      models.EventLinkClickThreshold,
+			CreatedAt: time.Now(),
+			Link:      c.link,
+			Clicks:    c.clicks,
+		})
+	}
+}
+
+func (d *Dispatcher) deliver(j job) {
+	j.attempt++
+	status, err := d.post(j)
+
+	delivery := newDelivery(j, status, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	if err := d.store.AddWebhookDelivery(ctx, delivery); err != nil {
+		logger.Log.Error("webhook delivery log error", zap.Error(err))
+	}
+	cancel()
+
+	if err == nil {
+		return
+	}
+	if j.attempt >= d.opts.MaxAttempts {
+		d.deadLetter(j, status, err.Error())
+		return
+	}
+
+	time.AfterFunc(d.backoff(j.attempt), func() {
+		select {
+		case <-d.done:
+			d.deadLetter(j, status, "dispatcher stopped before retry")
+		case d.jobs <- j:
+		}
+	})
+}
+
+// backoff doubles the delay after every failed attempt.
+func (d *Dispatcher) backoff(attempt int) time.Duration {
+	delay := d.opts.Backoff
+	for i := 1; i < attempt && delay < d.opts.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > d.opts.MaxBackoff {
+		delay = d.opts.MaxBackoff
+	}
+	return delay
+}
+
+func (d *Dispatcher) post(j job) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.opts.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, j.hook.URL, bytes.NewReader(j.payload))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go-link-shortener webhooks")
+	req.Header.Set(EventHeader, j.event.Type)
+	req.Header.Set(DeliveryHeader, j.event.ID)
+	req.Header.Set(SignatureHeader,
+		fmt.Sprintf("t=%d,v1=%s", timestamp, Sign(j.hook.Secret, timestamp, j.payload)))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+func (d *Dispatcher) deadLetter(j job, status int, reason string) {
+	delivery := newDelivery(j, status, nil)
+	delivery.Success = false
+	delivery.Error = reason
+	delivery.Payload = j.payload
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := d.store.AddWebhookDeadLetter(ctx, delivery); err != nil {
+		logger.Log.Error("webhook dead letter error", zap.Error(err))
+	}
+}
+
+func newDelivery(j job, status int, err error) models.WebhookDelivery {
+	delivery := models.WebhookDelivery{
+		ID:         uuid.NewString(),
+		WebhookID:  j.hook.ID,
+		EventID:    j.event.ID,
+		EventType:  j.event.Type,
+		Attempt:    j.attempt,
+		StatusCode: status,
+		Success:    err == nil,
+		CreatedAt:  time.Now(),
+	}
+	if err != nil {
+		delivery.Error = err.Error()
+	}
+	return delivery
+}
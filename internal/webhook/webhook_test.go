@@ -0,0 +1,182 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/DavidGQK/go-link-shortener/internal/logger"
+	"github.com/DavidGQK/go-link-shortener/internal/models"
+	"github.com/DavidGQK/go-link-shortener/internal/storage/cachestorage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	if err := logger.Initialize("fatal"); err != nil {
+		panic(err)
+	}
+
+	os.Exit(m.Run())
+}
+
+func Test_Sign(t *testing.T) {
+	body := []byte(`{"type":"link.created"}`)
+	signature := Sign("secret", 1700000000, body)
+
+	assert.True(t, Verify("secret", "t=1700000000,v1="+signature, body))
+	assert.False(t, Verify("other", "t=1700000000,v1="+signature, body))
+	assert.False(t, Verify("secret", "t=1700000001,v1="+signature, body))
+	assert.False(t, Verify("secret", "t=1700000000,v1="+signature, []byte(`{}`)))
+}
+
+// session is the user that newStore registers the webhook for.
+const session = "session"
+
+func newStore(t *testing.T, hook models.Webhook) *cachestorage.CacheStor {
+	ctx := context.Background()
+	store, err := cachestorage.NewCacheStor(0, "")
+	require.NoError(t, err)
+	user, err := store.CreateUser(ctx)
+	require.NoError(t, err)
+	require.NoError(t, store.UpdateUser(ctx, user.UserID, session))
+	require.NoError(t, store.CreateWebhook(ctx, session, hook))
+	return store
+}
+
+func waitDeliveries(t *testing.T, store *cachestorage.CacheStor, query models.DeliveryQuery, count int) []models.WebhookDelivery {
+	var deliveries []models.WebhookDelivery
+	require.Eventually(t, func() bool {
+		var err error
+		deliveries, err = store.GetWebhookDeliveries(context.Background(), session, query)
+		require.NoError(t, err)
+		return len(deliveries) >= count
+	}, 3*time.Second, 10*time.Millisecond)
+	return deliveries
+}
+
+func Test_DispatcherRetry(t *testing.T) {
+	var calls atomic.Int32
+	received := make(chan models.WebhookEvent, 1)
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		if !Verify("secret", r.Header.Get(SignatureHeader), body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var event models.WebhookEvent
+		_ = json.Unmarshal(body, &event)
+		received <- event
+	}))
+	defer endpoint.Close()
+
+	hook := models.Webhook{ID: "hook", URL: endpoint.URL, Secret: "secret"}
+	store := newStore(t, hook)
+	dispatcher := NewDispatcher(store, Options{Backoff: 10 * time.Millisecond, AllowPrivate: true})
+	defer dispatcher.Close()
+
+	require.True(t, dispatcher.Send(hook, models.WebhookEvent{ID: "event", Type: models.EventLinkCreated}))
+
+	select {
+	case event := <-received:
+		assert.Equal(t, "event", event.ID)
+	case <-time.After(3 * time.Second):
+		t.Fatal("event wasn't delivered")
+	}
+
+	deliveries := waitDeliveries(t, store, models.DeliveryQuery{WebhookID: "hook"}, 3)
+	assert.True(t, deliveries[0].Success)
+	assert.Equal(t, 3, deliveries[0].Attempt)
+	assert.Equal(t, http.StatusServiceUnavailable, deliveries[1].StatusCode)
+}
+
+func Test_DispatcherDeadLetter(t *testing.T) {
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer endpoint.Close()
+
+	hook := models.Webhook{ID: "hook", URL: endpoint.URL, Secret: "secret"}
+	store := newStore(t, hook)
+	dispatcher := NewDispatcher(store, Options{MaxAttempts: 2, Backoff: 10 * time.Millisecond, AllowPrivate: true})
+	defer dispatcher.Close()
+
+	dispatcher.Send(hook, models.WebhookEvent{ID: "event", Type: models.EventLinkDeleted})
+
+	dead := waitDeliveries(t, store, models.DeliveryQuery{WebhookID: "hook", DeadLetters: true}, 1)
+	assert.Equal(t, 2, dead[0].Attempt)
+	assert.Equal(t, http.StatusInternalServerError, dead[0].StatusCode)
+
+	var event models.WebhookEvent
+	require.NoError(t, json.Unmarshal(dead[0].Payload, &event))
+	assert.Equal(t, "event", event.ID)
+}
+
+func Test_DispatcherGuard(t *testing.T) {
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer endpoint.Close()
+
+	hook := models.Webhook{ID: "hook", URL: endpoint.URL, Secret: "secret"}
+	store := newStore(t, hook)
+	dispatcher := NewDispatcher(store, Options{MaxAttempts: 1})
+	defer dispatcher.Close()
+
+	dispatcher.Send(hook, models.WebhookEvent{ID: "event", Type: models.EventLinkCreated})
+
+	deliveries := waitDeliveries(t, store, models.DeliveryQuery{WebhookID: "hook"}, 1)
+	assert.False(t, deliveries[0].Success)
+	assert.Contains(t, deliveries[0].Error, "not allowed")
+}
+
+func Test_DispatcherClick(t *testing.T) {
+	received := make(chan models.WebhookEvent, 2)
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event models.WebhookEvent
+		_ = json.NewDecoder(r.Body).Decode(&event)
+		received <- event
+	}))
+	defer endpoint.Close()
+
+	hook := models.Webhook{
+		ID:              "hook",
+		URL:             endpoint.URL,
+		Secret:          "secret",
+		Events:          models.WebhookEvents{models.EventLinkClickThreshold},
+		ClickThresholds: models.ClickThresholds{2},
+	}
+	store := newStore(t, hook)
+	require.NoError(t, store.Add(models.Record{ShortURL: "clicked123", OriginalURL: "https://practicum.yandex.ru/"}, session))
+	dispatcher := NewDispatcher(store, Options{AllowPrivate: true})
+	defer dispatcher.Close()
+
+	link := models.ResponseUserURL{ShortURL: "http://localhost/clicked123"}
+	require.True(t, dispatcher.Click("clicked123", 1, link))
+	require.True(t, dispatcher.Click("clicked123", 2, link))
+	require.True(t, dispatcher.Click("unknown123", 2, link))
+
+	select {
+	case event := <-received:
+		assert.Equal(t, models.EventLinkClickThreshold, event.Type)
+		assert.Equal(t, 2, event.Clicks)
+		assert.Equal(t, link.ShortURL, event.Link.ShortURL)
+	case <-time.After(3 * time.Second):
+		t.Fatal("click threshold event wasn't delivered")
+	}
+
+	select {
+	case event := <-received:
+		t.Fatalf("unexpected event for %d clicks", event.Clicks)
+	case <-time.After(100 * time.Millisecond):
+	}
+}